@@ -5,6 +5,7 @@ package server
 
 import (
 	"context"
+	"errors"
 
 	"gorm.io/gorm"
 )
@@ -14,6 +15,7 @@ type GetArtistInput struct {
 }
 
 type ArtistOutput struct {
+	ETag string `header:"ETag"`
 	Body struct {
 		Artist Artist `json:"artist"`
 	}
@@ -25,15 +27,34 @@ func GetArtistByID(tx *gorm.DB, Id uint) (*Artist, error) {
 	return artist, DBErrToHumaErr(err)
 }
 
-func GetArtist(ctx context.Context, input *GetArtistInput) (*ArtistOutput, error) {
+type GetArtistConditionalInput struct {
+	Id uint `path:"id" example:"1"`
+	ConditionalGetInput
+}
+
+type GetArtistOutput struct {
+	CacheHeaders
+	Status int
+	Body   struct {
+		Artist Artist `json:"artist"`
+	}
+}
+
+func GetArtist(ctx context.Context, input *GetArtistConditionalInput) (*GetArtistOutput, error) {
 	tx := GetDB(ctx)
 
-	artist_output := &ArtistOutput{}
+	artist_output := &GetArtistOutput{}
 	artist, err := GetArtistByID(tx, input.Id)
 	if err != nil {
 		return nil, err
 	}
 	artist_output.Body.Artist = *artist
+	artist_output.setValidators(revisionETag(artist.Revision), artist.UpdatedAt)
+	if input.notModified(artist_output.CacheHeaders) {
+		artist_output.Status = 304
+	} else {
+		artist_output.Status = 200
+	}
 	return artist_output, nil
 }
 
@@ -47,7 +68,7 @@ type CreateArtistInput struct {
 }
 
 func createArtist(db *gorm.DB, artist *Artist, info *ArtistInfo) error {
-	return db.Transaction(func(tx *gorm.DB) error {
+	return transaction(db, func(tx *gorm.DB) error {
 		if err := info.to_Artist(artist); err != nil {
 			return err
 		}
@@ -60,7 +81,7 @@ func CreateArtist(ctx context.Context, input *CreateArtistInput) (*ArtistOutput,
 	db := GetDB(ctx)
 	output := ArtistOutput{}
 
-	err := db.Transaction(func(tx *gorm.DB) error {
+	err := transaction(db, func(tx *gorm.DB) error {
 		artist := Artist{}
 		if err := createArtist(tx, &artist, &input.Body); err != nil {
 			return err
@@ -72,9 +93,18 @@ func CreateArtist(ctx context.Context, input *CreateArtistInput) (*ArtistOutput,
 	return &output, err
 }
 
+// ArtistInfo with every field optional, used as a JSON Merge Patch
+type ArtistInfoPatch struct {
+	Name            *string  `json:"name,omitempty" nullable:"true"`
+	AdditionalNames []string `json:"additional_names,omitempty"`
+}
+
+// Only the fields of the body are updated (JSON Merge Patch, RFC 7396)
 type UpdateArtistInput struct {
-	Id   uint `path:"id"`
-	Body ArtistInfo
+	Id      uint   `path:"id"`
+	IfMatch string `header:"If-Match" doc:"ETag of the version the edit is based on"`
+	Body    ArtistInfoPatch
+	RawBody []byte
 }
 
 func updateArtist(tx *gorm.DB, artist *Artist) error {
@@ -94,42 +124,140 @@ func updateArtist(tx *gorm.DB, artist *Artist) error {
 
 func UpdateArtist(ctx context.Context, input *UpdateArtistInput) (*ArtistOutput, error) {
 	db := GetDB(ctx)
-	artist := Artist{}
-	err := db.First(&artist, input.Id).Error
-	if err != nil {
-		return nil, err
-	}
-	err = input.Body.to_Artist(&artist)
-	if err != nil {
-		return nil, err
-	}
+	out := &ArtistOutput{}
 
-	err = db.Transaction(func(tx *gorm.DB) error {
-		return updateArtist(tx, &artist)
+	err := transaction(db, func(tx *gorm.DB) error {
+		artist := &out.Body.Artist
+		err := tx.Scopes(CurrentArtists).Preload("AdditionalNames").First(artist, input.Id).Error
+		if err != nil {
+			return err
+		}
+
+		err = checkIfMatch(input.IfMatch, artist.Revision)
+		if err != nil {
+			return err
+		}
+
+		info, err := mergePatchInfo(artistInfoFromDB(*artist), input.RawBody)
+		if err != nil {
+			return err
+		}
+		err = info.to_Artist(artist)
+		if err != nil {
+			return err
+		}
+
+		err = updateArtist(WithRevisionCheck(tx), artist)
+		if err != nil {
+			return err
+		}
+		out.ETag = revisionETag(artist.Revision)
+		return nil
 	})
+	if errors.Is(err, ErrStaleRevision) {
+		current := Artist{}
+		err = db.Scopes(CurrentArtists).Preload("AdditionalNames").First(&current, input.Id).Error
+		if err != nil {
+			return nil, DBErrToHumaErr(err)
+		}
+		return nil, revisionConflict(current.Revision, current)
+	}
 	if err != nil {
-		return nil, err
+		return nil, DBErrToHumaErr(err)
 	}
 
-	out := &ArtistOutput{}
-	out.Body.Artist = artist
-
 	return out, nil
 }
 
+func artistInfoFromDB(artist Artist) ArtistInfo {
+	info := ArtistInfo{Name: artist.Name, AdditionalNames: make([]string, len(artist.AdditionalNames))}
+	for i, name := range artist.AdditionalNames {
+		info.AdditionalNames[i] = name.Name
+	}
+	return info
+}
+
 func (info ArtistInfo) to_Artist(artist *Artist) error {
 	artist.Name = info.Name
 	artist.AdditionalNames = createAdditionalNames(info.AdditionalNames)
 	return nil
 }
 
+type RevertArtistInput struct {
+	Id        uint `path:"id"`
+	HistoryId uint `path:"history_id"`
+}
+
+func RevertArtist(ctx context.Context, input *RevertArtistInput) (*ArtistOutput, error) {
+	db := GetDB(ctx)
+	out := &ArtistOutput{}
+
+	err := transaction(db, func(tx *gorm.DB) error {
+		artist, err := GetArtistByID(tx, input.Id)
+		if err != nil {
+			return err
+		}
+		historic := Artist{}
+		err = tx.Preload("AdditionalNames").
+			Where(&Artist{CurrentArtistID: &input.Id}).
+			First(&historic, input.HistoryId).Error
+		if err != nil {
+			return DBErrToHumaErr(err)
+		}
+
+		artist.Name = historic.Name
+		artist.AdditionalNames = historic.AdditionalNames
+		err = updateArtist(tx, artist)
+		out.Body.Artist = *artist
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+type ArtistHistoryOutput struct {
+	CacheHeaders
+	Status int
+	Body   struct {
+		History []Artist `json:"history"`
+	}
+}
+
+func GetArtistHistory(ctx context.Context, input *GetArtistConditionalInput) (*ArtistHistoryOutput, error) {
+	out := &ArtistHistoryOutput{}
+	db := GetDB(ctx)
+	err := db.Preload("AdditionalNames").Where(&Artist{CurrentArtistID: &input.Id}).Find(&out.Body.History).Error
+	if err != nil {
+		return nil, err
+	}
+
+	out.CacheHeaders = historyValidators(out.Body.History, func(a Artist) gorm.Model { return a.Model })
+	if input.notModified(out.CacheHeaders) {
+		out.Status = 304
+	} else {
+		out.Status = 200
+	}
+	return out, nil
+}
+
 type DeleteArtistResponse struct {
 	Status int
 }
 
 func DeleteArtist(ctx context.Context, input *GetArtistInput) (*DeleteArtistResponse, error) {
 	tx := GetDB(ctx)
-	err := tx.Scopes(CurrentArtists).Delete(&Artist{}, input.Id).Error
+	artist := Artist{}
+	err := tx.Scopes(CurrentArtists).First(&artist, input.Id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &DeleteArtistResponse{204}, nil
+	}
+	if err == nil {
+		// delete the loaded artist so its hooks know which one it is
+		err = tx.Delete(&artist).Error
+	}
 	return &DeleteArtistResponse{204}, DBErrToHumaErr(err)
 }
 
@@ -138,7 +266,12 @@ type FindArtistInput struct {
 }
 
 func findArtist(tx *gorm.DB, names []string, artist *Artist) error {
-	err := tx.Where("Name in ?", names).First(&artist).Error
+	err := tx.Scopes(CurrentArtists).Where("Name in ?", names).First(&artist).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// names of merged duplicates are kept as additional names
+		ids := additionalNameOwners(tx, "artists_additional_name", "artist_id", names)
+		err = tx.Scopes(CurrentArtists).Where("id IN (?)", ids).First(&artist).Error
+	}
 	return err
 }
 
@@ -153,11 +286,11 @@ func FindArtist(ctx context.Context, input *FindArtistInput) (*ArtistOutput, err
 }
 
 type AllArtistsInput struct {
-	IfNoneMatch string `header:"If-None-Match"`
+	ConditionalGetInput
 }
 
 type AllArtistsOutput struct {
-	ETag   string `header:"ETag"`
+	CacheHeaders
 	Status int
 	Body   []Artist `json:"artists"`
 }
@@ -166,14 +299,13 @@ func GetAllArtists(ctx context.Context, input *AllArtistsInput) (*AllArtistsOutp
 	db := GetDB(ctx)
 	out := &AllArtistsOutput{}
 
-	last_artist := Artist{}
-	err := db.Last(&last_artist).Error
-	err = setETag(last_artist.ID, err, &out.ETag)
+	var err error
+	out.CacheHeaders, err = tablesValidators(db, &Artist{})
 	if err != nil {
 		return nil, err
 	}
 
-	if out.ETag == input.IfNoneMatch {
+	if input.notModified(out.CacheHeaders) {
 		out.Status = 304
 	} else {
 		out.Status = 200
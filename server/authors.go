@@ -5,12 +5,15 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
 
 	"gorm.io/gorm"
 )
 
 type GetAuthorInput struct {
 	Id uint `path:"id" example:"1"`
+	ConditionalGetInput
 }
 
 type AuthorOutput struct {
@@ -25,15 +28,30 @@ func GetAuthorById(tx *gorm.DB, Id uint) (*TimingAuthor, error) {
 	return author, DBErrToHumaErr(err)
 }
 
-func GetAuthor(ctx context.Context, input *GetAuthorInput) (*AuthorOutput, error) {
+type GetAuthorOutput struct {
+	CacheHeaders
+	Status int
+	Body   struct {
+		Author TimingAuthor `json:"author"`
+	}
+}
+
+func GetAuthor(ctx context.Context, input *GetAuthorInput) (*GetAuthorOutput, error) {
 	tx := GetDB(ctx)
 
-	author_output := &AuthorOutput{}
+	author_output := &GetAuthorOutput{}
 	author, err := GetAuthorById(tx, input.Id)
 	if err != nil {
 		return nil, err
 	}
 	author_output.Body.Author = *author
+	// authors are not versioned
+	author_output.setValidators(fmt.Sprint(author.UpdatedAt.UnixMicro()), author.UpdatedAt)
+	if input.notModified(author_output.CacheHeaders) {
+		author_output.Status = 304
+	} else {
+		author_output.Status = 200
+	}
 	return author_output, nil
 }
 
@@ -50,7 +68,7 @@ func CreateAuthor(ctx context.Context, input *CreateAuthorInput) (*AuthorOutput,
 	db := GetDB(ctx)
 	output := AuthorOutput{}
 
-	err := db.Transaction(func(tx *gorm.DB) error {
+	err := transaction(db, func(tx *gorm.DB) error {
 		author := TimingAuthor{}
 		err := input.Body.to_TimingAuthor(&author)
 		if err != nil {
@@ -90,7 +108,7 @@ func UpdateAuthor(ctx context.Context, input *UpdateAuthorInput) (*AuthorOutput,
 		return nil, err
 	}
 
-	err = db.Transaction(func(tx *gorm.DB) error {
+	err = transaction(db, func(tx *gorm.DB) error {
 		return updateAuthor(tx, &author)
 	})
 	if err != nil {
@@ -115,7 +133,15 @@ type DeleteAuthorResponse struct {
 
 func DeleteAuthor(ctx context.Context, input *GetArtistInput) (*DeleteAuthorResponse, error) {
 	db := GetDB(ctx)
-	err := db.Delete(&TimingAuthor{}, input.Id).Error
+	author := TimingAuthor{}
+	err := db.First(&author, input.Id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &DeleteAuthorResponse{204}, nil
+	}
+	if err == nil {
+		// delete the loaded author so its hooks know which one it is
+		err = db.Delete(&author).Error
+	}
 	return &DeleteAuthorResponse{204}, DBErrToHumaErr(err)
 }
 
@@ -130,13 +156,31 @@ func FindAuthor(ctx context.Context, input *FindAuthorInput) (*AuthorOutput, err
 	return out, DBErrToHumaErr(err)
 }
 
+type AllAuthorInput struct {
+	ConditionalGetInput
+}
+
 type AllAuthorOutput struct {
-	Body []TimingAuthor `json:"authors"`
+	CacheHeaders
+	Status int
+	Body   []TimingAuthor `json:"authors"`
 }
 
-func GetAllAuthors(ctx context.Context, input *struct{}) (*AllAuthorOutput, error) {
+func GetAllAuthors(ctx context.Context, input *AllAuthorInput) (*AllAuthorOutput, error) {
 	db := GetDB(ctx)
 	out := &AllAuthorOutput{}
-	err := db.Find(&out.Body).Error
+
+	var err error
+	out.CacheHeaders, err = tablesValidators(db, &TimingAuthor{})
+	if err != nil {
+		return nil, err
+	}
+
+	if input.notModified(out.CacheHeaders) {
+		out.Status = 304
+	} else {
+		out.Status = 200
+		err = db.Find(&out.Body).Error
+	}
 	return out, DBErrToHumaErr(err)
 }
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/danielgtaylor/huma/v2"
+	"gorm.io/gorm"
+)
+
+type BulkKaraOperation struct {
+	Op string `json:"op" enum:"add_audio_tag,remove_audio_tag,add_video_tag,remove_video_tag,add_artist,remove_artist,add_media,remove_media,set_language,set_version" example:"add_video_tag"`
+	// audio or video tag of tag operations
+	Tag string `json:"tag,omitempty" example:"NSFW"`
+	// artist or media ID of artist and media operations
+	ID uint `json:"id,omitempty" example:"1"`
+	// new value of set operations
+	Value string `json:"value,omitempty" example:"FR"`
+}
+
+// apply the operation to a kara, returns true if the kara was modified
+type bulkKaraEdit func(kara *KaraInfoDB) bool
+
+func addBulkTag[T any, K comparable](tags *[]T, tag T, key func(T) K) bool {
+	if slices.ContainsFunc(*tags, func(other T) bool { return key(other) == key(tag) }) {
+		return false
+	}
+	*tags = append(*tags, tag)
+	return true
+}
+
+func removeBulkTag[T any, K comparable](tags *[]T, tag T, key func(T) K) bool {
+	n := len(*tags)
+	*tags = slices.DeleteFunc(*tags, func(other T) bool { return key(other) == key(tag) })
+	return len(*tags) != n
+}
+
+func audioTagKey(tag AudioTagDB) string { return tag.ID }
+func videoTagKey(tag VideoTagDB) string { return tag.ID }
+func artistKey(artist Artist) uint      { return artist.ID }
+func mediaKey(media MediaDB) uint       { return media.ID }
+
+// Check the operation and get the tags it needs before editing the karas
+func (op BulkKaraOperation) prepare(tx *gorm.DB) (bulkKaraEdit, error) {
+	switch op.Op {
+	case "add_audio_tag", "remove_audio_tag":
+		audio_tag, err := getAudioTag(op.Tag)
+		if err != nil {
+			return nil, huma.Error422UnprocessableEntity(err.Error())
+		}
+		tag := AudioTagDB{audio_tag.ID}
+		if op.Op == "add_audio_tag" {
+			return func(kara *KaraInfoDB) bool { return addBulkTag(&kara.AudioTags, tag, audioTagKey) }, nil
+		}
+		return func(kara *KaraInfoDB) bool { return removeBulkTag(&kara.AudioTags, tag, audioTagKey) }, nil
+	case "add_video_tag", "remove_video_tag":
+		video_tag, err := getVideoTag(op.Tag)
+		if err != nil {
+			return nil, huma.Error422UnprocessableEntity(err.Error())
+		}
+		tag := VideoTagDB{video_tag.ID}
+		if op.Op == "add_video_tag" {
+			return func(kara *KaraInfoDB) bool { return addBulkTag(&kara.VideoTags, tag, videoTagKey) }, nil
+		}
+		return func(kara *KaraInfoDB) bool { return removeBulkTag(&kara.VideoTags, tag, videoTagKey) }, nil
+	case "add_artist", "remove_artist":
+		artist, err := GetArtistByID(tx, op.ID)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "add_artist" {
+			return func(kara *KaraInfoDB) bool { return addBulkTag(&kara.Artists, *artist, artistKey) }, nil
+		}
+		return func(kara *KaraInfoDB) bool { return removeBulkTag(&kara.Artists, *artist, artistKey) }, nil
+	case "add_media", "remove_media":
+		media, err := getMediaByID(tx, op.ID)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "add_media" {
+			return func(kara *KaraInfoDB) bool { return addBulkTag(&kara.Medias, media, mediaKey) }, nil
+		}
+		return func(kara *KaraInfoDB) bool { return removeBulkTag(&kara.Medias, media, mediaKey) }, nil
+	case "set_language":
+		language := trimWhitespace(op.Value)
+		return func(kara *KaraInfoDB) bool {
+			changed := kara.Language != language
+			kara.Language = language
+			return changed
+		}, nil
+	case "set_version":
+		version := trimWhitespace(op.Value)
+		return func(kara *KaraInfoDB) bool {
+			changed := kara.Version != version
+			kara.Version = version
+			return changed
+		}, nil
+	}
+
+	return nil, huma.Error422UnprocessableEntity("unknown operation " + op.Op)
+}
+
+type BulkUpdateKarasInput struct {
+	Body struct {
+		IDs        []uint              `json:"ids" minItems:"1" maxItems:"1000" example:"[1, 2]"`
+		Operations []BulkKaraOperation `json:"operations" minItems:"1"`
+	}
+}
+
+type BulkKaraResult struct {
+	ID uint `json:"id"`
+	// false if the operations didn't change anything
+	Changed bool   `json:"changed"`
+	Error   string `json:"error,omitempty"`
+}
+
+type BulkUpdateKarasOutput struct {
+	Body struct {
+		Results []BulkKaraResult `json:"results"`
+	}
+}
+
+func bulkUpdateKara(tx *gorm.DB, id uint, edits []bulkKaraEdit) (bool, error) {
+	kara := KaraInfoDB{}
+	err := tx.Scopes(KaraAssociations, CurrentKaras).First(&kara, id).Error
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	for _, edit := range edits {
+		changed = edit(&kara) || changed
+	}
+	if !changed {
+		return false, nil
+	}
+
+	// one history entry for all the operations
+	return true, updateKara(WithRevisionCheck(tx), &kara)
+}
+
+func BulkUpdateKaras(ctx context.Context, input *BulkUpdateKarasInput) (*BulkUpdateKarasOutput, error) {
+	db := GetDB(ctx)
+	out := &BulkUpdateKarasOutput{}
+	out.Body.Results = []BulkKaraResult{}
+
+	err := transaction(db, func(tx *gorm.DB) error {
+		edits := make([]bulkKaraEdit, len(input.Body.Operations))
+		for i, op := range input.Body.Operations {
+			edit, err := op.prepare(tx)
+			if err != nil {
+				return err
+			}
+			edits[i] = edit
+		}
+
+		for _, id := range input.Body.IDs {
+			result := BulkKaraResult{ID: id}
+			// failed karas are rolled back to their savepoint, the others are kept
+			err := transaction(tx, func(tx *gorm.DB) error {
+				var err error
+				result.Changed, err = bulkUpdateKara(tx, id, edits)
+				return err
+			})
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				result.Error = fmt.Sprintf("kara %d not found", id)
+			} else if err != nil {
+				result.Changed = false
+				result.Error = err.Error()
+			}
+			out.Body.Results = append(out.Body.Results, result)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Conditional headers of read endpoints, clients polling them get a 304 if
+// nothing changed
+type ConditionalGetInput struct {
+	IfNoneMatch     string `header:"If-None-Match" doc:"ETag of the cached response"`
+	IfModifiedSince string `header:"If-Modified-Since" doc:"Last-Modified date of the cached response"`
+}
+
+type CacheHeaders struct {
+	ETag         string `header:"ETag"`
+	LastModified string `header:"Last-Modified"`
+}
+
+func (h *CacheHeaders) setValidators(etag string, modified time.Time) {
+	h.ETag = etag
+	if !modified.IsZero() {
+		h.LastModified = modified.UTC().Format(http.TimeFormat)
+	}
+}
+
+// True if one of the ETags of the header matches etag
+func etagMatches(header string, etag string) bool {
+	for candidate := range strings.SplitSeq(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		candidate = strings.Trim(candidate, `"`)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// True if the cached response of the client is still current.
+// If-Modified-Since is ignored when If-None-Match is given (RFC 9110).
+func (input ConditionalGetInput) notModified(headers CacheHeaders) bool {
+	if input.IfNoneMatch != "" {
+		return headers.ETag != "" && etagMatches(input.IfNoneMatch, headers.ETag)
+	}
+	if input.IfModifiedSince == "" || headers.LastModified == "" {
+		return false
+	}
+	since, err := http.ParseTime(input.IfModifiedSince)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(headers.LastModified)
+	return err == nil && !modified.After(since)
+}
+
+func hashETag(parts ...any) string {
+	h := fnv.New64a()
+	for _, part := range parts {
+		fmt.Fprint(h, part, ";")
+	}
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
+func lastTime(times ...time.Time) time.Time {
+	last := time.Time{}
+	for _, t := range times {
+		if t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+// Last modification of the kara or of the tags included in its response
+func karaModified(kara KaraInfoDB) time.Time {
+	modified := kara.UpdatedAt
+	for _, author := range kara.Authors {
+		modified = lastTime(modified, author.UpdatedAt)
+	}
+	for _, artist := range kara.Artists {
+		modified = lastTime(modified, artist.UpdatedAt)
+	}
+	for _, media := range kara.Medias {
+		modified = lastTime(modified, media.UpdatedAt)
+	}
+	if kara.SourceMedia != nil {
+		modified = lastTime(modified, kara.SourceMedia.UpdatedAt)
+	}
+	if kara.ClaimedBy != nil {
+		modified = lastTime(modified, kara.ClaimedBy.UpdatedAt)
+	}
+	if kara.EditorUser != nil {
+		modified = lastTime(modified, kara.EditorUser.UpdatedAt)
+	}
+	return modified
+}
+
+// ETag of a kara loaded with KaraAssociations, it starts with the revision
+// used by edits and changes when an included tag is edited
+func karaETag(kara KaraInfoDB) string {
+	return fmt.Sprintf("%d-%d", kara.Revision, karaModified(kara).UnixMicro())
+}
+
+// Revision part of a kara ETag
+func etagRevision(etag string) string {
+	revision, _, _ := strings.Cut(etag, "-")
+	return revision
+}
+
+// Version of all the rows of a table including historic and deleted entries:
+// updates create history rows, deletions set DeletedAt and permanent
+// deletions change the number of rows
+func tableVersion(tx *gorm.DB, model any) (string, time.Time, error) {
+	tx = tx.Unscoped().Model(model).Session(&gorm.Session{})
+
+	var count int64
+	err := tx.Count(&count).Error
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	last_update := gorm.Model{}
+	err = tx.Select("updated_at").Order("updated_at DESC").Take(&last_update).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", time.Time{}, err
+	}
+	last_delete := gorm.Model{}
+	err = tx.Select("deleted_at").Where("deleted_at IS NOT NULL").Order("deleted_at DESC").Take(&last_delete).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", time.Time{}, err
+	}
+
+	etag := fmt.Sprintf("%d:%d:%d", count, last_update.UpdatedAt.UnixMicro(), last_delete.DeletedAt.Time.UnixMicro())
+	return etag, lastTime(last_update.UpdatedAt, last_delete.DeletedAt.Time), nil
+}
+
+// Validators of a response made of the rows of the tables of models
+func tablesValidators(tx *gorm.DB, models ...any) (CacheHeaders, error) {
+	headers := CacheHeaders{}
+	versions := make([]any, len(models))
+	modified := time.Time{}
+	for i, model := range models {
+		version, last, err := tableVersion(tx, model)
+		if err != nil {
+			return headers, err
+		}
+		versions[i] = version
+		modified = lastTime(modified, last)
+	}
+	headers.setValidators(hashETag(versions...), modified)
+	return headers, nil
+}
+
+// Validators of a response made of karas loaded with KaraAssociations
+func karasValidators(karas []KaraInfoDB) CacheHeaders {
+	headers := CacheHeaders{}
+	etags := make([]any, len(karas))
+	modified := time.Time{}
+	for i, kara := range karas {
+		etags[i] = fmt.Sprintf("%d:%s", kara.ID, karaETag(kara))
+		modified = lastTime(modified, karaModified(kara))
+	}
+	headers.setValidators(hashETag(etags...), modified)
+	return headers
+}
+
+// Validators of a history, historic entries are never modified
+func historyValidators[T any](history []T, model func(T) gorm.Model) CacheHeaders {
+	headers := CacheHeaders{}
+	ids := make([]any, len(history))
+	modified := time.Time{}
+	for i, entry := range history {
+		ids[i] = model(entry).ID
+		modified = lastTime(modified, model(entry).UpdatedAt)
+	}
+	headers.setValidators(hashETag(ids...), modified)
+	return headers
+}
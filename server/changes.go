@@ -0,0 +1,287 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"gorm.io/gorm"
+)
+
+var ChangeCreated = "created"
+var ChangeUpdated = "updated"
+var ChangeDeleted = "deleted"
+var ChangeRestored = "restored"
+
+type Change struct {
+	Type   string `json:"type" enum:"kara,artist,media,author"`
+	ID     uint   `json:"id"`
+	Action string `json:"action" enum:"created,updated,deleted,restored"`
+	// revision of the kara, artist or media after the change
+	Revision uint      `json:"revision,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// Changes are written in the transaction making them, numbered in the order
+// the transactions are committed
+type ChangeLogEntry struct {
+	Seq      uint   `gorm:"primarykey"`
+	Type     string `gorm:"not null"`
+	ObjectID uint   `gorm:"not null"`
+	Action   string `gorm:"not null"`
+	Revision uint
+	Time     time.Time `gorm:"not null"`
+}
+
+func (e ChangeLogEntry) change() Change {
+	return Change{Type: e.Type, ID: e.ObjectID, Action: e.Action, Revision: e.Revision, Time: e.Time}
+}
+
+// Key of the postgres lock serializing the commits of the transactions
+// writing changes, sequence values are allocated in the order of the inserts
+// but transactions could commit in another order otherwise. sqlite only has
+// one writer.
+var changeLogLockKey = 0x6b617261
+
+// The change is written right before the transaction of tx is committed so the
+// lock is only held for the end of the transaction
+func logChange(tx *gorm.DB, typ string, id uint, action string, revision uint) error {
+	entry := ChangeLogEntry{Type: typ, ObjectID: id, Action: action, Revision: revision, Time: time.Now().UTC()}
+	q := getAfterCommitQueue(tx.Statement.Context)
+	if q == nil {
+		return writeChanges(tx, []ChangeLogEntry{entry})
+	}
+	q.changes = append(q.changes, entry)
+	return nil
+}
+
+func writeChanges(tx *gorm.DB, entries []ChangeLogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	tx = tx.Session(&gorm.Session{NewDB: true})
+	if tx.Dialector.Name() == "postgres" {
+		err := tx.Exec("SELECT pg_advisory_xact_lock(?)", changeLogLockKey).Error
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Create(&entries).Error
+}
+
+func versionAction(revision uint) string {
+	if revision <= 1 {
+		return ChangeCreated
+	}
+	return ChangeUpdated
+}
+
+// position of the last change of a page
+type ChangesCursor struct {
+	Seq uint `json:"seq"`
+}
+
+func (c ChangesCursor) String() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		// only contains marshallable fields
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseChangesCursor(since string) (ChangesCursor, error) {
+	cursor := ChangesCursor{}
+	if since == "" {
+		return cursor, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(since)
+	if err != nil {
+		return cursor, huma.Error422UnprocessableEntity("invalid cursor")
+	}
+	err = json.Unmarshal(b, &cursor)
+	if err != nil {
+		return cursor, huma.Error422UnprocessableEntity("invalid cursor")
+	}
+	return cursor, nil
+}
+
+type changeRow struct {
+	ID        uint
+	CurrentID *uint
+	Revision  uint
+	Time      time.Time
+}
+
+// Rows of a table that are changes of one kind, used to fill the change log
+// with the changes made before it existed
+type changeSource struct {
+	Type   string
+	Action string
+	Model  any
+	// column with the time of the change
+	TimeColumn string
+	// the change of each row, nil for the rows of versioned models
+	Scope func(*gorm.DB) *gorm.DB
+	// column pointing to the current version of historic entries
+	CurrentColumn string
+}
+
+func versionsSource(typ string, model any, current_column string) changeSource {
+	return changeSource{Type: typ, Model: model, TimeColumn: "updated_at", CurrentColumn: current_column}
+}
+
+func deletionsSource(typ string, model any, current_column string) changeSource {
+	return changeSource{
+		Type:       typ,
+		Action:     ChangeDeleted,
+		Model:      model,
+		TimeColumn: "deleted_at",
+		Scope: func(tx *gorm.DB) *gorm.DB {
+			return tx.Where("deleted_at IS NOT NULL AND " + current_column + " IS NULL")
+		},
+	}
+}
+
+// Each update of a kara, artist or media creates a historic entry with the
+// previous version so every version is a change, authors are not versioned
+// so only their last update is known.
+var changeSources = []changeSource{
+	versionsSource("kara", &KaraInfoDB{}, "current_kara_info_id"),
+	deletionsSource("kara", &KaraInfoDB{}, "current_kara_info_id"),
+	versionsSource("artist", &Artist{}, "current_artist_id"),
+	deletionsSource("artist", &Artist{}, "current_artist_id"),
+	versionsSource("media", &MediaDB{}, "current_media_id"),
+	deletionsSource("media", &MediaDB{}, "current_media_id"),
+	{Type: "author", Action: ChangeCreated, Model: &TimingAuthor{}, TimeColumn: "created_at", Scope: func(tx *gorm.DB) *gorm.DB { return tx }},
+	{Type: "author", Action: ChangeUpdated, Model: &TimingAuthor{}, TimeColumn: "updated_at", Scope: func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("updated_at > created_at")
+	}},
+	{Type: "author", Action: ChangeDeleted, Model: &TimingAuthor{}, TimeColumn: "deleted_at", Scope: func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("deleted_at IS NOT NULL")
+	}},
+}
+
+type sourceChange struct {
+	ChangeLogEntry
+	source int
+	row_id uint
+}
+
+func (s changeSource) changes(tx *gorm.DB, source int) ([]sourceChange, error) {
+	columns := fmt.Sprintf("id, %s AS time", s.TimeColumn)
+	if s.Scope == nil {
+		columns += fmt.Sprintf(", %s AS current_id, revision", s.CurrentColumn)
+	}
+	query := tx.Unscoped().Model(s.Model).Select(columns)
+	if s.Scope != nil {
+		query = query.Scopes(s.Scope)
+	}
+
+	rows := []changeRow{}
+	err := query.Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]sourceChange, len(rows))
+	for i, row := range rows {
+		entry := ChangeLogEntry{Type: s.Type, ObjectID: row.ID, Action: s.Action, Time: row.Time}
+		if s.Scope == nil {
+			entry.Revision = row.Revision
+			if row.CurrentID != nil {
+				entry.ObjectID = *row.CurrentID
+			}
+			entry.Action = versionAction(row.Revision)
+		}
+		changes[i] = sourceChange{entry, source, row.ID}
+	}
+	return changes, nil
+}
+
+// Log the existing karas, artists, medias and authors in the order of their
+// changes
+func initChangeLog(db *gorm.DB) {
+	changes := []sourceChange{}
+	for i, source := range changeSources {
+		source_changes, err := source.changes(db, i)
+		if err != nil {
+			panic(err)
+		}
+		changes = append(changes, source_changes...)
+	}
+
+	slices.SortFunc(changes, func(a sourceChange, b sourceChange) int {
+		return cmp.Or(
+			a.Time.Compare(b.Time),
+			cmp.Compare(a.Type, b.Type),
+			cmp.Compare(a.ObjectID, b.ObjectID),
+			cmp.Compare(a.Revision, b.Revision),
+			cmp.Compare(a.source, b.source),
+			cmp.Compare(a.row_id, b.row_id),
+		)
+	})
+
+	entries := make([]ChangeLogEntry, len(changes))
+	for i, change := range changes {
+		entries[i] = change.ChangeLogEntry
+	}
+	if len(entries) == 0 {
+		return
+	}
+	err := db.CreateInBatches(entries, 500).Error
+	if err != nil {
+		panic(err)
+	}
+}
+
+type GetChangesInput struct {
+	Since string `query:"since" doc:"next_cursor of the previous response, everything is returned if empty"`
+	Limit int    `query:"limit" default:"100" minimum:"1" maximum:"1000"`
+}
+
+type GetChangesOutput struct {
+	Body struct {
+		Changes []Change `json:"changes"`
+		// to use as since in the next request, even if there are no changes
+		NextCursor string `json:"next_cursor"`
+		// false if the next request could return more changes immediately
+		UpToDate bool `json:"up_to_date"`
+	}
+}
+
+func GetChanges(ctx context.Context, input *GetChangesInput) (*GetChangesOutput, error) {
+	db := GetDB(ctx)
+	out := &GetChangesOutput{}
+
+	cursor, err := parseChangesCursor(input.Since)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []ChangeLogEntry{}
+	err = db.Where("seq > ?", cursor.Seq).
+		Order("seq ASC").
+		Limit(input.Limit).
+		Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+
+	out.Body.Changes = make([]Change, len(entries))
+	for i, entry := range entries {
+		out.Body.Changes[i] = entry.change()
+	}
+	if len(entries) > 0 {
+		cursor.Seq = entries[len(entries)-1].Seq
+	}
+	out.Body.NextCursor = cursor.String()
+	out.Body.UpToDate = len(entries) < input.Limit
+
+	return out, nil
+}
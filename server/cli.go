@@ -73,6 +73,61 @@ func MakeCli() {
 		},
 	})
 
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "index-lyrics",
+		Short: "Extract and index the lyrics of all karaokes with subtitles",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			initStorage(cmd.Context())
+			init_db(cmd.Context())
+			err := BackfillLyrics(cmd.Context(), GetDB(cmd.Context()))
+			if err != nil {
+				panic(err)
+			}
+		},
+	})
+
+	storage_cmd := &cobra.Command{
+		Use:   "storage",
+		Short: "Manage the stored files",
+	}
+	storage_audit_fix_flag := false
+	storage_audit_cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Compare the stored files with the database",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			initStorage(cmd.Context())
+			init_db(cmd.Context())
+			db := GetDB(cmd.Context())
+			report, err := AuditStorage(cmd.Context(), db)
+			if err != nil {
+				panic(err)
+			}
+			if storage_audit_fix_flag {
+				err = FixStorage(cmd.Context(), db, report)
+				if err != nil {
+					panic(err)
+				}
+			}
+			for _, issue := range report.Issues {
+				line := fmt.Sprintf("%s\t%s", issue.Problem, issue.Key)
+				if issue.Problem == AuditSizeMismatch {
+					line += fmt.Sprintf("\t%d bytes, expected %d", issue.Size, issue.ExpectedSize)
+				}
+				if issue.Fixed {
+					line += "\tfixed"
+				}
+				fmt.Println(line)
+			}
+			fmt.Printf("%d objects, %d issues.\n", report.Objects, len(report.Issues))
+		},
+	}
+	storage_audit_cmd.Flags().BoolVar(&storage_audit_fix_flag, "fix", false, "delete the orphan files and clear the upload flags of the missing files.")
+	storage_cmd.AddCommand(storage_audit_cmd)
+
+	rootCmd.AddCommand(storage_cmd)
+
 	rootCmd.PersistentFlags().IntVarP(
 		&CONFIG.Listen.Port,
 		"port", "p",
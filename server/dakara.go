@@ -10,10 +10,8 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"runtime/debug"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/danielgtaylor/huma/v2"
@@ -602,52 +600,46 @@ func UploadedKaras(db *gorm.DB) *gorm.DB {
 	return db.Where("video_uploaded AND (subtitles_uploaded OR hardsubbed)")
 }
 
-var syncDakaraNotifyMutex = sync.Mutex{}
-var syncDakaraNotifyChannel = make(chan bool)
-
-// Notify the sync worker (non blocking)
-func SyncDakaraNotify() {
-	go func() {
-		if syncDakaraNotifyMutex.TryLock() {
-			defer syncDakaraNotifyMutex.Unlock()
-			getLogger().Println("notifying dakara worker")
-			syncDakaraNotifyChannel <- true
-			getLogger().Println("notified dakara worker")
-		}
-	}()
+// Schedule a sync with Dakara, the job is only started once the transaction
+// is committed
+func SyncDakaraNotify(tx *gorm.DB) error {
+	if CONFIG.Dakara.BaseURL == "" {
+		return nil
+	}
+	return enqueueJob(tx, JobDakaraSync, struct{}{})
 }
 
-func SyncDakaraLoop(ctx context.Context) {
-	for {
-		SyncDakara(ctx)
-		<-syncDakaraNotifyChannel
-	}
+func runDakaraSyncJob(ctx context.Context, job Job) error {
+	return SyncDakara(ctx)
 }
 
-func SyncDakara(ctx context.Context) {
+func SyncDakara(ctx context.Context) error {
 	logger := getLogger()
 	defer logger.Println("Done syncing dakara")
-	defer func() {
-		r := recover()
-		if r != nil {
-			getLogger().Printf("recovered from panic in SyncDakara %s\n%s\n", r, string(debug.Stack()))
-		}
-	}()
 
+	stats := DakaraSyncEventData{}
+	err := syncDakara(ctx, &stats)
+	if err != nil {
+		stats.Error = err.Error()
+	}
+	EVENTS.Publish(EventDakaraSyncFinished, stats)
+	return err
+}
+
+func syncDakara(ctx context.Context, stats *DakaraSyncEventData) error {
+	logger := getLogger()
 	db := GetDB(ctx)
 	// sync media types / work types
 	worktypes, err := dakaraGetWorkTypes(ctx)
 	if err != nil {
-		getLogger().Println(err)
-		return
+		return err
 	}
 
 	for _, media_type := range MediaTypes {
 		if worktypes[strings.ToLower(media_type.ID)] == nil {
 			err = dakaraAddWorkType(ctx, media_type)
 			if err != nil {
-				getLogger().Println(err)
-				return
+				return err
 			}
 		}
 	}
@@ -655,16 +647,14 @@ func SyncDakara(ctx context.Context) {
 	all_karas := []KaraInfoDB{}
 	err = db.Scopes(KaraAssociations, UploadedKaras, CurrentKaras).Find(&all_karas).Error
 	if err != nil {
-		getLogger().Println(err)
-		return
+		return err
 	}
 	logger.Printf("Syncing %d karas to Dakara", len(all_karas))
 
 	// sync media / works
 	works, err := dakaraGetWorks(ctx)
 	if err != nil {
-		getLogger().Println(err)
-		return
+		return err
 	}
 
 	all_medias := map[uint]MediaDB{}
@@ -700,14 +690,12 @@ func SyncDakara(ctx context.Context) {
 			if work != nil {
 				err = dakaraDeleteWork(ctx, work.ID)
 				if err != nil {
-					getLogger().Println(err)
-					return
+					return err
 				}
 			}
 			err = dakaraAddWork(ctx, body)
 			if err != nil {
-				getLogger().Println(err)
-				return
+				return err
 			}
 			new_works++
 		}
@@ -717,8 +705,7 @@ func SyncDakara(ctx context.Context) {
 	// sync artists
 	dakara_artists, err := dakaraGetArtists(ctx)
 	if err != nil {
-		getLogger().Println(err)
-		return
+		return err
 	}
 
 	new_artists := 0
@@ -726,8 +713,7 @@ func SyncDakara(ctx context.Context) {
 		if dakara_artists[artist.Name] == nil {
 			err = dakaraAddArtist(ctx, artist)
 			if err != nil {
-				getLogger().Println(err)
-				return
+				return err
 			}
 			new_artists++
 		}
@@ -737,8 +723,7 @@ func SyncDakara(ctx context.Context) {
 	// sync tags
 	dakara_tags, err := dakaraGetTags(ctx)
 	if err != nil {
-		getLogger().Println(err)
-		return
+		return err
 	}
 
 	// sync audio tags
@@ -747,14 +732,12 @@ func SyncDakara(ctx context.Context) {
 		if dakara_tag == nil {
 			err = dakaraAddTag(ctx, audio_tag)
 			if err != nil {
-				getLogger().Println(err)
-				return
+				return err
 			}
 		} else {
 			err = dakaraPutTag(ctx, dakara_tag.ID, audio_tag)
 			if err != nil {
-				getLogger().Println(err)
-				return
+				return err
 			}
 		}
 	}
@@ -765,14 +748,12 @@ func SyncDakara(ctx context.Context) {
 		if dakara_tag == nil {
 			err = dakaraAddTag(ctx, video_tag)
 			if err != nil {
-				getLogger().Println(err)
-				return
+				return err
 			}
 		} else {
 			err = dakaraPutTag(ctx, dakara_tag.ID, video_tag)
 			if err != nil {
-				getLogger().Println(err)
-				return
+				return err
 			}
 		}
 	}
@@ -782,32 +763,26 @@ func SyncDakara(ctx context.Context) {
 
 	songs, err := dakaraGetSongs(ctx)
 	if err != nil {
-		getLogger().Println(err)
-		return
+		return err
 	}
 
 	dakara_tags, err = dakaraGetTags(ctx)
 	if err != nil {
-		getLogger().Println(err)
-		return
+		return err
 	}
 
 	dakara_artists, err = dakaraGetArtists(ctx)
 	if err != nil {
-		getLogger().Println(err)
-		return
+		return err
 	}
 
 	works, err = dakaraGetWorks(ctx)
 	if err != nil {
-		getLogger().Println(err)
-		return
+		return err
 	}
 
 	logger.Println("syncing new songs")
 
-	new_songs := 0
-	updated_songs := 0
 	for _, kara := range all_karas {
 		song_body, err := createDakaraSongBody(ctx, kara, dakara_tags, dakara_artists, works)
 		if err != nil {
@@ -821,7 +796,7 @@ func SyncDakara(ctx context.Context) {
 				getLogger().Println(err)
 				continue
 			}
-			new_songs++
+			stats.NewSongs++
 		} else if song_body.HasChanged(*dakara_song) {
 			// overly spammy in practice
 			// logger.Printf("kara changed\n%+v\n%+v\n", dakara_song, song_body)
@@ -830,10 +805,10 @@ func SyncDakara(ctx context.Context) {
 				getLogger().Println(err)
 				continue
 			}
-			updated_songs++
+			stats.UpdatedSongs++
 		}
 	}
-	logger.Printf("Created %d songs, Updated %d songs\n", new_songs, updated_songs)
+	logger.Printf("Created %d songs, Updated %d songs\n", stats.NewSongs, stats.UpdatedSongs)
 
 	err = cleanUpDakaraSongs(ctx, songs)
 	if err != nil {
@@ -851,6 +826,7 @@ func SyncDakara(ctx context.Context) {
 	if err != nil {
 		getLogger().Println(err)
 	}
+	return nil
 }
 
 func dakaraSongEndpoint(dakara_song_id int) string {
@@ -1055,6 +1031,9 @@ func StartDakaraSync(ctx context.Context, input *struct{}) (*struct{}, error) {
 		return nil, huma.Error403Forbidden("endpoint reserved to adminitrators")
 	}
 
-	SyncDakaraNotify()
+	err = SyncDakaraNotify(GetDB(ctx))
+	if err != nil {
+		return nil, err
+	}
 	return &struct{}{}, nil
 }
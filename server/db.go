@@ -59,9 +59,106 @@ func init_db(ctx context.Context) {
 		panic("unknown db driver " + CONFIG.DB.Driver)
 	}
 
+	registerAfterCommitCallbacks(db_instance)
 	init_model(db_instance.WithContext(ctx))
 }
 
+type AfterCommit struct{}
+
+// Functions to run once the transaction is committed, dropped if it is
+// rolled back
+type afterCommitQueue struct {
+	fns []func()
+	// written to the change log right before the commit
+	changes []ChangeLogEntry
+}
+
+func (q *afterCommitQueue) run() {
+	for _, fn := range q.fns {
+		fn()
+	}
+	q.fns = nil
+}
+
+func getAfterCommitQueue(ctx context.Context) *afterCommitQueue {
+	q, _ := ctx.Value(AfterCommit{}).(*afterCommitQueue)
+	return q
+}
+
+// Run fn after the transaction of tx is committed, e.g. to notify other
+// goroutines of the changes once they can see them
+func afterCommit(tx *gorm.DB, fn func()) {
+	q := getAfterCommitQueue(tx.Statement.Context)
+	if q == nil {
+		fn()
+		return
+	}
+	q.fns = append(q.fns, fn)
+}
+
+// Same as db.Transaction, fc can queue functions with afterCommit
+func transaction(db *gorm.DB, fc func(tx *gorm.DB) error) error {
+	parent := getAfterCommitQueue(db.Statement.Context)
+	q := &afterCommitQueue{}
+	err := db.WithContext(context.WithValue(db.Statement.Context, AfterCommit{}, q)).Transaction(func(tx *gorm.DB) error {
+		err := fc(tx)
+		if err != nil || parent != nil {
+			return err
+		}
+		return writeChanges(tx, q.changes)
+	})
+	if err != nil {
+		return err
+	}
+	if parent != nil {
+		// nested transactions are committed with their parent
+		parent.fns = append(parent.fns, q.fns...)
+		parent.changes = append(parent.changes, q.changes...)
+	} else {
+		q.run()
+	}
+	return nil
+}
+
+var afterCommitOwner = "karaberus:after_commit_owner"
+
+// create, update and delete statements run in their own transaction when
+// they are not in one already, the changes logged by their hooks are written
+// before it is committed and the functions queued run after it
+func registerAfterCommitCallbacks(db *gorm.DB) {
+	queue := func(db *gorm.DB) {
+		if getAfterCommitQueue(db.Statement.Context) == nil {
+			db.Statement.Context = context.WithValue(db.Statement.Context, AfterCommit{}, &afterCommitQueue{})
+			db.InstanceSet(afterCommitOwner, true)
+		}
+	}
+	write := func(db *gorm.DB) {
+		if _, ok := db.InstanceGet(afterCommitOwner); ok && db.Error == nil {
+			db.AddError(writeChanges(db, getAfterCommitQueue(db.Statement.Context).changes))
+		}
+	}
+	run := func(db *gorm.DB) {
+		if _, ok := db.InstanceGet(afterCommitOwner); ok && db.Error == nil {
+			getAfterCommitQueue(db.Statement.Context).run()
+		}
+	}
+
+	err := errors.Join(
+		db.Callback().Create().Before("gorm:begin_transaction").Register("karaberus:after_commit_queue", queue),
+		db.Callback().Create().Before("gorm:commit_or_rollback_transaction").Register("karaberus:change_log", write),
+		db.Callback().Create().After("gorm:commit_or_rollback_transaction").Register("karaberus:after_commit", run),
+		db.Callback().Update().Before("gorm:begin_transaction").Register("karaberus:after_commit_queue", queue),
+		db.Callback().Update().Before("gorm:commit_or_rollback_transaction").Register("karaberus:change_log", write),
+		db.Callback().Update().After("gorm:commit_or_rollback_transaction").Register("karaberus:after_commit", run),
+		db.Callback().Delete().Before("gorm:begin_transaction").Register("karaberus:after_commit_queue", queue),
+		db.Callback().Delete().Before("gorm:commit_or_rollback_transaction").Register("karaberus:change_log", write),
+		db.Callback().Delete().After("gorm:commit_or_rollback_transaction").Register("karaberus:after_commit", run),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
 func GetDB(ctx context.Context) *gorm.DB {
 	if db_instance == nil {
 		panic("db instance not initialised")
@@ -74,5 +171,8 @@ func DBErrToHumaErr(err error) error {
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return huma.Error404NotFound("record not found")
 	}
+	if errors.Is(err, ErrStaleRevision) {
+		return huma.Error409Conflict(err.Error())
+	}
 	return err
 }
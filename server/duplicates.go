@@ -0,0 +1,377 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+)
+
+var duplicateScoreThreshold = 0.5
+
+// karas with less than this difference of duration (in seconds) are similar
+var duplicateDurationTolerance int32 = 2
+
+var DuplicateSameTitle = "same title"
+var DuplicateExtraTitle = "title matches an extra title"
+var DuplicateSameSong = "same source media, song order and audio tag"
+var DuplicateSameVideo = "same video file"
+var DuplicateSameSubtitles = "same subtitles file"
+var DuplicateSimilarDuration = "similar duration"
+
+var duplicateReasonScores = map[string]float64{
+	DuplicateSameTitle:       0.4,
+	DuplicateExtraTitle:      0.3,
+	DuplicateSameSong:        0.4,
+	DuplicateSameVideo:       0.6,
+	DuplicateSameSubtitles:   0.6,
+	DuplicateSimilarDuration: 0.1,
+}
+
+// Pair of karas that are likely duplicates, KaraID is the oldest one
+type KaraDuplicate struct {
+	KaraID      uint       `gorm:"primarykey;autoIncrement:false" json:"kara_id"`
+	Kara        KaraInfoDB `gorm:"foreignKey:KaraID;references:ID;constraint:OnDelete:CASCADE" json:"kara"`
+	DuplicateID uint       `gorm:"primarykey;autoIncrement:false" json:"duplicate_id"`
+	Duplicate   KaraInfoDB `gorm:"foreignKey:DuplicateID;references:ID;constraint:OnDelete:CASCADE" json:"duplicate"`
+	Score       float64    `json:"score"`
+	Reasons     []string   `gorm:"serializer:json" json:"reasons"`
+	DetectedAt  time.Time  `json:"detected_at"`
+}
+
+// Lower case title without accents, punctuation or extra spaces
+func normalizeTitle(title string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range norm.NFD.String(strings.ToLower(title)) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if space && b.Len() > 0 {
+				b.WriteRune(' ')
+			}
+			space = false
+			b.WriteRune(r)
+		default:
+			space = true
+		}
+	}
+	return b.String()
+}
+
+type normalizedTitleRow struct {
+	ID    uint
+	Title string
+}
+
+// Normalize the titles of the karas and extra titles created before they were
+// stored
+func initNormalizedTitles(db *gorm.DB) {
+	models := []struct {
+		Model  any
+		Column string
+		Target string
+	}{
+		{&KaraInfoDB{}, "title", "normalized_title"},
+		{&AdditionalName{}, "name", "normalized_name"},
+	}
+	for _, m := range models {
+		rows := []normalizedTitleRow{}
+		err := db.Unscoped().Model(m.Model).Select("id, " + m.Column + " AS title").Scan(&rows).Error
+		if err != nil {
+			panic(err)
+		}
+		for _, row := range rows {
+			err = db.Unscoped().Model(m.Model).
+				Where("id = ?", row.ID).
+				UpdateColumn(m.Target, normalizeTitle(row.Title)).Error
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+}
+
+func normalizedExtraTitles(kara KaraInfoDB) []string {
+	titles := []string{}
+	for _, extra_title := range kara.ExtraTitles {
+		title := normalizeTitle(extra_title.Name)
+		if title != "" {
+			titles = append(titles, title)
+		}
+	}
+	return titles
+}
+
+func shareAudioTag(a KaraInfoDB, b KaraInfoDB) bool {
+	if len(a.AudioTags) == 0 && len(b.AudioTags) == 0 {
+		return true
+	}
+	for _, tag := range a.AudioTags {
+		if slices.ContainsFunc(b.AudioTags, func(other AudioTagDB) bool { return other.ID == tag.ID }) {
+			return true
+		}
+	}
+	return false
+}
+
+// Score between 0 and 1 of a and b being the same kara with the reasons
+func compareKaras(a KaraInfoDB, b KaraInfoDB) (float64, []string) {
+	reasons := []string{}
+
+	a_title := normalizeTitle(a.Title)
+	b_title := normalizeTitle(b.Title)
+	if a_title != "" && a_title == b_title {
+		reasons = append(reasons, DuplicateSameTitle)
+	} else if (a_title != "" && slices.Contains(normalizedExtraTitles(b), a_title)) ||
+		(b_title != "" && slices.Contains(normalizedExtraTitles(a), b_title)) {
+		reasons = append(reasons, DuplicateExtraTitle)
+	}
+
+	if a.SourceMediaID != nil && b.SourceMediaID != nil && *a.SourceMediaID == *b.SourceMediaID &&
+		a.SongOrder == b.SongOrder && shareAudioTag(a, b) {
+		reasons = append(reasons, DuplicateSameSong)
+	}
+
+	if a.VideoUploaded && b.VideoUploaded && a.VideoCRC32 != 0 && a.VideoCRC32 == b.VideoCRC32 {
+		reasons = append(reasons, DuplicateSameVideo)
+	}
+	if a.SubtitlesUploaded && b.SubtitlesUploaded && a.SubtitlesCRC32 != 0 && a.SubtitlesCRC32 == b.SubtitlesCRC32 {
+		reasons = append(reasons, DuplicateSameSubtitles)
+	}
+
+	// durations alone don't mean anything
+	if len(reasons) > 0 && a.Duration > 0 && b.Duration > 0 {
+		diff := a.Duration - b.Duration
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff <= duplicateDurationTolerance {
+			reasons = append(reasons, DuplicateSimilarDuration)
+		}
+	}
+
+	score := 0.0
+	for _, reason := range reasons {
+		score += duplicateReasonScores[reason]
+	}
+	return min(score, 1), reasons
+}
+
+// Keys shared by karas that should be compared
+func duplicateKeys(kara KaraInfoDB) []string {
+	keys := []string{}
+
+	title := normalizeTitle(kara.Title)
+	if title != "" {
+		keys = append(keys, "title:"+title)
+	}
+	for _, extra_title := range normalizedExtraTitles(kara) {
+		keys = append(keys, "title:"+extra_title)
+	}
+	if kara.SourceMediaID != nil {
+		keys = append(keys, fmt.Sprintf("song:%d:%d", *kara.SourceMediaID, kara.SongOrder))
+	}
+	if kara.VideoUploaded && kara.VideoCRC32 != 0 {
+		keys = append(keys, fmt.Sprintf("video:%d", kara.VideoCRC32))
+	}
+	if kara.SubtitlesUploaded && kara.SubtitlesCRC32 != 0 {
+		keys = append(keys, fmt.Sprintf("sub:%d", kara.SubtitlesCRC32))
+	}
+
+	return keys
+}
+
+func findDuplicateKaras(karas []KaraInfoDB) []KaraDuplicate {
+	buckets := map[string][]int{}
+	for i, kara := range karas {
+		for _, key := range duplicateKeys(kara) {
+			bucket := buckets[key]
+			// a kara can have the same key twice (title and extra title)
+			if len(bucket) == 0 || bucket[len(bucket)-1] != i {
+				buckets[key] = append(bucket, i)
+			}
+		}
+	}
+
+	now := time.Now().UTC()
+	duplicates := []KaraDuplicate{}
+	compared := map[[2]int]bool{}
+	for _, bucket := range buckets {
+		for i, a := range bucket {
+			for _, b := range bucket[i+1:] {
+				pair := [2]int{min(a, b), max(a, b)}
+				if compared[pair] {
+					continue
+				}
+				compared[pair] = true
+
+				kara, other := karas[pair[0]], karas[pair[1]]
+				if kara.ID > other.ID {
+					kara, other = other, kara
+				}
+				score, reasons := compareKaras(kara, other)
+				if score >= duplicateScoreThreshold {
+					duplicates = append(duplicates, KaraDuplicate{
+						KaraID:      kara.ID,
+						DuplicateID: other.ID,
+						Score:       score,
+						Reasons:     reasons,
+						DetectedAt:  now,
+					})
+				}
+			}
+		}
+	}
+
+	return duplicates
+}
+
+var detectDuplicatesMutex = sync.Mutex{}
+
+// Replace the duplicates report with the current karas
+func DetectDuplicateKaras(ctx context.Context) error {
+	if !detectDuplicatesMutex.TryLock() {
+		getLogger().Println("duplicate karas detection already running")
+		return nil
+	}
+	defer detectDuplicatesMutex.Unlock()
+
+	db := GetDB(ctx)
+	karas := []KaraInfoDB{}
+	err := db.Scopes(CurrentKaras).
+		Preload("ExtraTitles").
+		Preload("AudioTags").
+		Find(&karas).Error
+	if err != nil {
+		return err
+	}
+
+	duplicates := findDuplicateKaras(karas)
+	getLogger().Printf("found %d likely duplicate karas", len(duplicates))
+
+	return transaction(db, func(tx *gorm.DB) error {
+		err := tx.Where("1 = 1").Delete(&KaraDuplicate{}).Error
+		if err != nil {
+			return err
+		}
+		if len(duplicates) == 0 {
+			return nil
+		}
+		return tx.Omit("Kara", "Duplicate").CreateInBatches(duplicates, 100).Error
+	})
+}
+
+func runDuplicatesDetectionJob(ctx context.Context, job Job) error {
+	return DetectDuplicateKaras(ctx)
+}
+
+type DuplicateMatch struct {
+	KaraID  uint     `json:"kara_id"`
+	Title   string   `json:"title"`
+	Score   float64  `json:"score"`
+	Reasons []string `json:"reasons"`
+}
+
+// Existing karas closely matching kara
+func findKaraDuplicates(tx *gorm.DB, kara KaraInfoDB) ([]DuplicateMatch, error) {
+	titles := normalizedExtraTitles(kara)
+	title := normalizeTitle(kara.Title)
+	if title != "" {
+		titles = append(titles, title)
+	}
+	conds := tx.Session(&gorm.Session{NewDB: true})
+	extra_titles := conds.
+		Table("kara_info_additional_name").
+		Select("kara_info_additional_name.kara_info_db_id").
+		Joins("JOIN additional_names ON additional_names.id = kara_info_additional_name.additional_name_id").
+		Where("additional_names.normalized_name IN ?", titles)
+
+	query := conds.Where("normalized_title IN ? OR id IN (?)", titles, extra_titles)
+	if kara.SourceMediaID != nil {
+		query = query.Or("source_media_id = ? AND song_order = ?", *kara.SourceMediaID, kara.SongOrder)
+	}
+	if kara.VideoUploaded && kara.VideoCRC32 != 0 {
+		query = query.Or("video_uploaded AND video_crc32 = ?", kara.VideoCRC32)
+	}
+
+	candidates := []KaraInfoDB{}
+	err := tx.Scopes(CurrentKaras).
+		Preload("ExtraTitles").
+		Preload("AudioTags").
+		Where(query).
+		Where("id <> ?", kara.ID).
+		Find(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	matches := []DuplicateMatch{}
+	for _, candidate := range candidates {
+		score, reasons := compareKaras(candidate, kara)
+		if score >= duplicateScoreThreshold {
+			matches = append(matches, DuplicateMatch{candidate.ID, candidate.FriendlyName(), score, reasons})
+		}
+	}
+	slices.SortFunc(matches, func(a DuplicateMatch, b DuplicateMatch) int {
+		if a.Score > b.Score {
+			return -1
+		} else if a.Score < b.Score {
+			return 1
+		}
+		return int(a.KaraID) - int(b.KaraID)
+	})
+
+	return matches, nil
+}
+
+type GetDuplicateKarasInput struct {
+	MinScore float64 `query:"min_score" default:"0.5" minimum:"0" maximum:"1"`
+}
+
+type DuplicateKarasOutput struct {
+	Body struct {
+		Duplicates []KaraDuplicate `json:"duplicates"`
+	}
+}
+
+func GetDuplicateKaras(ctx context.Context, input *GetDuplicateKarasInput) (*DuplicateKarasOutput, error) {
+	db := GetDB(ctx)
+	out := &DuplicateKarasOutput{}
+	out.Body.Duplicates = []KaraDuplicate{}
+
+	duplicates := []KaraDuplicate{}
+	err := db.Preload("Kara").
+		Preload("Duplicate").
+		Where("score >= ?", input.MinScore).
+		Order("score DESC, kara_id, duplicate_id").
+		Find(&duplicates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, duplicate := range duplicates {
+		// one of the karas was deleted since the detection
+		if duplicate.Kara.ID == 0 || duplicate.Duplicate.ID == 0 {
+			continue
+		}
+		out.Body.Duplicates = append(out.Body.Duplicates, duplicate)
+	}
+
+	return out, nil
+}
+
+func StartDuplicateKarasDetection(ctx context.Context, input *struct{}) (*struct{}, error) {
+	err := enqueueJob(GetDB(ctx), JobDuplicatesDetection, struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	return &struct{}{}, nil
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/google/uuid"
+	"github.com/valyala/fasthttp"
+	"gorm.io/gorm"
+)
+
+type EventType string
+
+var EventKaraCreated EventType = "kara_created"
+var EventKaraUpdated EventType = "kara_updated"
+var EventKaraDeleted EventType = "kara_deleted"
+var EventFileUploaded EventType = "file_uploaded"
+var EventCheckFailed EventType = "check_failed"
+var EventFileCorrupted EventType = "file_corrupted"
+var EventMugenImportFinished EventType = "mugen_import_finished"
+var EventDakaraSyncFinished EventType = "dakara_sync_finished"
+
+// Sent to clients resuming from an event that is not kept anymore, they
+// should reload what they need (the changes feed can be used for that)
+var EventReset EventType = "reset"
+
+type KaraEventData struct {
+	KaraID   uint `json:"kara_id"`
+	Revision uint `json:"revision"`
+}
+
+type FileEventData struct {
+	KaraID   uint   `json:"kara_id"`
+	FileType string `json:"file_type" enum:"video,inst,sub"`
+	Size     int64  `json:"size,omitempty"`
+	CRC32    uint32 `json:"crc32,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type MugenImportEventData struct {
+	KaraID   uint      `json:"kara_id"`
+	MugenKID uuid.UUID `json:"mugen_kid"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type DakaraSyncEventData struct {
+	NewSongs     int    `json:"new_songs"`
+	UpdatedSongs int    `json:"updated_songs"`
+	Error        string `json:"error,omitempty"`
+}
+
+type Event struct {
+	ID   uint64    `json:"id"`
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data"`
+}
+
+type EventSubscription struct {
+	Events chan Event
+	bus    *EventBus
+}
+
+func (s *EventSubscription) Close() {
+	s.bus.unsubscribe(s)
+}
+
+// In-process bus of the catalogue events.
+// The last events are kept so clients can resume their stream.
+type EventBus struct {
+	mutex       sync.Mutex
+	last_id     uint64
+	recent      []Event
+	max_recent  int
+	subscribers map[*EventSubscription]struct{}
+}
+
+// Event IDs start from the current time so they keep increasing after a
+// restart and clients resuming from a previous run get a reset.
+func NewEventBus(max_recent int) *EventBus {
+	return &EventBus{
+		last_id:     uint64(time.Now().UnixMicro()),
+		recent:      []Event{},
+		max_recent:  max_recent,
+		subscribers: map[*EventSubscription]struct{}{},
+	}
+}
+
+var EVENTS = NewEventBus(1000)
+
+func (b *EventBus) LastID() uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.last_id
+}
+
+func (b *EventBus) Publish(typ EventType, data any) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.last_id++
+	event := Event{ID: b.last_id, Type: typ, Time: time.Now().UTC(), Data: data}
+	b.recent = append(b.recent, event)
+	if len(b.recent) > b.max_recent {
+		b.recent = b.recent[len(b.recent)-b.max_recent:]
+	}
+
+	for sub := range b.subscribers {
+		select {
+		case sub.Events <- event:
+		default:
+			// too slow, the client can resume from the last event it got
+			getLogger().Println("dropping slow events subscriber")
+			delete(b.subscribers, sub)
+			close(sub.Events)
+		}
+	}
+}
+
+// Subscribe to the events after last_id, 0 for new events only
+func (b *EventBus) Subscribe(last_id uint64) *EventSubscription {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	missed := []Event{}
+	if last_id != 0 && last_id != b.last_id {
+		oldest := b.last_id + 1
+		if len(b.recent) > 0 {
+			oldest = b.recent[0].ID
+		}
+		if last_id > b.last_id || last_id+1 < oldest {
+			missed = append(missed, Event{ID: b.last_id, Type: EventReset, Time: time.Now().UTC(), Data: struct{}{}})
+		} else {
+			for _, event := range b.recent {
+				if event.ID > last_id {
+					missed = append(missed, event)
+				}
+			}
+		}
+	}
+
+	sub := &EventSubscription{Events: make(chan Event, len(missed)+100), bus: b}
+	for _, event := range missed {
+		sub.Events <- event
+	}
+	b.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (b *EventBus) unsubscribe(sub *EventSubscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		close(sub.Events)
+	}
+}
+
+// the event is sent once the change is committed
+func publishKaraEvent(tx *gorm.DB, typ EventType, kara *KaraInfoDB) {
+	data := KaraEventData{KaraID: kara.ID, Revision: kara.Revision}
+	afterCommit(tx, func() { EVENTS.Publish(typ, data) })
+}
+
+var eventsPingInterval = 30 * time.Second
+
+func writeEvent(w io.Writer, event Event) error {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// Write the events until the client is gone, writes fail once it is
+// disconnected so it is pinged regularly.
+func streamEvents(ctx context.Context, w io.Writer, flush func() error, sub *EventSubscription) {
+	defer sub.Close()
+
+	ping := time.NewTicker(eventsPingInterval)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+			err = writeEvent(w, event)
+		case <-ping.C:
+			_, err = io.WriteString(w, ": ping\n\n")
+		case <-ctx.Done():
+			return
+		}
+		if err == nil {
+			err = flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+type GetEventsInput struct {
+	LastEventID string `header:"Last-Event-ID" doc:"ID of the last event received to resume the stream"`
+}
+
+func GetEvents(ctx context.Context, input *GetEventsInput) (*huma.StreamResponse, error) {
+	last_id := uint64(0)
+	if input.LastEventID != "" {
+		var err error
+		last_id, err = strconv.ParseUint(input.LastEventID, 10, 64)
+		if err != nil {
+			return nil, huma.Error422UnprocessableEntity("invalid Last-Event-ID")
+		}
+	}
+
+	sub := EVENTS.Subscribe(last_id)
+
+	return &huma.StreamResponse{
+		Body: func(ctx huma.Context) {
+			ctx.SetHeader("Content-Type", "text/event-stream")
+			ctx.SetHeader("Cache-Control", "no-cache")
+			// don't let reverse proxies buffer the stream
+			ctx.SetHeader("X-Accel-Buffering", "no")
+
+			fiber_ctx, ok := ctx.BodyWriter().(*fasthttp.RequestCtx)
+			if ok {
+				// fasthttp buffers the response until the handler returns
+				fiber_ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+					streamEvents(context.Background(), w, w.Flush, sub)
+				})
+				return
+			}
+
+			w := ctx.BodyWriter()
+			flush := func() error {
+				if flusher, ok := w.(http.Flusher); ok {
+					flusher.Flush()
+				}
+				return nil
+			}
+			streamEvents(ctx.Context(), w, flush, sub)
+		},
+	}, nil
+}
@@ -50,7 +50,7 @@ func createFont(ctx context.Context, name string) (Font, error) {
 	db := GetDB(ctx)
 	font := Font{Name: name}
 
-	err := db.Transaction(
+	err := transaction(db,
 		func(tx *gorm.DB) error {
 			err := tx.Create(&font).Error
 			return DBErrToHumaErr(err)
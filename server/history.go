@@ -0,0 +1,277 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Public info of the user who made a revision
+type RevisionEditor struct {
+	ID string `json:"id"`
+	// name of their timing profile, empty if they don't have one
+	Name string `json:"name"`
+}
+
+type KaraRevision struct {
+	ID uint `json:"id"`
+	// true if this is the current version of the kara
+	Current      bool            `json:"current"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+	EditorUserID *string         `json:"editor_user_id"`
+	Editor       *RevisionEditor `json:"editor"`
+}
+
+type FieldChange struct {
+	Field string `json:"field" example:"title"`
+	Old   any    `json:"old"`
+	New   any    `json:"new"`
+}
+
+type DiffTag struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type AssociationChange struct {
+	Field   string    `json:"field" example:"artists"`
+	Added   []DiffTag `json:"added"`
+	Removed []DiffTag `json:"removed"`
+}
+
+type KaraDiff struct {
+	From KaraRevision `json:"from"`
+	// the editor of this revision made the change
+	To           KaraRevision        `json:"to"`
+	Fields       []FieldChange       `json:"fields"`
+	Associations []AssociationChange `json:"associations"`
+}
+
+type diffField struct {
+	name  string
+	value any
+}
+
+func karaRevision(kara KaraInfoDB) KaraRevision {
+	revision := KaraRevision{
+		ID:           kara.ID,
+		Current:      kara.CurrentKaraInfoID == nil,
+		UpdatedAt:    kara.UpdatedAt,
+		EditorUserID: kara.EditorUserID,
+	}
+	if kara.EditorUser != nil {
+		revision.Editor = &RevisionEditor{ID: kara.EditorUser.ID}
+		if kara.EditorUser.TimingProfile != nil {
+			revision.Editor.Name = kara.EditorUser.TimingProfile.Name
+		}
+	}
+	return revision
+}
+
+func karaDiffFields(kara KaraInfoDB) []diffField {
+	var source_media any = nil
+	if kara.SourceMedia != nil {
+		source_media = DiffTag{fmt.Sprint(kara.SourceMedia.ID), kara.SourceMedia.Description()}
+	}
+
+	var claimed_by any = nil
+	if kara.ClaimedBy != nil {
+		claimed_by = DiffTag{fmt.Sprint(kara.ClaimedBy.ID), kara.ClaimedBy.Name}
+	}
+
+	return []diffField{
+		{"title", kara.Title},
+		{"version", kara.Version},
+		{"comment", kara.Comment},
+		{"language", kara.Language},
+		{"song_order", kara.SongOrder},
+		{"private", kara.Private},
+		{"source_media", source_media},
+		{"status", kara.Status},
+		{"claimed_by", claimed_by},
+		{"video_uploaded", kara.VideoUploaded},
+		{"video_size", kara.VideoSize},
+		{"video_crc32", kara.VideoCRC32},
+		{"video_mod_time", kara.VideoModTime},
+		{"instrumental_uploaded", kara.InstrumentalUploaded},
+		{"instrumental_size", kara.InstrumentalSize},
+		{"instrumental_crc32", kara.InstrumentalCRC32},
+		{"instrumental_mod_time", kara.InstrumentalModTime},
+		{"subtitles_uploaded", kara.SubtitlesUploaded},
+		{"subtitles_size", kara.SubtitlesSize},
+		{"subtitles_crc32", kara.SubtitlesCRC32},
+		{"subtitles_mod_time", kara.SubtitlesModTime},
+		{"hardsubbed", kara.Hardsubbed},
+		{"duration", kara.Duration},
+		{"karaoke_creation_time", kara.KaraokeCreationTime},
+	}
+}
+
+func diffTags[T any](items []T, tag func(T) DiffTag) []DiffTag {
+	tags := make([]DiffTag, len(items))
+	for i, item := range items {
+		tags[i] = tag(item)
+	}
+	return tags
+}
+
+func karaDiffAssociations(kara KaraInfoDB) map[string][]DiffTag {
+	return map[string][]DiffTag{
+		"authors": diffTags(kara.Authors, func(a TimingAuthor) DiffTag {
+			return DiffTag{fmt.Sprint(a.ID), a.Name}
+		}),
+		"artists": diffTags(kara.Artists, func(a Artist) DiffTag {
+			return DiffTag{fmt.Sprint(a.ID), a.Name}
+		}),
+		"medias": diffTags(kara.Medias, func(m MediaDB) DiffTag {
+			return DiffTag{fmt.Sprint(m.ID), m.Description()}
+		}),
+		"audio_tags": diffTags(kara.AudioTags, func(t AudioTagDB) DiffTag {
+			return DiffTag{t.ID, t.ID}
+		}),
+		"video_tags": diffTags(kara.VideoTags, func(t VideoTagDB) DiffTag {
+			return DiffTag{t.ID, t.ID}
+		}),
+		// extra titles are recreated on each update, compare them by name
+		"title_aliases": diffTags(kara.ExtraTitles, func(n AdditionalName) DiffTag {
+			return DiffTag{n.Name, n.Name}
+		}),
+	}
+}
+
+var karaDiffAssociationsOrder = []string{"authors", "artists", "medias", "audio_tags", "video_tags", "title_aliases"}
+
+func sameDiffValue(a any, b any) bool {
+	a_time, ok := a.(time.Time)
+	if ok {
+		b_time, ok := b.(time.Time)
+		return ok && a_time.Equal(b_time)
+	}
+	return a == b
+}
+
+// tags in a but not in b
+func missingTags(a []DiffTag, b []DiffTag) []DiffTag {
+	missing := []DiffTag{}
+	for _, tag := range a {
+		if !slices.ContainsFunc(b, func(other DiffTag) bool { return other.ID == tag.ID }) {
+			missing = append(missing, tag)
+		}
+	}
+	return missing
+}
+
+func diffKaras(from KaraInfoDB, to KaraInfoDB) KaraDiff {
+	diff := KaraDiff{
+		From:         karaRevision(from),
+		To:           karaRevision(to),
+		Fields:       []FieldChange{},
+		Associations: []AssociationChange{},
+	}
+
+	to_fields := karaDiffFields(to)
+	for i, field := range karaDiffFields(from) {
+		if !sameDiffValue(field.value, to_fields[i].value) {
+			diff.Fields = append(diff.Fields, FieldChange{field.name, field.value, to_fields[i].value})
+		}
+	}
+
+	from_assocs := karaDiffAssociations(from)
+	to_assocs := karaDiffAssociations(to)
+	for _, name := range karaDiffAssociationsOrder {
+		change := AssociationChange{
+			Field:   name,
+			Added:   missingTags(to_assocs[name], from_assocs[name]),
+			Removed: missingTags(from_assocs[name], to_assocs[name]),
+		}
+		if len(change.Added) > 0 || len(change.Removed) > 0 {
+			diff.Associations = append(diff.Associations, change)
+		}
+	}
+
+	return diff
+}
+
+// All versions of a kara from the oldest to the current one
+func getKaraRevisions(tx *gorm.DB, kara_id uint) ([]KaraInfoDB, error) {
+	current := KaraInfoDB{}
+	err := tx.Scopes(KaraRevisionAssociations, CurrentKaras).First(&current, kara_id).Error
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	revisions := []KaraInfoDB{}
+	err = tx.Scopes(KaraRevisionAssociations).
+		Where(&KaraInfoDB{CurrentKaraInfoID: &kara_id}).
+		Order("id").
+		Find(&revisions).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return append(revisions, current), nil
+}
+
+type KaraDiffInput struct {
+	Id        uint `path:"id"`
+	HistoryId uint `path:"history_id"`
+	// defaults to the current version
+	To uint `query:"to" doc:"history entry to compare to, defaults to the current version"`
+}
+
+type KaraDiffOutput struct {
+	Body struct {
+		Diff KaraDiff `json:"diff"`
+	}
+}
+
+func GetKaraDiff(ctx context.Context, input *KaraDiffInput) (*KaraDiffOutput, error) {
+	db := GetDB(ctx)
+	out := &KaraDiffOutput{}
+
+	from, err := getKaraHistoryEntry(db, input.Id, input.HistoryId)
+	if err != nil {
+		return nil, err
+	}
+
+	to := KaraInfoDB{}
+	if input.To == 0 || input.To == input.Id {
+		err = db.Scopes(KaraRevisionAssociations, CurrentKaras).First(&to, input.Id).Error
+		err = DBErrToHumaErr(err)
+	} else {
+		to, err = getKaraHistoryEntry(db, input.Id, input.To)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	out.Body.Diff = diffKaras(from, to)
+	return out, nil
+}
+
+type KaraChangesOutput struct {
+	Body struct {
+		// changes from the oldest to the most recent
+		Changes []KaraDiff `json:"changes"`
+	}
+}
+
+func GetKaraChanges(ctx context.Context, input *GetKaraInput) (*KaraChangesOutput, error) {
+	db := GetDB(ctx)
+	out := &KaraChangesOutput{}
+	out.Body.Changes = []KaraDiff{}
+
+	revisions, err := getKaraRevisions(db, input.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 1; i < len(revisions); i++ {
+		out.Body.Changes = append(out.Body.Changes, diffKaras(revisions[i-1], revisions[i]))
+	}
+
+	return out, nil
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"gorm.io/gorm"
+)
+
+var IssueTypeTiming = "timing"
+var IssueTypeTypo = "typo"
+var IssueTypeVideoQuality = "video_quality"
+var IssueTypeMetadata = "wrong_metadata"
+
+var IssueOpen = "open"
+var IssueResolved = "resolved"
+
+var issueTypeNames = map[string]string{
+	IssueTypeTiming:       "Timing",
+	IssueTypeTypo:         "Typo",
+	IssueTypeVideoQuality: "Video quality",
+	IssueTypeMetadata:     "Wrong metadata",
+}
+
+// Problem reported on an uploaded kara
+type KaraIssue struct {
+	ID          uint           `gorm:"primarykey" json:"id"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+	KaraID      uint           `gorm:"index" json:"kara_id"`
+	Type        string         `json:"type"`
+	Description string         `json:"description"`
+	// position in the media where the issue happens, in milliseconds
+	Timestamp  *uint      `json:"timestamp"`
+	Status     string     `gorm:"index" json:"status"`
+	ReporterID *string    `json:"reporter_id"`
+	Reporter   *User      `gorm:"foreignKey:ReporterID;references:ID" json:"reporter"`
+	ResolverID *string    `json:"resolver_id"`
+	Resolver   *User      `gorm:"foreignKey:ResolverID;references:ID" json:"resolver"`
+	ResolvedAt *time.Time `json:"resolved_at"`
+}
+
+func (issue *KaraIssue) BeforeSave(tx *gorm.DB) error {
+	issue.Description = trimWhitespace(issue.Description)
+	return nil
+}
+
+func (issue KaraIssue) TypeName() string {
+	name, ok := issueTypeNames[issue.Type]
+	if !ok {
+		return issue.Type
+	}
+	return name
+}
+
+func formatIssueTimestamp(ms uint) string {
+	d := time.Duration(ms) * time.Millisecond
+	return fmt.Sprintf("%d:%02d.%03d", int(d.Minutes()), int(d.Seconds())%60, ms%1000)
+}
+
+func issueDescription(issue KaraIssue) string {
+	parts := []string{karaDescriptionPart("Type", issue.TypeName())}
+
+	if issue.Timestamp != nil {
+		parts = append(parts, karaDescriptionPart("Timestamp", formatIssueTimestamp(*issue.Timestamp)))
+	}
+	if issue.Description != "" {
+		parts = append(parts, issue.Description)
+	}
+
+	return strings.Join(parts, "\n\n")
+}
+
+func issueTemplateContext(event WebhookEvent, kara KaraInfoDB, issue KaraIssue) WebhookTemplateContext {
+	return WebhookTemplateContext{
+		Event:       event,
+		Kara:        kara,
+		Issue:       &issue,
+		Server:      CONFIG.Listen.BaseURL,
+		Title:       kara.FriendlyName(),
+		Description: issueDescription(issue),
+		Resource:    karaResource(kara),
+	}
+}
+
+func PostIssueWebhooks(tx *gorm.DB, event WebhookEvent, kara KaraInfoDB, issue KaraIssue) error {
+	return enqueueWebhooks(tx, issueTemplateContext(event, kara, issue))
+}
+
+func IssuesAssociations(tx *gorm.DB) *gorm.DB {
+	return tx.Preload("Reporter").Preload("Resolver")
+}
+
+type KaraIssueInfo struct {
+	Type        string `json:"type" enum:"timing,typo,video_quality,wrong_metadata" example:"timing"`
+	Description string `json:"description" example:"the second verse is late"`
+	// position in the media where the issue happens, in milliseconds
+	Timestamp *uint `json:"timestamp,omitempty" example:"83500"`
+}
+
+func (info KaraIssueInfo) check(kara KaraInfoDB) error {
+	if info.Timestamp != nil && kara.Duration > 0 && *info.Timestamp > uint(kara.Duration)*1000 {
+		return huma.Error422UnprocessableEntity("timestamp is after the end of the media")
+	}
+	return nil
+}
+
+type GetKaraIssuesInput struct {
+	Id     uint   `path:"id"`
+	Status string `query:"status" enum:"open,resolved" doc:"filter by status"`
+}
+
+type KaraIssuesOutput struct {
+	Body struct {
+		Issues []KaraIssue `json:"issues"`
+	}
+}
+
+func GetKaraIssues(ctx context.Context, input *GetKaraIssuesInput) (*KaraIssuesOutput, error) {
+	db := GetDB(ctx)
+	out := &KaraIssuesOutput{}
+	out.Body.Issues = []KaraIssue{}
+
+	kara := KaraInfoDB{}
+	err := db.Scopes(CurrentKaras).First(&kara, input.Id).Error
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	tx := db.Scopes(IssuesAssociations).Where(&KaraIssue{KaraID: kara.ID})
+	if input.Status != "" {
+		tx = tx.Where(&KaraIssue{Status: input.Status})
+	}
+	err = tx.Order("id").Find(&out.Body.Issues).Error
+	return out, err
+}
+
+type KaraIssueInput struct {
+	Id      uint `path:"id"`
+	IssueId uint `path:"issue_id"`
+}
+
+type KaraIssueOutput struct {
+	Body struct {
+		Issue KaraIssue `json:"issue"`
+	}
+}
+
+func getKaraIssue(tx *gorm.DB, kara_id uint, issue_id uint) (KaraIssue, error) {
+	issue := KaraIssue{}
+	err := tx.Scopes(IssuesAssociations).
+		Where(&KaraIssue{KaraID: kara_id}).
+		First(&issue, issue_id).Error
+	return issue, DBErrToHumaErr(err)
+}
+
+func GetKaraIssue(ctx context.Context, input *KaraIssueInput) (*KaraIssueOutput, error) {
+	db := GetDB(ctx)
+	out := &KaraIssueOutput{}
+
+	issue, err := getKaraIssue(db, input.Id, input.IssueId)
+	if err != nil {
+		return nil, err
+	}
+
+	out.Body.Issue = issue
+	return out, nil
+}
+
+type CreateKaraIssueInput struct {
+	Id   uint `path:"id"`
+	Body KaraIssueInfo
+}
+
+func CreateKaraIssue(ctx context.Context, input *CreateKaraIssueInput) (*KaraIssueOutput, error) {
+	db := GetDB(ctx)
+	out := &KaraIssueOutput{}
+
+	kara := KaraInfoDB{}
+	err := transaction(db, func(tx *gorm.DB) error {
+		err := tx.Scopes(KaraAssociations, CurrentKaras).First(&kara, input.Id).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Scopes(UploadedKaras).First(&KaraInfoDB{}, kara.ID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return huma.Error422UnprocessableEntity("issues can only be reported on uploaded karaokes")
+		}
+		if err != nil {
+			return err
+		}
+
+		err = input.Body.check(kara)
+		if err != nil {
+			return err
+		}
+
+		issue := KaraIssue{
+			KaraID:      kara.ID,
+			Type:        input.Body.Type,
+			Description: input.Body.Description,
+			Timestamp:   input.Body.Timestamp,
+			Status:      IssueOpen,
+			Reporter:    getCurrentUserNilable(tx),
+		}
+		err = tx.Create(&issue).Error
+		if err != nil {
+			return err
+		}
+
+		out.Body.Issue, err = getKaraIssue(tx, kara.ID, issue.ID)
+		if err != nil {
+			return err
+		}
+
+		return PostIssueWebhooks(tx, WebhookIssueOpened, kara, out.Body.Issue)
+	})
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	return out, nil
+}
+
+type UpdateKaraIssueInput struct {
+	Id      uint `path:"id"`
+	IssueId uint `path:"issue_id"`
+	Body    struct {
+		KaraIssueInfo
+		Status string `json:"status" enum:"open,resolved" example:"resolved"`
+	}
+}
+
+func UpdateKaraIssue(ctx context.Context, input *UpdateKaraIssueInput) (*KaraIssueOutput, error) {
+	db := GetDB(ctx)
+	out := &KaraIssueOutput{}
+
+	kara := KaraInfoDB{}
+	var event *WebhookEvent = nil
+	err := transaction(db, func(tx *gorm.DB) error {
+		err := tx.Scopes(KaraAssociations, CurrentKaras).First(&kara, input.Id).Error
+		if err != nil {
+			return err
+		}
+
+		issue, err := getKaraIssue(tx, kara.ID, input.IssueId)
+		if err != nil {
+			return err
+		}
+
+		err = input.Body.check(kara)
+		if err != nil {
+			return err
+		}
+
+		issue.Type = input.Body.Type
+		issue.Description = input.Body.Description
+		issue.Timestamp = input.Body.Timestamp
+
+		if input.Body.Status != issue.Status {
+			issue.Status = input.Body.Status
+			if issue.Status == IssueResolved {
+				now := time.Now().UTC()
+				issue.ResolvedAt = &now
+				issue.Resolver = getCurrentUserNilable(tx)
+				if issue.Resolver != nil {
+					issue.ResolverID = &issue.Resolver.ID
+				}
+				event = &WebhookIssueResolved
+			} else {
+				issue.ResolvedAt = nil
+				issue.Resolver = nil
+				issue.ResolverID = nil
+				event = &WebhookIssueOpened
+			}
+		}
+
+		err = tx.Omit("Reporter", "Resolver").Save(&issue).Error
+		if err != nil {
+			return err
+		}
+
+		out.Body.Issue, err = getKaraIssue(tx, kara.ID, issue.ID)
+		if err != nil {
+			return err
+		}
+
+		if event != nil {
+			return PostIssueWebhooks(tx, *event, kara, out.Body.Issue)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	return out, nil
+}
+
+type DeleteKaraIssueOutput struct {
+	Status int
+}
+
+func DeleteKaraIssue(ctx context.Context, input *KaraIssueInput) (*DeleteKaraIssueOutput, error) {
+	db := GetDB(ctx)
+
+	issue, err := getKaraIssue(db, input.Id, input.IssueId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Delete(&issue).Error
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+	return &DeleteKaraIssueOutput{204}, nil
+}
@@ -0,0 +1,451 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var JobPending = "pending"
+var JobRunning = "running"
+var JobSucceeded = "succeeded"
+var JobFailed = "failed"
+var JobCanceled = "canceled"
+
+// Background work, jobs are run by the job worker and retried when they fail
+type Job struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Type      string    `gorm:"index;uniqueIndex:idx_pending_job,where:status = 'pending'" json:"type"`
+	// JSON arguments of the job
+	Payload  string `gorm:"uniqueIndex:idx_pending_job,where:status = 'pending'" json:"payload"`
+	Status   string `gorm:"index" json:"status" enum:"pending,running,succeeded,failed,canceled"`
+	Attempts int    `json:"attempts"`
+	// the job is not started before this time
+	RunAt      time.Time  `gorm:"index" json:"run_at"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	LastError  string     `json:"last_error"`
+}
+
+func (job Job) decode(payload any) error {
+	return json.Unmarshal([]byte(job.Payload), payload)
+}
+
+var JobMugenDownload = "mugen_download"
+var JobMugenSync = "mugen_sync"
+var JobDakaraSync = "dakara_sync"
+var JobDuplicatesDetection = "duplicates_detection"
+var JobInitSizeCRC = "init_size_crc"
+var JobExportRemainingKaras = "export_remaining_karas"
+var JobStorageScrub = "storage_scrub"
+
+type JobHandler struct {
+	Run func(ctx context.Context, job Job) error
+	// jobs of this type running at the same time
+	Concurrency int
+	// the job fails after this many attempts
+	MaxAttempts int
+	// recurring jobs are enqueued again to run after this delay when they finish
+	Interval time.Duration
+}
+
+var jobHandlers = map[string]JobHandler{
+	JobMugenDownload:        {Run: runMugenDownloadJob, Concurrency: 5, MaxAttempts: 3},
+	JobMugenSync:            {Run: runMugenSyncJob, Concurrency: 1, MaxAttempts: 3},
+	JobDakaraSync:           {Run: runDakaraSyncJob, Concurrency: 1, MaxAttempts: 3},
+	JobDuplicatesDetection:  {Run: runDuplicatesDetectionJob, Concurrency: 1, MaxAttempts: 1, Interval: 24 * time.Hour},
+	JobInitSizeCRC:          {Run: runInitSizeCRCJob, Concurrency: 1, MaxAttempts: 3},
+	JobExportRemainingKaras: {Run: runExportRemainingKarasJob, Concurrency: 1, MaxAttempts: 3},
+	JobStorageScrub:         {Run: runStorageScrubJob, Concurrency: 1, MaxAttempts: 1, Interval: time.Hour},
+}
+
+// Delay before the first retry, doubled after each failure
+var jobRetryDelay = time.Minute
+var jobMaxRetryDelay = 6 * time.Hour
+
+func jobRetryBackoff(attempts int) time.Duration {
+	delay := jobRetryDelay
+	for i := 1; i < attempts && delay < jobMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, jobMaxRetryDelay)
+}
+
+func enqueueJob(tx *gorm.DB, typ string, payload any) error {
+	return enqueueJobAt(tx, typ, payload, time.Now().UTC())
+}
+
+// Jobs are unique while they are pending, a job that is already waiting to
+// run is started no later than run_at instead
+func enqueueJobAt(tx *gorm.DB, typ string, payload any, run_at time.Time) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	job := Job{Type: typ, Payload: string(b), Status: JobPending, RunAt: run_at}
+	res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&job)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		err = tx.Model(&Job{}).
+			Where(&Job{Type: typ, Payload: job.Payload, Status: JobPending}).
+			Where("run_at > ?", run_at).
+			UpdateColumn("run_at", run_at).Error
+		if err != nil {
+			return err
+		}
+	}
+	afterCommit(tx, notifyJobWorker)
+	return nil
+}
+
+// Jobs that can be pending again, the same one was not enqueued since they
+// were started
+func withoutPendingDuplicate(tx *gorm.DB) *gorm.DB {
+	return tx.Where(
+		"NOT EXISTS (SELECT 1 FROM jobs AS pending WHERE pending.type = jobs.type AND pending.payload = jobs.payload AND pending.status = ?)",
+		JobPending,
+	)
+}
+
+// Keep one pending job of each type and payload before they are unique
+func removePendingDuplicateJobs(db *gorm.DB) {
+	err := db.Where(
+		"status = ? AND id NOT IN (SELECT MIN(id) FROM jobs WHERE status = ? GROUP BY type, payload)",
+		JobPending, JobPending,
+	).Delete(&Job{}).Error
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Enqueue the recurring jobs that are not waiting to run
+func enqueueRecurringJobs(db *gorm.DB) error {
+	for typ, handler := range jobHandlers {
+		if handler.Interval == 0 {
+			continue
+		}
+		var count int64
+		err := db.Model(&Job{}).Where(&Job{Type: typ, Status: JobPending}).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			err = enqueueJob(db, typ, struct{}{})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var jobNotifyChannel = make(chan bool, 1)
+
+// Notify the job worker (non blocking)
+func notifyJobWorker() {
+	select {
+	case jobNotifyChannel <- true:
+	default:
+	}
+}
+
+var jobsMutex = sync.Mutex{}
+var runningJobs = map[string]int{}
+var jobCancels = map[uint]context.CancelFunc{}
+
+func runJob(ctx context.Context, job Job, handler JobHandler) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			getLogger().Printf("recovered from panic in job %d: %s\n%s\n", job.ID, r, string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler.Run(ctx, job)
+}
+
+func finishJob(ctx context.Context, job Job, handler JobHandler, err error) {
+	now := time.Now().UTC()
+	updates := map[string]any{"finished_at": now}
+	if err == nil {
+		updates["status"] = JobSucceeded
+		updates["last_error"] = ""
+	} else {
+		getLogger().Printf("job %d (%s) failed: %s", job.ID, job.Type, err)
+		updates["last_error"] = err.Error()
+		if job.Attempts >= handler.MaxAttempts {
+			updates["status"] = JobFailed
+		} else {
+			updates["status"] = JobPending
+			updates["run_at"] = now.Add(jobRetryBackoff(job.Attempts))
+		}
+	}
+
+	db := GetDB(context.WithoutCancel(ctx))
+	if updates["status"] == JobPending {
+		res := db.Model(&Job{}).
+			Scopes(withoutPendingDuplicate).
+			Where(&Job{ID: job.ID, Status: JobRunning}).
+			Updates(updates)
+		if res.Error != nil {
+			getLogger().Println(res.Error)
+		}
+		if res.Error != nil || res.RowsAffected > 0 {
+			return
+		}
+		// the pending one is run instead
+		updates["status"] = JobFailed
+		delete(updates, "run_at")
+	}
+
+	// canceled jobs keep their status
+	err = db.Model(&Job{}).
+		Where(&Job{ID: job.ID, Status: JobRunning}).
+		Updates(updates).Error
+	if err != nil {
+		getLogger().Println(err)
+	}
+
+	if handler.Interval > 0 {
+		err = enqueueJobAt(db, job.Type, json.RawMessage(job.Payload), now.Add(handler.Interval))
+		if err != nil {
+			getLogger().Println(err)
+		}
+	}
+}
+
+// Start the jobs that are due, within the concurrency limit of their type.
+// The returned WaitGroup is done when the started jobs are finished.
+func startDueJobs(ctx context.Context) *sync.WaitGroup {
+	wg := &sync.WaitGroup{}
+	db := GetDB(ctx)
+	now := time.Now().UTC()
+
+	err := db.Model(&Job{}).
+		Where("status = ? AND type NOT IN ?", JobPending, slices.Collect(maps.Keys(jobHandlers))).
+		Updates(Job{Status: JobFailed, LastError: "unknown job type"}).Error
+	if err != nil {
+		getLogger().Println(err)
+	}
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	// each type is queried separately so the jobs of a type waiting for
+	// free slots don't hide the jobs of the other types
+	for typ, handler := range jobHandlers {
+		free := handler.Concurrency - runningJobs[typ]
+		if free <= 0 {
+			continue
+		}
+
+		jobs := []Job{}
+		err := db.Where("type = ? AND status = ? AND run_at <= ?", typ, JobPending, now).
+			Order("run_at ASC").
+			Order("id ASC").
+			Limit(free).
+			Find(&jobs).Error
+		if err != nil {
+			getLogger().Println(err)
+			continue
+		}
+
+		for _, job := range jobs {
+			startJob(ctx, wg, job, handler)
+		}
+	}
+	return wg
+}
+
+// jobsMutex must be held
+func startJob(ctx context.Context, wg *sync.WaitGroup, job Job, handler JobHandler) {
+	db := GetDB(ctx)
+	now := time.Now().UTC()
+	res := db.Model(&Job{}).
+		Where(&Job{ID: job.ID, Status: JobPending}).
+		Updates(map[string]any{"status": JobRunning, "started_at": now, "attempts": job.Attempts + 1})
+	if res.Error != nil {
+		getLogger().Println(res.Error)
+		return
+	}
+	if res.RowsAffected == 0 {
+		// canceled in the meantime
+		return
+	}
+	job.Status = JobRunning
+	job.StartedAt = &now
+	job.Attempts++
+
+	job_ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	runningJobs[job.Type]++
+	jobCancels[job.ID] = cancel
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := runJob(job_ctx, job, handler)
+		finishJob(job_ctx, job, handler, err)
+
+		jobsMutex.Lock()
+		runningJobs[job.Type]--
+		delete(jobCancels, job.ID)
+		jobsMutex.Unlock()
+		cancel()
+		notifyJobWorker()
+	}()
+}
+
+// Jobs running when the server stopped are started again, unless the same
+// job is already pending
+func resetInterruptedJobs(db *gorm.DB) error {
+	now := time.Now().UTC()
+	err := db.Model(&Job{}).
+		Scopes(withoutPendingDuplicate).
+		Where("id IN (SELECT MIN(id) FROM jobs WHERE status = ? GROUP BY type, payload)", JobRunning).
+		Updates(map[string]any{"status": JobPending, "run_at": now}).Error
+	if err != nil {
+		return err
+	}
+	return db.Model(&Job{}).
+		Where(&Job{Status: JobRunning}).
+		Updates(map[string]any{"status": JobFailed, "last_error": "interrupted", "finished_at": now}).Error
+}
+
+var jobPollInterval = 10 * time.Second
+
+func RunJobsLoop(ctx context.Context) {
+	err := resetInterruptedJobs(GetDB(ctx))
+	if err != nil {
+		getLogger().Println(err)
+	}
+	err = enqueueRecurringJobs(GetDB(ctx))
+	if err != nil {
+		getLogger().Println(err)
+	}
+	for {
+		startDueJobs(ctx)
+		select {
+		case <-jobNotifyChannel:
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+type GetJobsInput struct {
+	Status string `query:"status" enum:"pending,running,succeeded,failed,canceled," doc:"only return the jobs with this status"`
+	Type   string `query:"type" doc:"only return the jobs of this type"`
+	Limit  int    `query:"limit" default:"100" minimum:"1" maximum:"1000"`
+}
+
+type JobsOutput struct {
+	Body struct {
+		Jobs []Job `json:"jobs"`
+	}
+}
+
+func GetJobs(ctx context.Context, input *GetJobsInput) (*JobsOutput, error) {
+	db := GetDB(ctx)
+	out := &JobsOutput{}
+	err := db.Where(&Job{Status: input.Status, Type: input.Type}).
+		Order("id DESC").
+		Limit(input.Limit).
+		Find(&out.Body.Jobs).Error
+	return out, DBErrToHumaErr(err)
+}
+
+type JobInput struct {
+	ID uint `path:"id"`
+}
+
+type JobOutput struct {
+	Body struct {
+		Job Job `json:"job"`
+	}
+}
+
+func GetJob(ctx context.Context, input *JobInput) (*JobOutput, error) {
+	db := GetDB(ctx)
+	out := &JobOutput{}
+	err := db.First(&out.Body.Job, input.ID).Error
+	return out, DBErrToHumaErr(err)
+}
+
+// Run a failed or canceled job again with all its attempts
+func RetryJob(ctx context.Context, input *JobInput) (*JobOutput, error) {
+	db := GetDB(ctx)
+	out := &JobOutput{}
+
+	err := transaction(db, func(tx *gorm.DB) error {
+		job := &out.Body.Job
+		err := lockForUpdate(tx).First(job, input.ID).Error
+		if err != nil {
+			return err
+		}
+		if job.Status != JobFailed && job.Status != JobCanceled {
+			return huma.Error409Conflict(fmt.Sprintf("job is %s", job.Status))
+		}
+		var count int64
+		err = tx.Model(&Job{}).Where(&Job{Type: job.Type, Payload: job.Payload, Status: JobPending}).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return huma.Error409Conflict("the same job is already pending")
+		}
+		job.Status = JobPending
+		job.Attempts = 0
+		job.RunAt = time.Now().UTC()
+		return tx.Save(job).Error
+	})
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	notifyJobWorker()
+	return out, nil
+}
+
+// Cancel a pending job or stop a running one
+func CancelJob(ctx context.Context, input *JobInput) (*JobOutput, error) {
+	db := GetDB(ctx)
+	out := &JobOutput{}
+
+	err := transaction(db, func(tx *gorm.DB) error {
+		job := &out.Body.Job
+		err := lockForUpdate(tx).First(job, input.ID).Error
+		if err != nil {
+			return err
+		}
+		if job.Status != JobPending && job.Status != JobRunning {
+			return huma.Error409Conflict(fmt.Sprintf("job is %s", job.Status))
+		}
+		job.Status = JobCanceled
+		now := time.Now().UTC()
+		job.FinishedAt = &now
+		return tx.Save(job).Error
+	})
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	jobsMutex.Lock()
+	cancel, ok := jobCancels[input.ID]
+	jobsMutex.Unlock()
+	if ok {
+		cancel()
+	}
+	return out, nil
+}
@@ -5,11 +5,16 @@ package server
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/danielgtaylor/huma/v2"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Media struct {
@@ -155,7 +160,9 @@ func (info KaraInfo) to_KaraInfoDB(ctx context.Context, tx *gorm.DB, kara_info *
 			return err
 		}
 		kara_info.SourceMedia = &source_media
+		kara_info.SourceMediaID = &source_media.ID
 	} else {
+		kara_info.SourceMedia = nil
 		kara_info.SourceMediaID = nil
 	}
 
@@ -167,16 +174,25 @@ type CreateKaraInput struct {
 }
 
 type KaraOutput struct {
+	ETag string `header:"ETag"`
 	Body struct {
 		Kara KaraInfoDB `json:"kara"`
 	}
 }
 
-func CreateKara(ctx context.Context, input *CreateKaraInput) (*KaraOutput, error) {
+type CreateKaraOutput struct {
+	Body struct {
+		Kara KaraInfoDB `json:"kara"`
+		// existing karas closely matching the new one
+		Duplicates []DuplicateMatch `json:"duplicates"`
+	}
+}
+
+func CreateKara(ctx context.Context, input *CreateKaraInput) (*CreateKaraOutput, error) {
 	db := GetDB(ctx)
-	output := KaraOutput{}
+	output := CreateKaraOutput{}
 
-	err := db.Transaction(func(tx *gorm.DB) error {
+	err := transaction(db, func(tx *gorm.DB) error {
 		kara := KaraInfoDB{}
 		err := input.Body.to_KaraInfoDB(ctx, tx, &kara)
 		if err != nil {
@@ -185,6 +201,11 @@ func CreateKara(ctx context.Context, input *CreateKaraInput) (*KaraOutput, error
 		output.Body.Kara = kara
 
 		err = tx.Create(&output.Body.Kara).Error
+		if err != nil {
+			return err
+		}
+
+		output.Body.Duplicates, err = findKaraDuplicates(tx, output.Body.Kara)
 		return err
 	})
 
@@ -198,13 +219,78 @@ type SetKaraUploadTimeInput struct {
 	}
 }
 
+// KaraInfo with every field optional, used as a JSON Merge Patch
+type KaraInfoPatch struct {
+	Title               *string  `json:"title,omitempty" nullable:"true" example:"Zankoku na Tenshi no These"`
+	ExtraTitles         []string `json:"title_aliases,omitempty" example:"[\"A Cruel Angel's Thesis\"]"`
+	Authors             []uint   `json:"authors,omitempty" example:"[1]"`
+	Artists             []uint   `json:"artists,omitempty" example:"[1]"`
+	SourceMedia         *uint    `json:"source_media,omitempty" nullable:"true" example:"1"`
+	SongOrder           *uint    `json:"song_order,omitempty" nullable:"true" example:"0"`
+	Medias              []uint   `json:"medias,omitempty"`
+	AudioTags           []string `json:"audio_tags,omitempty" example:"[\"OP\"]"`
+	VideoTags           []string `json:"video_tags,omitempty" example:"[\"NSFW\"]"`
+	Comment             *string  `json:"comment,omitempty" nullable:"true" example:"From https://youtu.be/dQw4w9WgXcQ"`
+	Version             *string  `json:"version,omitempty" nullable:"true" example:"iykyk"`
+	Language            *string  `json:"language,omitempty" nullable:"true" example:"FR"`
+	KaraokeCreationDate *int64   `json:"karaoke_creation_time,omitempty" nullable:"true" example:"42"`
+	IsHardsub           *bool    `json:"is_hardsub,omitempty" nullable:"true" example:"false"`
+	Private             *bool    `json:"private,omitempty" nullable:"true" example:"false"`
+}
+
+// Only the fields of the body are updated (JSON Merge Patch, RFC 7396),
+// association lists given in the body replace the current ones.
 type UpdateKaraInput struct {
-	Id   uint `path:"id"`
-	Body KaraInfo
+	Id      uint   `path:"id"`
+	IfMatch string `header:"If-Match" doc:"ETag of the version the edit is based on"`
+	Body    KaraInfoPatch
+	RawBody []byte
+}
+
+// Current values of a kara as given to CreateKara
+func karaInfoFromDB(kara KaraInfoDB) KaraInfo {
+	info := KaraInfo{
+		Title:       kara.Title,
+		ExtraTitles: make([]string, len(kara.ExtraTitles)),
+		Authors:     make([]uint, len(kara.Authors)),
+		Artists:     make([]uint, len(kara.Artists)),
+		SongOrder:   kara.SongOrder,
+		Medias:      make([]uint, len(kara.Medias)),
+		AudioTags:   make([]string, len(kara.AudioTags)),
+		VideoTags:   make([]string, len(kara.VideoTags)),
+		Comment:     kara.Comment,
+		Version:     kara.Version,
+		Language:    kara.Language,
+		Private:     kara.Private,
+	}
+
+	for i, title := range kara.ExtraTitles {
+		info.ExtraTitles[i] = title.Name
+	}
+	for i, author := range kara.Authors {
+		info.Authors[i] = author.ID
+	}
+	for i, artist := range kara.Artists {
+		info.Artists[i] = artist.ID
+	}
+	if kara.SourceMediaID != nil {
+		info.SourceMedia = *kara.SourceMediaID
+	}
+	for i, media := range kara.Medias {
+		info.Medias[i] = media.ID
+	}
+	for i, tag := range kara.AudioTags {
+		info.AudioTags[i] = tag.ID
+	}
+	for i, tag := range kara.VideoTags {
+		info.VideoTags[i] = tag.ID
+	}
+
+	return info
 }
 
 func updateKara(tx *gorm.DB, kara *KaraInfoDB) error {
-	err := tx.Model(&kara).Select("*").Updates(&kara).Error
+	err := WithMetadataUpdate(tx).Model(&kara).Select("*").Updates(&kara).Error
 	if err != nil {
 		return err
 	}
@@ -227,6 +313,10 @@ func updateKara(tx *gorm.DB, kara *KaraInfoDB) error {
 	if err != nil {
 		return err
 	}
+	err = tx.Model(&kara).Association("Artists").Replace(&kara.Artists)
+	if err != nil {
+		return err
+	}
 	err = tx.Model(&kara).Association("ExtraTitles").Replace(&kara.ExtraTitles)
 	if err != nil {
 		return err
@@ -240,26 +330,48 @@ func updateKara(tx *gorm.DB, kara *KaraInfoDB) error {
 
 func UpdateKara(ctx context.Context, input *UpdateKaraInput) (*KaraOutput, error) {
 	db := GetDB(ctx)
-	kara := KaraInfoDB{}
-	err := db.Scopes(CurrentKaras).First(&kara, input.Id).Error
-	if err != nil {
-		return nil, err
-	}
-	err = input.Body.to_KaraInfoDB(ctx, db, &kara)
-	if err != nil {
-		return nil, err
-	}
+	out := &KaraOutput{}
+
+	err := transaction(db, func(tx *gorm.DB) error {
+		kara := &out.Body.Kara
+		err := tx.Scopes(KaraAssociations, CurrentKaras).First(kara, input.Id).Error
+		if err != nil {
+			return err
+		}
 
-	err = db.Transaction(func(tx *gorm.DB) error {
-		return updateKara(tx, &kara)
+		err = checkIfMatch(input.IfMatch, kara.Revision)
+		if err != nil {
+			return err
+		}
+
+		info, err := mergePatchInfo(karaInfoFromDB(*kara), input.RawBody)
+		if err != nil {
+			return err
+		}
+		err = info.to_KaraInfoDB(ctx, tx, kara)
+		if err != nil {
+			return err
+		}
+
+		err = updateKara(WithRevisionCheck(tx), kara)
+		if err != nil {
+			return err
+		}
+		out.ETag = karaETag(*kara)
+		return nil
 	})
+	if errors.Is(err, ErrStaleRevision) {
+		current := KaraInfoDB{}
+		err = db.Scopes(KaraAssociations, CurrentKaras).First(&current, input.Id).Error
+		if err != nil {
+			return nil, DBErrToHumaErr(err)
+		}
+		return nil, revisionConflict(current.Revision, current)
+	}
 	if err != nil {
-		return nil, err
+		return nil, DBErrToHumaErr(err)
 	}
 
-	out := &KaraOutput{}
-	out.Body.Kara = kara
-
 	return out, nil
 }
 
@@ -267,22 +379,189 @@ type GetKaraInput struct {
 	Id uint `path:"id"`
 }
 
-func GetKara(ctx context.Context, input *GetKaraInput) (*KaraOutput, error) {
+type GetKaraConditionalInput struct {
+	Id uint `path:"id"`
+	ConditionalGetInput
+}
+
+type GetKaraOutput struct {
+	CacheHeaders
+	Status int
+	Body   struct {
+		Kara KaraInfoDB `json:"kara"`
+	}
+}
+
+func GetKara(ctx context.Context, input *GetKaraConditionalInput) (*GetKaraOutput, error) {
 	db := GetDB(ctx)
 
-	kara_output := &KaraOutput{}
-	err := db.Scopes(KaraAssociations, CurrentKaras).First(&kara_output.Body.Kara, input.Id).Error
-	return kara_output, DBErrToHumaErr(err)
+	out := &GetKaraOutput{}
+	kara := &out.Body.Kara
+	err := db.Scopes(KaraAssociations, CurrentKaras).First(kara, input.Id).Error
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	out.setValidators(karaETag(*kara), karaModified(*kara))
+	if input.notModified(out.CacheHeaders) {
+		out.Status = 304
+	} else {
+		out.Status = 200
+	}
+	return out, nil
+}
+
+type DeleteKaraInput struct {
+	Id     uint   `path:"id"`
+	Reason string `query:"reason" required:"true" minLength:"1" doc:"why the karaoke is deleted"`
 }
 
 type DeleteKaraResponse struct {
 	Status int
 }
 
-func DeleteKara(ctx context.Context, input *GetKaraInput) (*DeleteKaraResponse, error) {
+func DeleteKara(ctx context.Context, input *DeleteKaraInput) (*DeleteKaraResponse, error) {
+	db := GetDB(ctx)
+
+	reason := trimWhitespace(input.Reason)
+	if reason == "" {
+		return nil, huma.Error422UnprocessableEntity("a reason is required to delete a karaoke")
+	}
+
+	err := transaction(db, func(tx *gorm.DB) error {
+		kara := KaraInfoDB{}
+		err := tx.Scopes(CurrentKaras).First(&kara, input.Id).Error
+		if err != nil {
+			return err
+		}
+
+		deletion := KaraDeletion{
+			KaraID: kara.ID,
+			Reason: reason,
+			User:   getCurrentUserNilable(tx),
+			Date:   time.Now().UTC(),
+		}
+		err = tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&deletion).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Delete(&kara).Error
+		if err != nil {
+			return err
+		}
+
+		return SyncDakaraNotify(tx)
+	})
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	return &DeleteKaraResponse{204}, nil
+}
+
+type TrashedKara struct {
+	Kara KaraInfoDB `json:"kara"`
+	// nil for karas deleted before deletion reasons were recorded
+	Deletion *KaraDeletion `json:"deletion"`
+}
+
+type GetTrashOutput struct {
+	Body struct {
+		Karas []TrashedKara `json:"karas"`
+	}
+}
+
+func DeletedKaras(tx *gorm.DB) *gorm.DB {
+	return tx.Unscoped().Where("deleted_at IS NOT NULL")
+}
+
+func GetTrash(ctx context.Context, input *struct{}) (*GetTrashOutput, error) {
+	db := GetDB(ctx)
+	out := &GetTrashOutput{}
+	out.Body.Karas = []TrashedKara{}
+
+	karas := []KaraInfoDB{}
+	err := db.Scopes(KaraAssociations, DeletedKaras, CurrentKaras).
+		Order("deleted_at DESC").
+		Find(&karas).Error
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, len(karas))
+	for i, kara := range karas {
+		ids[i] = kara.ID
+	}
+	deletions := []KaraDeletion{}
+	err = db.Preload("User").Where("kara_id IN ?", ids).Find(&deletions).Error
+	if err != nil {
+		return nil, err
+	}
+	deletions_by_kara := make(map[uint]*KaraDeletion, len(deletions))
+	for i, deletion := range deletions {
+		deletions_by_kara[deletion.KaraID] = &deletions[i]
+	}
+
+	for _, kara := range karas {
+		out.Body.Karas = append(out.Body.Karas, TrashedKara{kara, deletions_by_kara[kara.ID]})
+	}
+
+	return out, nil
+}
+
+func RestoreKara(ctx context.Context, input *GetKaraInput) (*KaraOutput, error) {
 	db := GetDB(ctx)
-	err := db.Scopes(CurrentKaras).Delete(&KaraInfoDB{}, input.Id).Error
-	return &DeleteKaraResponse{204}, DBErrToHumaErr(err)
+	out := &KaraOutput{}
+
+	err := transaction(db, func(tx *gorm.DB) error {
+		kara := &out.Body.Kara
+		err := tx.Scopes(DeletedKaras, CurrentKaras).First(kara, input.Id).Error
+		if err != nil {
+			return err
+		}
+
+		// skip hooks, restoring shouldn't create a history entry
+		err = tx.Unscoped().Model(kara).UpdateColumn("deleted_at", nil).Error
+		if err != nil {
+			return err
+		}
+		// keep who deleted the kara and why
+		restored_at := time.Now().UTC()
+		restoration := KaraDeletion{RestoredAt: &restored_at}
+		user := getCurrentUserNilable(tx)
+		if user != nil {
+			restoration.RestoredByID = &user.ID
+		}
+		err = tx.Model(&KaraDeletion{KaraID: kara.ID}).
+			Select("RestoredAt", "RestoredByID").
+			Updates(&restoration).Error
+		if err != nil {
+			return err
+		}
+
+		err = logChange(tx, "kara", kara.ID, ChangeRestored, kara.Revision)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Scopes(KaraAssociations).First(kara, kara.ID).Error
+		if err != nil {
+			return err
+		}
+		if kara.VideoUploaded && kara.SubtitlesUploaded {
+			err = SyncDakaraNotify(tx)
+			if err != nil {
+				return err
+			}
+		}
+		return UploadHookGitlab(tx, kara)
+	})
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	return out, nil
 }
 
 func GetKaraByID(db *gorm.DB, kara_id uint) (KaraInfoDB, error) {
@@ -291,90 +570,308 @@ func GetKaraByID(db *gorm.DB, kara_id uint) (KaraInfoDB, error) {
 	return *kara, err
 }
 
+type KaraFilters struct {
+	Query     string `query:"q" doc:"search in titles and extra titles"`
+	Artist    uint   `query:"artist" doc:"artist ID"`
+	Media     uint   `query:"media" doc:"source media or related media ID"`
+	Author    uint   `query:"author" doc:"timing author ID"`
+	AudioTag  string `query:"audio_tag" example:"OP"`
+	VideoTag  string `query:"video_tag" example:"NSFW"`
+	Language  string `query:"language" example:"FR"`
+	Uploaded  string `query:"uploaded" enum:"true,false" doc:"filter by upload state"`
+	IsPrivate string `query:"private" enum:"true,false" doc:"filter by private flag"`
+	Status    string `query:"status" enum:"planned,in_progress,uploaded,needs_fix,retired"`
+	ClaimedBy uint   `query:"claimed_by" doc:"timing author ID of the user working on the kara"`
+}
+
+func (f KaraFilters) Scopes() []func(*gorm.DB) *gorm.DB {
+	scopes := []func(*gorm.DB) *gorm.DB{CurrentKaras}
+
+	if f.Query != "" {
+		scopes = append(scopes, KarasMatchingTitle(f.Query))
+	}
+	if f.Artist > 0 {
+		scopes = append(scopes, KarasWithArtist(f.Artist))
+	}
+	if f.Media > 0 {
+		scopes = append(scopes, KarasWithMedia(f.Media))
+	}
+	if f.Author > 0 {
+		scopes = append(scopes, KarasWithAuthor(f.Author))
+	}
+	if f.AudioTag != "" {
+		scopes = append(scopes, KarasWithAudioTag(f.AudioTag))
+	}
+	if f.VideoTag != "" {
+		scopes = append(scopes, KarasWithVideoTag(f.VideoTag))
+	}
+	if f.Language != "" {
+		scopes = append(scopes, KarasWithLanguage(f.Language))
+	}
+	switch f.Uploaded {
+	case "true":
+		scopes = append(scopes, UploadedKaras)
+	case "false":
+		scopes = append(scopes, NotUploadedKaras)
+	}
+	if f.IsPrivate != "" {
+		scopes = append(scopes, KarasWithPrivate(f.IsPrivate == "true"))
+	}
+	if f.Status != "" {
+		scopes = append(scopes, KarasWithStatus(f.Status))
+	}
+	if f.ClaimedBy > 0 {
+		scopes = append(scopes, KarasClaimedBy(f.ClaimedBy))
+	}
+
+	return scopes
+}
+
+type KaraPagination struct {
+	Sort   string `query:"sort" default:"id" enum:"id,-id,title,-title,created_at,-created_at,updated_at,-updated_at,karaoke_creation_time,-karaoke_creation_time" doc:"sort field, prefix with - for descending order"`
+	Limit  int    `query:"limit" default:"100" minimum:"0" maximum:"1000" doc:"maximum number of karas returned, 0 returns everything"`
+	Cursor string `query:"cursor" doc:"next_cursor value of the previous page"`
+}
+
+// position of the last kara of a page
+type KaraCursor struct {
+	ID    uint      `json:"id"`
+	Title string    `json:"title,omitempty"`
+	Time  time.Time `json:"time,omitzero"`
+}
+
+func (p KaraPagination) sortColumn() (string, bool) {
+	column, desc := strings.CutPrefix(p.Sort, "-")
+	if column == "" {
+		column = "id"
+	}
+	return column, desc
+}
+
+func (p KaraPagination) makeCursor(kara KaraInfoDB) string {
+	cursor := KaraCursor{ID: kara.ID}
+	column, _ := p.sortColumn()
+	switch column {
+	case "title":
+		cursor.Title = kara.Title
+	case "created_at":
+		cursor.Time = kara.CreatedAt
+	case "updated_at":
+		cursor.Time = kara.UpdatedAt
+	case "karaoke_creation_time":
+		cursor.Time = kara.KaraokeCreationTime
+	}
+
+	b, err := json.Marshal(cursor)
+	if err != nil {
+		// only contains marshallable fields
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (p KaraPagination) parseCursor() (*KaraCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(p.Cursor)
+	if err != nil {
+		return nil, huma.Error422UnprocessableEntity("invalid cursor")
+	}
+	cursor := &KaraCursor{}
+	err = json.Unmarshal(b, cursor)
+	if err != nil {
+		return nil, huma.Error422UnprocessableEntity("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// Sort and paginate karas, the id is used as a tie-breaker so the order is stable
+func (p KaraPagination) Scope() (func(*gorm.DB) *gorm.DB, error) {
+	column, desc := p.sortColumn()
+	cmp := ">"
+	order := "ASC"
+	if desc {
+		cmp = "<"
+		order = "DESC"
+	}
+
+	var cursor *KaraCursor
+	if p.Cursor != "" {
+		var err error
+		cursor, err = p.parseCursor()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(tx *gorm.DB) *gorm.DB {
+		if column != "id" {
+			tx = tx.Order(fmt.Sprintf("%s %s", column, order))
+		}
+		tx = tx.Order("id " + order)
+
+		if cursor != nil {
+			switch column {
+			case "id":
+				tx = tx.Where("id "+cmp+" ?", cursor.ID)
+			case "title":
+				tx = tx.Where(
+					fmt.Sprintf("title %s ? OR (title = ? AND id %s ?)", cmp, cmp),
+					cursor.Title, cursor.Title, cursor.ID,
+				)
+			default:
+				tx = tx.Where(
+					fmt.Sprintf("%s %s ? OR (%s = ? AND id %s ?)", column, cmp, column, cmp),
+					cursor.Time, cursor.Time, cursor.ID,
+				)
+			}
+		}
+
+		// one more kara tells if there is a next page
+		if p.Limit > 0 {
+			tx = tx.Limit(p.Limit + 1)
+		}
+		return tx
+	}, nil
+}
+
 type GetAllKarasInput struct {
-	IfNoneMatch string `header:"If-None-Match"`
+	ConditionalGetInput
+	KaraFilters
+	KaraPagination
 }
 
 type GetAllKarasBody struct {
 }
 
 type GetAllKarasOutput struct {
-	ETag   string `header:"ETag"`
+	CacheHeaders
 	Status int
 	Body   struct {
 		Karas []KaraInfoDB
+		// number of karas matching the filters
+		Total int64 `json:"total"`
+		// empty on the last page
+		NextCursor string `json:"next_cursor,omitempty"`
 	}
 }
 
-func getKaraETag(tx *gorm.DB, etag_header *string) error {
-	etag := uint(0)
+func GetAllKaras(ctx context.Context, input *GetAllKarasInput) (*GetAllKarasOutput, error) {
+	out := &GetAllKarasOutput{}
+	db := GetDB(ctx)
 
-	last_kara := KaraInfoDB{}
-	err := tx.Last(&last_kara).Error
-	err = extendETag(last_kara.ID, err, &etag)
+	// artists, medias, authors and users are included in the response
+	var err error
+	out.CacheHeaders, err = tablesValidators(db, &KaraInfoDB{}, &Artist{}, &MediaDB{}, &TimingAuthor{}, &User{})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// need to check artists since they are included in the response
-	last_artist := Artist{}
-	err = tx.Last(&last_artist).Error
-	err = extendETag(last_artist.ID, err, &etag)
+	if input.notModified(out.CacheHeaders) {
+		out.Status = 304
+		return out, nil
+	}
+
+	filters := input.KaraFilters.Scopes()
+	page, err := input.KaraPagination.Scope()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// need to check medias since they are included in the response
-	last_media := Artist{}
-	err = tx.Last(&last_media).Error
-	err = extendETag(last_media.ID, err, &etag)
+	err = db.Model(&KaraInfoDB{}).Scopes(filters...).Count(&out.Body.Total).Error
 	if err != nil {
-		return err
+		return nil, DBErrToHumaErr(err)
 	}
 
-	// need to check authors since they are included in the response
-	// they are not versioned so it uses the last update time
-	last_author := TimingAuthor{}
-	err = tx.Order("updated_at DESC").Take(&last_author).Error
-	err = extendETag(uint(last_author.UpdatedAt.Unix()), err, &etag)
+	out.Status = 200
+	err = db.Scopes(KaraAssociations).Scopes(filters...).Scopes(page).Find(&out.Body.Karas).Error
 	if err != nil {
-		return err
+		return nil, DBErrToHumaErr(err)
 	}
 
-	*etag_header = fmt.Sprint(etag)
-	return nil
+	if input.Limit > 0 && len(out.Body.Karas) > input.Limit {
+		out.Body.Karas = out.Body.Karas[:input.Limit]
+		out.Body.NextCursor = input.KaraPagination.makeCursor(out.Body.Karas[input.Limit-1])
+	}
+
+	return out, nil
 }
 
-func GetAllKaras(ctx context.Context, input *GetAllKarasInput) (*GetAllKarasOutput, error) {
-	out := &GetAllKarasOutput{}
+type RevertKaraInput struct {
+	Id        uint `path:"id"`
+	HistoryId uint `path:"history_id"`
+}
+
+func getKaraHistoryEntry(tx *gorm.DB, kara_id uint, history_id uint) (KaraInfoDB, error) {
+	historic := KaraInfoDB{}
+	err := tx.Scopes(KaraRevisionAssociations).
+		Where(&KaraInfoDB{CurrentKaraInfoID: &kara_id}).
+		First(&historic, history_id).Error
+	return historic, DBErrToHumaErr(err)
+}
+
+// Restore the metadata of a historic entry, files are left untouched
+func revertKara(tx *gorm.DB, kara *KaraInfoDB, historic KaraInfoDB) error {
+	kara.Title = historic.Title
+	kara.ExtraTitles = historic.ExtraTitles
+	kara.Authors = historic.Authors
+	kara.Artists = historic.Artists
+	kara.VideoTags = historic.VideoTags
+	kara.AudioTags = historic.AudioTags
+	kara.Medias = historic.Medias
+	kara.SourceMediaID = historic.SourceMediaID
+	kara.SourceMedia = historic.SourceMedia
+	kara.SongOrder = historic.SongOrder
+	kara.Private = historic.Private
+	kara.Version = historic.Version
+	kara.Comment = historic.Comment
+	kara.Language = historic.Language
+
+	return updateKara(tx, kara)
+}
+
+func RevertKara(ctx context.Context, input *RevertKaraInput) (*KaraOutput, error) {
 	db := GetDB(ctx)
+	out := &KaraOutput{}
 
-	err := getKaraETag(db, &out.ETag)
+	err := transaction(db, func(tx *gorm.DB) error {
+		err := tx.Scopes(CurrentKaras).First(&out.Body.Kara, input.Id).Error
+		if err != nil {
+			return DBErrToHumaErr(err)
+		}
+		historic, err := getKaraHistoryEntry(tx, input.Id, input.HistoryId)
+		if err != nil {
+			return err
+		}
+		return revertKara(tx, &out.Body.Kara, historic)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	if out.ETag == input.IfNoneMatch {
-		out.Status = 304
-	} else {
-		out.Status = 200
-		err = db.Scopes(KaraAssociations, CurrentKaras).Find(&out.Body.Karas).Error
-	}
-	return out, DBErrToHumaErr(err)
+	return out, nil
 }
 
 type GetKaraHistoryOutput struct {
-	Body struct {
+	CacheHeaders
+	Status int
+	Body   struct {
 		History []KaraInfoDB `json:"history"`
 	}
 }
 
-func GetKaraHistory(ctx context.Context, input *GetKaraInput) (*GetKaraHistoryOutput, error) {
+func GetKaraHistory(ctx context.Context, input *GetKaraConditionalInput) (*GetKaraHistoryOutput, error) {
 	out := &GetKaraHistoryOutput{}
 	db := GetDB(ctx)
 	err := db.Scopes(KaraAssociations).Where(&KaraInfoDB{CurrentKaraInfoID: &input.Id}).Find(&out.Body.History).Error
 	if err != nil {
 		return nil, err
 	}
+
+	// the tags of historic entries can still be edited
+	out.CacheHeaders = karasValidators(out.Body.History)
+	if input.notModified(out.CacheHeaders) {
+		out.Status = 304
+	} else {
+		out.Status = 200
+	}
 	return out, nil
 }
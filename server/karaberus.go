@@ -42,9 +42,22 @@ func addRoutes(api huma.API) {
 	user_admin := RouteSecurity{OIDC: true, Admin: true, Scopes: Scopes{User: true}}.toSecurity()
 
 	huma.Get(api, "/api/kara", GetAllKaras, setSecurity(kara_ro))
+	huma.Patch(api, "/api/kara", BulkUpdateKaras, setSecurity(kara))
+	huma.Get(api, "/api/kara/search/lyrics", SearchLyrics, setSecurity(kara_ro))
+	huma.Get(api, "/api/kara/trash", GetTrash, setSecurity(kara_admin))
+	huma.Get(api, "/api/kara/wip", GetMyWIPKaras, setSecurity(kara_ro))
+	huma.Get(api, "/api/kara/duplicates", GetDuplicateKaras, setSecurity(kara_ro))
+	huma.Post(api, "/api/kara/duplicates/detect", StartDuplicateKarasDetection, setSecurity(kara_admin), setAccepted)
 	huma.Get(api, "/api/kara/{id}", GetKara, setSecurity(kara_ro))
 	huma.Get(api, "/api/kara/{id}/history", GetKaraHistory, setSecurity(kara_ro))
+	huma.Get(api, "/api/kara/{id}/history/changes", GetKaraChanges, setSecurity(kara_ro))
+	huma.Get(api, "/api/kara/{id}/history/{history_id}/diff", GetKaraDiff, setSecurity(kara_ro))
+	huma.Post(api, "/api/kara/{id}/history/{history_id}/revert", RevertKara, setSecurity(kara))
 	huma.Delete(api, "/api/kara/{id}", DeleteKara, setSecurity(kara))
+	huma.Post(api, "/api/kara/{id}/restore", RestoreKara, setSecurity(kara_admin))
+	huma.Put(api, "/api/kara/{id}/status", UpdateKaraStatus, setSecurity(kara))
+	huma.Post(api, "/api/kara/{id}/claim", ClaimKara, setSecurity(kara))
+	huma.Delete(api, "/api/kara/{id}/claim", UnclaimKara, setSecurity(kara))
 	huma.Patch(api, "/api/kara/{id}", UpdateKara, setSecurity(kara))
 	huma.Post(api, "/api/kara", CreateKara, setSecurity(kara))
 	huma.Put(api, "/api/kara/{id}/upload/{filetype}", UploadKaraFile, setSecurity(kara))
@@ -56,8 +69,19 @@ func addRoutes(api huma.API) {
 		Security:    kara_ro,
 	}, DownloadHead)
 	huma.Get(api, "/api/kara/{id}/download/{filetype}", DownloadFile, setSecurity(kara_ro_basic))
+	huma.Get(api, "/api/kara/{id}/versions/{filetype}", GetKaraFileVersions, setSecurity(kara_ro))
+	huma.Get(api, "/api/kara/{id}/versions/{filetype}/{version_id}/download", DownloadKaraFileVersion, setSecurity(kara_ro_basic))
+	huma.Post(api, "/api/kara/{id}/versions/{filetype}/{version_id}/promote", PromoteKaraFileVersion, setSecurity(kara))
+	huma.Get(api, "/api/kara/{id}/issues", GetKaraIssues, setSecurity(kara_ro))
+	huma.Post(api, "/api/kara/{id}/issues", CreateKaraIssue, setSecurity(kara))
+	huma.Get(api, "/api/kara/{id}/issues/{issue_id}", GetKaraIssue, setSecurity(kara_ro))
+	huma.Patch(api, "/api/kara/{id}/issues/{issue_id}", UpdateKaraIssue, setSecurity(kara))
+	huma.Delete(api, "/api/kara/{id}/issues/{issue_id}", DeleteKaraIssue, setSecurity(kara_admin))
 	huma.Get(api, "/api/kara/{id}/mugen/export", MugenExportKara, setSecurity(kara_admin))
 
+	huma.Get(api, "/api/changes", GetChanges, setSecurity(kara_ro))
+	huma.Get(api, "/api/events", GetEvents, setSecurity(kara_ro))
+
 	huma.Get(api, "/api/font", GetAllFonts, setSecurity(kara_ro))
 	huma.Post(api, "/api/font", UploadFont, setSecurity(kara))
 	huma.Get(api, "/api/font/{id}/download", DownloadFont, setSecurity(kara_ro))
@@ -75,6 +99,9 @@ func addRoutes(api huma.API) {
 	huma.Get(api, "/api/tags/artist", GetAllArtists, setSecurity(kara_ro))
 	huma.Get(api, "/api/tags/artist/search", FindArtist, setSecurity(kara_ro))
 	huma.Get(api, "/api/tags/artist/{id}", GetArtist, setSecurity(kara_ro))
+	huma.Get(api, "/api/tags/artist/{id}/history", GetArtistHistory, setSecurity(kara_ro))
+	huma.Post(api, "/api/tags/artist/{id}/history/{history_id}/revert", RevertArtist, setSecurity(kara))
+	huma.Post(api, "/api/tags/artist/{id}/merge", MergeArtist, setSecurity(kara_admin))
 	huma.Delete(api, "/api/tags/artist/{id}", DeleteArtist, setSecurity(kara))
 	huma.Patch(api, "/api/tags/artist/{id}", UpdateArtist, setSecurity(kara))
 	huma.Post(api, "/api/tags/artist", CreateArtist, setSecurity(kara))
@@ -83,6 +110,9 @@ func addRoutes(api huma.API) {
 	huma.Get(api, "/api/tags/media/types", GetAllMediaTypes, setSecurity(kara_ro))
 	huma.Get(api, "/api/tags/media/search", FindMedia, setSecurity(kara_ro))
 	huma.Get(api, "/api/tags/media/{id}", GetMedia, setSecurity(kara_ro))
+	huma.Get(api, "/api/tags/media/{id}/history", GetMediaHistory, setSecurity(kara_ro))
+	huma.Post(api, "/api/tags/media/{id}/history/{history_id}/revert", RevertMedia, setSecurity(kara))
+	huma.Post(api, "/api/tags/media/{id}/merge", MergeMedia, setSecurity(kara_admin))
 	huma.Delete(api, "/api/tags/media/{id}", DeleteMedia, setSecurity(kara))
 	huma.Patch(api, "/api/tags/media/{id}", UpdateMedia, setSecurity(kara))
 	huma.Post(api, "/api/tags/media", CreateMedia, setSecurity(kara))
@@ -94,10 +124,31 @@ func addRoutes(api huma.API) {
 
 	huma.Post(api, "/api/dakara/sync", StartDakaraSync, setSecurity(kara))
 
+	huma.Get(api, "/api/jobs", GetJobs, setSecurity(oidc_admin))
+	huma.Get(api, "/api/jobs/{id}", GetJob, setSecurity(oidc_admin))
+	huma.Post(api, "/api/jobs/{id}/retry", RetryJob, setSecurity(oidc_admin), setAccepted)
+	huma.Post(api, "/api/jobs/{id}/cancel", CancelJob, setSecurity(oidc_admin))
+
+	huma.Get(api, "/api/storage/s3", GetS3Endpoints, setSecurity(oidc_admin))
+	huma.Get(api, "/api/storage/audit", GetStorageAudit, setSecurity(oidc_admin))
+	huma.Post(api, "/api/storage/audit/fix", FixStorageAudit, setSecurity(oidc_admin))
+	huma.Get(api, "/api/storage/scrub", GetScrubStatus, setSecurity(oidc_admin))
+	huma.Post(api, "/api/storage/scrub", StartStorageScrub, setSecurity(oidc_admin), setAccepted)
+
 	huma.Get(api, "/api/token", GetAllUserTokens, setSecurity(oidc))
 	huma.Post(api, "/api/token", CreateToken, setSecurity(oidc))
 	huma.Delete(api, "/api/token/{token}", DeleteToken, setSecurity(oidc))
 
+	huma.Get(api, "/api/webhooks/deliveries", GetWebhookDeliveries, setSecurity(oidc_admin))
+	huma.Post(api, "/api/webhooks/deliveries/{id}/redeliver", RedeliverWebhook, setSecurity(oidc_admin))
+	huma.Get(api, "/api/webhooks", GetAllWebhooks, setSecurity(oidc_admin))
+	huma.Post(api, "/api/webhooks", CreateWebhook, setSecurity(oidc_admin))
+	huma.Post(api, "/api/webhooks/preview", PreviewWebhook, setSecurity(oidc_admin))
+	huma.Get(api, "/api/webhooks/{id}", GetWebhook, setSecurity(oidc_admin))
+	huma.Patch(api, "/api/webhooks/{id}", UpdateWebhook, setSecurity(oidc_admin))
+	huma.Delete(api, "/api/webhooks/{id}", DeleteWebhook, setSecurity(oidc_admin))
+	huma.Post(api, "/api/webhooks/{id}/test", TestWebhook, setSecurity(oidc_admin))
+
 	huma.Get(api, "/api/gitlab/authorize", GitlabAuth, setSecurity(oidc_admin))
 	huma.Get(api, "/api/gitlab/callback", GitlabCallback, setSecurity(oidc_admin))
 
@@ -162,6 +213,11 @@ func setSecurity(security []map[string][]string) func(o *huma.Operation) {
 	}
 }
 
+// Operations starting work in the background
+func setAccepted(o *huma.Operation) {
+	o.DefaultStatus = http.StatusAccepted
+}
+
 func setupKaraberus() (*fiber.App, huma.API) {
 	// Create a new router & API
 	app := fiber.New(fiber.Config{
@@ -172,7 +228,10 @@ func setupKaraberus() (*fiber.App, huma.API) {
 
 	app.Use(logger.New())
 	app.Use(healthcheck.New())
-	app.Use(compress.New())
+	app.Use(compress.New(compress.Config{
+		// compressed event streams are not flushed
+		Next: func(c *fiber.Ctx) bool { return c.Path() == "/api/events" },
+	}))
 	if CONFIG.Listen.Profiling {
 		app.Use(pprof.New())
 	}
@@ -216,14 +275,21 @@ func RunKaraberus(app *fiber.App, api huma.API) {
 
 	ctx := context.WithValue(context.Background(), KaraberusInit{}, true)
 	addOidcRoutes(ctx, app)
-	initS3Clients(ctx)
+	initStorage(ctx)
 	init_db(ctx)
 
-	if CONFIG.Dakara.BaseURL != "" {
-		go SyncDakaraLoop(context.Background())
+	db := GetDB(context.Background())
+	err = enqueueJob(db, JobMugenSync, struct{}{})
+	if err != nil {
+		panic(err)
+	}
+	err = SyncDakaraNotify(db)
+	if err != nil {
+		panic(err)
 	}
 
-	go SyncMugen(context.Background())
+	go RunJobsLoop(context.Background())
+	go DeliverWebhooksLoop(context.Background())
 
 	listen_addr := CONFIG.Listen.Addr()
 	getLogger().Printf("Starting server on %s...\n", listen_addr)
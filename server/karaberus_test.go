@@ -6,13 +6,27 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/danielgtaylor/huma/v2"
 	"github.com/danielgtaylor/huma/v2/humatest"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"gorm.io/gorm"
 )
 
 type KaraberusTestConfig struct {
@@ -266,7 +280,7 @@ func TestCreateKara(t *testing.T) {
 	}
 
 	path := fmt.Sprintf("/api/kara/%d", data.Body.Kara.ID)
-	assertRespCode(t, api.Delete(path), 204)
+	assertRespCode(t, api.Delete(path+"?reason=test"), 204)
 }
 
 func TestUpdateKara(t *testing.T) {
@@ -301,7 +315,7 @@ func TestUpdateKara(t *testing.T) {
 	path := fmt.Sprintf("/api/kara/%d", data.Body.Kara.ID)
 
 	resp = assertRespCode(t,
-		api.Patch(path,
+		api.Patch(path, "If-Match: 1",
 			map[string]any{
 				"title":                 "kara_title_post_update",
 				"title_aliases":         []string{"kara_update_title_alias"},
@@ -352,7 +366,7 @@ func TestUpdateKara(t *testing.T) {
 		t.Fatalf("wrong number of history entries: %d", len(history_data.Body.History))
 	}
 
-	assertRespCode(t, api.Delete(path), 204)
+	assertRespCode(t, api.Delete(path+"?reason=test"), 204)
 }
 
 func TestUpdateAuthor(t *testing.T) {
@@ -437,7 +451,7 @@ func TestUpdateMedia(t *testing.T) {
 	media_path := fmt.Sprintf("/api/tags/media/%d", data.Body.Media.ID)
 
 	resp = assertRespCode(t,
-		api.Patch(media_path,
+		api.Patch(media_path, "If-Match: 1",
 			map[string]any{
 				"name":             "media_name_update_test2",
 				"media_type":       "LIVE",
@@ -460,7 +474,7 @@ func TestUpdateMedia(t *testing.T) {
 	}
 
 	resp = assertRespCode(t,
-		api.Patch(media_path,
+		api.Patch(media_path, "If-Match: 2",
 			map[string]any{
 				"name":             "media_name_update_test3",
 				"media_type":       "ANIME",
@@ -506,7 +520,7 @@ func TestUpdateArtist(t *testing.T) {
 	artist_path := fmt.Sprintf("/api/tags/artist/%d", data.Body.Artist.ID)
 
 	resp = assertRespCode(t,
-		api.Patch(artist_path,
+		api.Patch(artist_path, "If-Match: 1",
 			map[string]any{
 				"name":             "artist_name_update_test2",
 				"additional_names": []string{},
@@ -525,7 +539,7 @@ func TestUpdateArtist(t *testing.T) {
 	}
 
 	resp = assertRespCode(t,
-		api.Patch(artist_path,
+		api.Patch(artist_path, "If-Match: 2",
 			map[string]any{
 				"name":             "artist_name_update_test3",
 				"additional_names": []string{},
@@ -543,3 +557,2376 @@ func TestUpdateArtist(t *testing.T) {
 		t.Fatal("failed to update artist name a second time")
 	}
 }
+
+func createTestKara(t *testing.T, api humatest.TestAPI, body map[string]any) KaraInfoDB {
+	kara := map[string]any{
+		"title":         "",
+		"title_aliases": []string{},
+		"authors":       []uint{},
+		"artists":       []uint{},
+		"source_media":  0,
+		"song_order":    0,
+		"medias":        []uint{},
+		"audio_tags":    []string{},
+		"video_tags":    []string{},
+		"comment":       "",
+		"version":       "",
+		"language":      "",
+	}
+	for k, v := range body {
+		kara[k] = v
+	}
+
+	resp := assertRespCode(t, api.Post("/api/kara", kara), 200)
+
+	data := KaraOutput{}
+	dec := json.NewDecoder(resp.Body)
+	err := dec.Decode(&data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data.Body.Kara
+}
+
+func getAllKaras(t *testing.T, api humatest.TestAPI, query string) GetAllKarasOutput {
+	resp := assertRespCode(t, api.Get("/api/kara?"+query), 200)
+
+	data := GetAllKarasOutput{}
+	dec := json.NewDecoder(resp.Body)
+	err := dec.Decode(&data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSearchKaras(t *testing.T) {
+	api := getTestAPI(t)
+
+	artist_resp := assertRespCode(t,
+		api.Post("/api/tags/artist",
+			map[string]any{
+				"name":             "artist_name_search_test",
+				"additional_names": []string{},
+			},
+		),
+		200,
+	)
+	artist := ArtistOutput{}
+	err := json.NewDecoder(artist_resp.Body).Decode(&artist.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	karas := []KaraInfoDB{
+		createTestKara(t, api, map[string]any{
+			"title":      "search_test Zankoku",
+			"artists":    []uint{artist.Body.Artist.ID},
+			"audio_tags": []string{"OP"},
+			"language":   "JP",
+		}),
+		createTestKara(t, api, map[string]any{
+			"title":         "search_test other",
+			"title_aliases": []string{"search_test 100%_alias"},
+			"language":      "FR",
+		}),
+		createTestKara(t, api, map[string]any{
+			"title":   "search_test private",
+			"private": true,
+		}),
+	}
+
+	data := getAllKaras(t, api, "q=SEARCH_TEST")
+	if data.Body.Total != 3 || len(data.Body.Karas) != 3 {
+		t.Fatalf("expected 3 karas, got %d", data.Body.Total)
+	}
+
+	data = getAllKaras(t, api, "q=100%25_alias")
+	if data.Body.Total != 1 || data.Body.Karas[0].ID != karas[1].ID {
+		t.Fatal("failed to find kara by extra title")
+	}
+
+	data = getAllKaras(t, api, "q=search_test&artist="+fmt.Sprint(artist.Body.Artist.ID)+"&audio_tag=OP&language=jp")
+	if data.Body.Total != 1 || data.Body.Karas[0].ID != karas[0].ID {
+		t.Fatal("failed to filter karas by artist, audio tag and language")
+	}
+
+	data = getAllKaras(t, api, "q=search_test&private=true&uploaded=false")
+	if data.Body.Total != 1 || data.Body.Karas[0].ID != karas[2].ID {
+		t.Fatal("failed to filter private karas")
+	}
+
+	// paginate through results
+	for _, sort := range []string{"id", "-title", "created_at"} {
+		seen := map[uint]bool{}
+		cursor := ""
+		for range 4 {
+			data = getAllKaras(t, api, "q=search_test&limit=2&sort="+sort+"&cursor="+cursor)
+			if data.Body.Total != 3 {
+				t.Fatalf("wrong total: %d", data.Body.Total)
+			}
+			for _, kara := range data.Body.Karas {
+				if seen[kara.ID] {
+					t.Fatalf("kara %d returned twice when sorting by %s", kara.ID, sort)
+				}
+				seen[kara.ID] = true
+			}
+			cursor = data.Body.NextCursor
+			if cursor == "" {
+				break
+			}
+		}
+		if len(seen) != 3 {
+			t.Fatalf("pagination sorted by %s returned %d karas", sort, len(seen))
+		}
+	}
+
+	// a full page is the last one when there are no more karas
+	data = getAllKaras(t, api, "q=search_test&limit=3")
+	if len(data.Body.Karas) != 3 || data.Body.NextCursor != "" {
+		t.Fatalf("unexpected last page: %d karas, cursor %q", len(data.Body.Karas), data.Body.NextCursor)
+	}
+
+	assertRespCode(t, api.Get("/api/kara?cursor=invalid"), 422)
+
+	for _, kara := range karas {
+		assertRespCode(t, api.Delete(fmt.Sprintf("/api/kara/%d?reason=test", kara.ID)), 204)
+	}
+}
+
+func TestSearchLyrics(t *testing.T) {
+	api := getTestAPI(t)
+
+	kara := createTestKara(t, api, map[string]any{"title": "lyrics_search_test"})
+	err := setKaraLyrics(GetDB(context.Background()), kara.ID, "zankoku na tenshi no you ni\nshounen <i>yo</i> shinwa ni nare")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := assertRespCode(t, api.Get("/api/kara/search/lyrics?q=Shounen%20shinwa"), 200)
+	data := SearchLyricsOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data.Body.Results) != 1 || data.Body.Results[0].Kara.ID != kara.ID {
+		t.Fatalf("expected kara %d in results: %+v", kara.ID, data.Body.Results)
+	}
+	if !strings.Contains(data.Body.Results[0].Snippet, "<mark>shounen</mark>") {
+		t.Fatalf("match is not highlighted: %s", data.Body.Results[0].Snippet)
+	}
+	if !strings.Contains(data.Body.Results[0].Snippet, "&lt;i&gt;yo&lt;/i&gt;") {
+		t.Fatalf("lyrics are not escaped: %s", data.Body.Results[0].Snippet)
+	}
+
+	// invalid fts5 syntax should be escaped
+	assertRespCode(t, api.Get("/api/kara/search/lyrics?q=%22tenshi%20OR%20(%20NEAR"), 200)
+
+	assertRespCode(t, api.Delete(fmt.Sprintf("/api/kara/%d?reason=test", kara.ID)), 204)
+
+	resp = assertRespCode(t, api.Get("/api/kara/search/lyrics?q=shinwa"), 200)
+	data = SearchLyricsOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Body.Results) != 0 {
+		t.Fatal("deleted kara returned in lyrics search")
+	}
+}
+
+func TestRevertKara(t *testing.T) {
+	api := getTestAPI(t)
+
+	kara := createTestKara(t, api, map[string]any{
+		"title":         "kara_title_pre_revert",
+		"title_aliases": []string{"kara_revert_title_alias"},
+		"audio_tags":    []string{"OP"},
+		"song_order":    1,
+	})
+
+	path := fmt.Sprintf("/api/kara/%d", kara.ID)
+	assertRespCode(t,
+		api.Patch(path, "If-Match: 1",
+			map[string]any{
+				"title":         "kara_title_post_revert",
+				"title_aliases": []string{},
+				"authors":       []uint{},
+				"artists":       []uint{},
+				"source_media":  0,
+				"song_order":    0,
+				"medias":        []uint{},
+				"audio_tags":    []string{"ED"},
+				"video_tags":    []string{},
+				"comment":       "",
+				"version":       "",
+				"language":      "",
+			}),
+		200,
+	)
+
+	resp := assertRespCode(t, api.Get(path+"/history"), 200)
+	history_data := GetKaraHistoryOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&history_data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history_data.Body.History) != 1 {
+		t.Fatalf("wrong number of history entries: %d", len(history_data.Body.History))
+	}
+	historic := history_data.Body.History[0]
+	if len(historic.ExtraTitles) != 1 || len(historic.AudioTags) != 1 {
+		t.Fatal("associations were not copied to the historic entry")
+	}
+
+	assertRespCode(t, api.Post(fmt.Sprintf("%s/history/%d/revert", path, historic.ID+1000), map[string]any{}), 404)
+	assertRespCode(t, api.Post(fmt.Sprintf("%s/history/%d/revert", path, historic.ID), map[string]any{}), 200)
+
+	resp = assertRespCode(t, api.Get(path), 200)
+	data := KaraOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reverted := data.Body.Kara
+	if reverted.Title != "kara_title_pre_revert" || reverted.SongOrder != 1 {
+		t.Fatalf("failed to revert kara: %+v", reverted)
+	}
+	if len(reverted.ExtraTitles) != 1 || reverted.ExtraTitles[0].Name != "kara_revert_title_alias" {
+		t.Fatalf("failed to revert extra titles: %+v", reverted.ExtraTitles)
+	}
+	if len(reverted.AudioTags) != 1 || reverted.AudioTags[0].ID != "OP" {
+		t.Fatalf("failed to revert audio tags: %+v", reverted.AudioTags)
+	}
+
+	resp = assertRespCode(t, api.Get(path+"/history"), 200)
+	history_data = GetKaraHistoryOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&history_data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history_data.Body.History) != 2 {
+		t.Fatalf("revert did not create a history entry: %d", len(history_data.Body.History))
+	}
+
+	assertRespCode(t, api.Delete(path+"?reason=test"), 204)
+}
+
+func TestRevertArtist(t *testing.T) {
+	api := getTestAPI(t)
+
+	resp := assertRespCode(t,
+		api.Post("/api/tags/artist",
+			map[string]any{
+				"name":             "artist_name_revert_test",
+				"additional_names": []string{"artist_alias_revert_test"},
+			},
+		),
+		200,
+	)
+	data := ArtistOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	artist_path := fmt.Sprintf("/api/tags/artist/%d", data.Body.Artist.ID)
+	assertRespCode(t,
+		api.Patch(artist_path, "If-Match: 1",
+			map[string]any{
+				"name":             "artist_name_revert_test2",
+				"additional_names": []string{},
+			},
+		),
+		200,
+	)
+
+	resp = assertRespCode(t, api.Get(artist_path+"/history"), 200)
+	history := ArtistHistoryOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&history.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Body.History) != 1 {
+		t.Fatalf("wrong number of history entries: %d", len(history.Body.History))
+	}
+
+	resp = assertRespCode(t, api.Post(fmt.Sprintf("%s/history/%d/revert", artist_path, history.Body.History[0].ID), map[string]any{}), 200)
+	err = json.NewDecoder(resp.Body).Decode(&data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Body.Artist.Name != "artist_name_revert_test" {
+		t.Fatal("failed to revert artist name")
+	}
+	if len(data.Body.Artist.AdditionalNames) != 1 || data.Body.Artist.AdditionalNames[0].Name != "artist_alias_revert_test" {
+		t.Fatal("failed to revert artist additional names")
+	}
+
+	assertRespCode(t, api.Delete(artist_path), 204)
+}
+
+func TestKaraDiff(t *testing.T) {
+	api := getTestAPI(t)
+
+	kara := createTestKara(t, api, map[string]any{
+		"title":      "kara_title_pre_diff",
+		"audio_tags": []string{"OP"},
+	})
+
+	path := fmt.Sprintf("/api/kara/%d", kara.ID)
+	assertRespCode(t,
+		api.Patch(path, "If-Match: 1",
+			map[string]any{
+				"title":         "kara_title_post_diff",
+				"title_aliases": []string{"kara_diff_alias"},
+				"authors":       []uint{},
+				"artists":       []uint{},
+				"source_media":  0,
+				"song_order":    0,
+				"medias":        []uint{},
+				"audio_tags":    []string{"ED"},
+				"video_tags":    []string{},
+				"comment":       "",
+				"version":       "",
+				"language":      "",
+			}),
+		200,
+	)
+
+	resp := assertRespCode(t, api.Get(path+"/history/changes"), 200)
+	changes := KaraChangesOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&changes.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Body.Changes) != 1 {
+		t.Fatalf("wrong number of changes: %d", len(changes.Body.Changes))
+	}
+
+	diff := changes.Body.Changes[0]
+	if !diff.To.Current || diff.To.EditorUserID == nil || *diff.To.EditorUserID != "test_user" {
+		t.Fatalf("wrong revision for the change: %+v", diff.To)
+	}
+	if diff.To.Editor == nil || diff.To.Editor.ID != "test_user" {
+		t.Fatalf("wrong editor for the change: %+v", diff.To.Editor)
+	}
+	if len(diff.Fields) != 1 || diff.Fields[0].Field != "title" || diff.Fields[0].New != "kara_title_post_diff" {
+		t.Fatalf("wrong field changes: %+v", diff.Fields)
+	}
+	if len(diff.Associations) != 2 {
+		t.Fatalf("wrong association changes: %+v", diff.Associations)
+	}
+	audio_tags := diff.Associations[0]
+	if audio_tags.Field != "audio_tags" || audio_tags.Added[0].ID != "ED" || audio_tags.Removed[0].ID != "OP" {
+		t.Fatalf("wrong audio tags change: %+v", audio_tags)
+	}
+
+	resp = assertRespCode(t, api.Get(fmt.Sprintf("%s/history/%d/diff", path, diff.From.ID)), 200)
+	diff_data := KaraDiffOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&diff_data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff_data.Body.Diff.Fields) != 1 || len(diff_data.Body.Diff.Associations) != 2 {
+		t.Fatalf("wrong diff with current version: %+v", diff_data.Body.Diff)
+	}
+
+	assertRespCode(t, api.Delete(path+"?reason=test"), 204)
+}
+
+func TestKaraTrash(t *testing.T) {
+	api := getTestAPI(t)
+
+	kara := createTestKara(t, api, map[string]any{"title": "kara_trash_test"})
+	path := fmt.Sprintf("/api/kara/%d", kara.ID)
+
+	assertRespCode(t, api.Delete(path), 422)
+	assertRespCode(t, api.Delete(path+"?reason=duplicate"), 204)
+	assertRespCode(t, api.Get(path), 404)
+	assertRespCode(t, api.Delete(path+"?reason=duplicate"), 404)
+
+	resp := assertRespCode(t, api.Get("/api/kara/trash"), 200)
+	trash := GetTrashOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&trash.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var trashed *TrashedKara
+	for _, trashed_kara := range trash.Body.Karas {
+		if trashed_kara.Kara.ID == kara.ID {
+			trashed = &trashed_kara
+		}
+	}
+	if trashed == nil {
+		t.Fatal("deleted kara is not in the trash")
+	}
+	if trashed.Deletion == nil || trashed.Deletion.Reason != "duplicate" || *trashed.Deletion.UserID != "test_user" {
+		t.Fatalf("wrong deletion info: %+v", trashed.Deletion)
+	}
+
+	assertRespCode(t, api.Post(path+"/restore", map[string]any{}), 200)
+	assertRespCode(t, api.Get(path), 200)
+	assertRespCode(t, api.Post(path+"/restore", map[string]any{}), 404)
+
+	db := GetDB(context.Background())
+	deletion := KaraDeletion{}
+	err = db.First(&deletion, kara.ID).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deletion.Reason != "duplicate" || deletion.RestoredAt == nil || deletion.RestoredByID == nil || *deletion.RestoredByID != "test_user" {
+		t.Fatalf("wrong restoration info: %+v", deletion)
+	}
+
+	assertRespCode(t, api.Delete(path+"?reason=test"), 204)
+	deletion = KaraDeletion{}
+	err = db.First(&deletion, kara.ID).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deletion.Reason != "test" || deletion.RestoredAt != nil {
+		t.Fatalf("wrong deletion info: %+v", deletion)
+	}
+}
+
+func TestKaraIssues(t *testing.T) {
+	api := getTestAPI(t)
+
+	kara := createTestKara(t, api, map[string]any{"title": "kara_issues_test"})
+	path := fmt.Sprintf("/api/kara/%d/issues", kara.ID)
+	issue_body := map[string]any{"type": "timing", "description": "late", "timestamp": 1500}
+
+	// not uploaded yet
+	assertRespCode(t, api.Post(path, issue_body), 422)
+
+	err := GetDB(context.Background()).Model(&KaraInfoDB{}).
+		Where("id = ?", kara.ID).
+		UpdateColumns(map[string]any{"video_uploaded": true, "subtitles_uploaded": true}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertRespCode(t, api.Post(path, map[string]any{"type": "unknown", "description": "late"}), 422)
+	resp := assertRespCode(t, api.Post(path, issue_body), 200)
+	out := KaraIssueOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&out.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue := out.Body.Issue
+	if issue.Status != IssueOpen || issue.ReporterID == nil || *issue.ReporterID != "test_user" || *issue.Timestamp != 1500 {
+		t.Fatalf("wrong issue: %+v", issue)
+	}
+
+	issue_path := fmt.Sprintf("%s/%d", path, issue.ID)
+	resp = assertRespCode(t, api.Patch(issue_path, map[string]any{"type": "typo", "description": "typo", "status": "resolved"}), 200)
+	err = json.NewDecoder(resp.Body).Decode(&out.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue = out.Body.Issue
+	if issue.Status != IssueResolved || issue.Type != IssueTypeTypo || issue.Timestamp != nil || issue.ResolvedAt == nil || *issue.ResolverID != "test_user" {
+		t.Fatalf("wrong resolved issue: %+v", issue)
+	}
+
+	resp = assertRespCode(t, api.Get(path+"?status=open"), 200)
+	issues := KaraIssuesOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&issues.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues.Body.Issues) != 0 {
+		t.Fatalf("expected no open issue, got %+v", issues.Body.Issues)
+	}
+
+	resp = assertRespCode(t, api.Patch(issue_path, map[string]any{"type": "typo", "description": "still there", "status": "open"}), 200)
+	err = json.NewDecoder(resp.Body).Decode(&out.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Body.Issue.ResolverID != nil || out.Body.Issue.ResolvedAt != nil {
+		t.Fatalf("reopened issue is still resolved: %+v", out.Body.Issue)
+	}
+
+	assertRespCode(t, api.Get(fmt.Sprintf("/api/kara/%d/issues/%d", kara.ID+1, issue.ID)), 404)
+	assertRespCode(t, api.Delete(fmt.Sprintf("/api/kara/%d?reason=test", kara.ID)), 204)
+}
+
+func TestKaraClaim(t *testing.T) {
+	api := getTestAPI(t)
+
+	kara := createTestKara(t, api, map[string]any{"title": "kara_claim_test"})
+	if kara.Status != KaraStatusInProgress {
+		t.Fatalf("unexpected status of a new kara: %s", kara.Status)
+	}
+	path := fmt.Sprintf("/api/kara/%d", kara.ID)
+
+	resp := assertRespCode(t, api.Post("/api/tags/author", map[string]any{"name": "kara_claim_author"}), 200)
+	author := AuthorOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&author.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	author_id := author.Body.Author.ID
+
+	assertRespCode(t, api.Put("/api/me/author", map[string]any{"id": nil}), 204)
+	assertRespCode(t, api.Post(path+"/claim", map[string]any{}), 422)
+	assertRespCode(t, api.Put("/api/me/author", map[string]any{"id": author_id}), 204)
+
+	assertRespCode(t, api.Put(path+"/status", map[string]any{"status": "uploaded"}), 422)
+	assertRespCode(t, api.Put(path+"/status", map[string]any{"status": "planned"}), 200)
+
+	resp = assertRespCode(t, api.Post(path+"/claim", map[string]any{}), 200)
+	out := KaraOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&out.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Body.Kara.Status != KaraStatusInProgress || out.Body.Kara.ClaimedByID == nil || *out.Body.Kara.ClaimedByID != author_id {
+		t.Fatalf("kara not claimed: %+v", out.Body.Kara)
+	}
+
+	resp = assertRespCode(t, api.Get("/api/kara/wip"), 200)
+	wip := MyWIPKarasOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&wip.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wip.Body.Karas) != 1 || wip.Body.Karas[0].ID != kara.ID {
+		t.Fatalf("unexpected WIP karas: %+v", wip.Body.Karas)
+	}
+
+	resp = assertRespCode(t, api.Get(path+"/history/changes"), 200)
+	changes := KaraChangesOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&changes.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last_change := changes.Body.Changes[len(changes.Body.Changes)-1]
+	fields := []string{}
+	for _, field := range last_change.Fields {
+		fields = append(fields, field.Field)
+	}
+	if !slices.Equal(fields, []string{"status", "claimed_by"}) {
+		t.Fatalf("unexpected changes for the claim: %v", fields)
+	}
+
+	resp = assertRespCode(t, api.Delete(path+"/claim"), 200)
+	err = json.NewDecoder(resp.Body).Decode(&out.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Body.Kara.Status != KaraStatusPlanned || out.Body.Kara.ClaimedByID != nil {
+		t.Fatalf("kara still claimed: %+v", out.Body.Kara)
+	}
+
+	assertRespCode(t, api.Put("/api/me/author", map[string]any{"id": nil}), 204)
+	assertRespCode(t, api.Delete(path+"?reason=test"), 204)
+	assertRespCode(t, api.Delete(fmt.Sprintf("/api/tags/author/%d", author_id)), 204)
+}
+
+func createTestArtist(t *testing.T, api humatest.TestAPI, name string, additional_names []string) Artist {
+	resp := assertRespCode(t, api.Post("/api/tags/artist", map[string]any{"name": name, "additional_names": additional_names}), 200)
+	data := ArtistOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data.Body.Artist
+}
+
+func createTestMedia(t *testing.T, api humatest.TestAPI, name string) MediaDB {
+	resp := assertRespCode(t, api.Post("/api/tags/media", map[string]any{"name": name, "media_type": "ANIME", "additional_names": []string{}}), 200)
+	data := MediaOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data.Body.Media
+}
+
+func TestMergeArtist(t *testing.T) {
+	api := getTestAPI(t)
+
+	target := createTestArtist(t, api, "merge_artist_target", []string{})
+	source := createTestArtist(t, api, "merge_artist_source", []string{"merge_artist_alias"})
+	kara := createTestKara(t, api, map[string]any{"title": "kara_merge_artist_test", "artists": []uint{target.ID, source.ID}})
+
+	merge_path := fmt.Sprintf("/api/tags/artist/%d/merge", target.ID)
+	assertRespCode(t, api.Post(merge_path, map[string]any{"source": target.ID}), 422)
+	resp := assertRespCode(t, api.Post(merge_path, map[string]any{"source": source.ID}), 200)
+	data := ArtistOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, name := range data.Body.Artist.AdditionalNames {
+		names = append(names, name.Name)
+	}
+	if !slices.Equal(names, []string{"merge_artist_source", "merge_artist_alias"}) {
+		t.Fatalf("unexpected additional names after merge: %v", names)
+	}
+
+	assertRespCode(t, api.Get(fmt.Sprintf("/api/tags/artist/%d", source.ID)), 404)
+	resp = assertRespCode(t, api.Get("/api/tags/artist/search?name=merge_artist_alias"), 200)
+	err = json.NewDecoder(resp.Body).Decode(&data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Body.Artist.ID != target.ID {
+		t.Fatalf("merged name found artist %d instead of %d", data.Body.Artist.ID, target.ID)
+	}
+
+	resp = assertRespCode(t, api.Get(fmt.Sprintf("/api/kara/%d", kara.ID)), 200)
+	kara_data := KaraOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&kara_data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kara_data.Body.Kara.Artists) != 1 || kara_data.Body.Kara.Artists[0].ID != target.ID {
+		t.Fatalf("unexpected artists after merge: %+v", kara_data.Body.Kara.Artists)
+	}
+
+	resp = assertRespCode(t, api.Get(fmt.Sprintf("/api/kara/%d/history", kara.ID)), 200)
+	history := GetKaraHistoryOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&history.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Body.History) != 1 {
+		t.Fatalf("expected a history entry for the merge, got %d", len(history.Body.History))
+	}
+
+	assertRespCode(t, api.Delete(fmt.Sprintf("/api/kara/%d?reason=test", kara.ID)), 204)
+	assertRespCode(t, api.Delete(fmt.Sprintf("/api/tags/artist/%d", target.ID)), 204)
+}
+
+func TestMergeMedia(t *testing.T) {
+	api := getTestAPI(t)
+
+	target := createTestMedia(t, api, "merge_media_target")
+	source := createTestMedia(t, api, "merge_media_source")
+	kara := createTestKara(t, api, map[string]any{
+		"title":        "kara_merge_media_test",
+		"source_media": source.ID,
+		"medias":       []uint{source.ID},
+	})
+
+	resp := assertRespCode(t, api.Post(fmt.Sprintf("/api/tags/media/%d/merge", target.ID), map[string]any{"source": source.ID}), 200)
+	data := MediaOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Body.Media.AdditionalNames) != 1 || data.Body.Media.AdditionalNames[0].Name != "merge_media_source" {
+		t.Fatalf("unexpected additional names after merge: %+v", data.Body.Media.AdditionalNames)
+	}
+
+	resp = assertRespCode(t, api.Get(fmt.Sprintf("/api/kara/%d", kara.ID)), 200)
+	kara_data := KaraOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&kara_data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := kara_data.Body.Kara
+	if merged.SourceMediaID == nil || *merged.SourceMediaID != target.ID || len(merged.Medias) != 1 || merged.Medias[0].ID != target.ID {
+		t.Fatalf("kara medias not merged: %+v", merged)
+	}
+
+	assertRespCode(t, api.Get(fmt.Sprintf("/api/tags/media/%d", source.ID)), 404)
+	assertRespCode(t, api.Delete(fmt.Sprintf("/api/kara/%d?reason=test", kara.ID)), 204)
+	assertRespCode(t, api.Delete(fmt.Sprintf("/api/tags/media/%d", target.ID)), 204)
+}
+
+func TestNormalizeTitle(t *testing.T) {
+	title := normalizeTitle("  Zankoku na Tenshi no Thèse!! (TV size) ")
+	if title != "zankoku na tenshi no these tv size" {
+		t.Fatalf("unexpected normalized title: %q", title)
+	}
+}
+
+func TestDuplicateKaras(t *testing.T) {
+	api := getTestAPI(t)
+
+	media := createTestMedia(t, api, "duplicate_media_test")
+	kara_body := map[string]any{
+		"title":        "Duplicate Kara Test",
+		"source_media": media.ID,
+		"song_order":   1,
+		"audio_tags":   []string{"OP"},
+	}
+	kara := createTestKara(t, api, kara_body)
+
+	resp := assertRespCode(t, api.Post("/api/kara", map[string]any{
+		"title":         "duplicate kara test!",
+		"title_aliases": []string{},
+		"authors":       []uint{},
+		"artists":       []uint{},
+		"source_media":  media.ID,
+		"song_order":    1,
+		"medias":        []uint{},
+		"audio_tags":    []string{"OP"},
+		"video_tags":    []string{},
+		"comment":       "",
+		"version":       "",
+		"language":      "",
+	}), 200)
+	created := CreateKaraOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&created.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicate := created.Body.Kara
+	if len(created.Body.Duplicates) != 1 || created.Body.Duplicates[0].KaraID != kara.ID {
+		t.Fatalf("duplicate not detected on creation: %+v", created.Body.Duplicates)
+	}
+	if !slices.Equal(created.Body.Duplicates[0].Reasons, []string{DuplicateSameTitle, DuplicateSameSong}) {
+		t.Fatalf("unexpected reasons: %v", created.Body.Duplicates[0].Reasons)
+	}
+
+	assertRespCode(t, api.Post("/api/kara/duplicates/detect", map[string]any{}), 202)
+	err = DetectDuplicateKaras(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = assertRespCode(t, api.Get("/api/kara/duplicates"), 200)
+	report := DuplicateKarasOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&report.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := slices.ContainsFunc(report.Body.Duplicates, func(d KaraDuplicate) bool {
+		return d.KaraID == kara.ID && d.DuplicateID == duplicate.ID
+	})
+	if !found {
+		t.Fatalf("duplicate not in the report: %+v", report.Body.Duplicates)
+	}
+
+	// titles are compared once normalized
+	db := GetDB(context.Background())
+	err = db.Model(&KaraInfoDB{}).Where("id = ?", kara.ID).UpdateColumn("duration", 90).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, err := findKaraDuplicates(db, KaraInfoDB{Title: "Dupliçate  kara test?", UploadInfo: UploadInfo{Duration: 91}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(matches, func(m DuplicateMatch) bool { return m.KaraID == kara.ID }) {
+		t.Fatalf("normalized title not matched: %+v", matches)
+	}
+
+	assertRespCode(t, api.Delete(fmt.Sprintf("/api/kara/%d?reason=test", kara.ID)), 204)
+	assertRespCode(t, api.Delete(fmt.Sprintf("/api/kara/%d?reason=test", duplicate.ID)), 204)
+	assertRespCode(t, api.Delete(fmt.Sprintf("/api/tags/media/%d", media.ID)), 204)
+}
+
+func TestBulkUpdateKaras(t *testing.T) {
+	api := getTestAPI(t)
+
+	artist := createTestArtist(t, api, "bulk_artist_test", []string{})
+	kara := createTestKara(t, api, map[string]any{"title": "kara_bulk_test", "video_tags": []string{"MV"}, "comment": "keep me"})
+	other := createTestKara(t, api, map[string]any{"title": "kara_bulk_test_2", "language": "FR"})
+
+	body := map[string]any{
+		"ids": []uint{kara.ID, other.ID, 0},
+		"operations": []map[string]any{
+			{"op": "add_video_tag", "tag": "NSFW"},
+			{"op": "remove_video_tag", "tag": "MV"},
+			{"op": "add_artist", "id": artist.ID},
+			{"op": "set_language", "value": "FR"},
+		},
+	}
+	assertRespCode(t, api.Patch("/api/kara", map[string]any{
+		"ids":        []uint{kara.ID},
+		"operations": []map[string]any{{"op": "add_video_tag", "tag": "UNKNOWN"}},
+	}), 422)
+
+	resp := assertRespCode(t, api.Patch("/api/kara", body), 200)
+	out := BulkUpdateKarasOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&out.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := out.Body.Results
+	if len(results) != 3 || !results[0].Changed || !results[1].Changed || results[2].Error == "" {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+
+	resp = assertRespCode(t, api.Get(fmt.Sprintf("/api/kara/%d", kara.ID)), 200)
+	kara_data := KaraOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&kara_data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated := kara_data.Body.Kara
+	if len(updated.VideoTags) != 1 || updated.VideoTags[0].ID != "NSFW" ||
+		len(updated.Artists) != 1 || updated.Artists[0].ID != artist.ID ||
+		updated.Language != "FR" || updated.Comment != "keep me" {
+		t.Fatalf("bulk operations not applied: %+v", updated)
+	}
+
+	// already applied
+	resp = assertRespCode(t, api.Patch("/api/kara", body), 200)
+	err = json.NewDecoder(resp.Body).Decode(&out.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Body.Results[0].Changed || out.Body.Results[1].Changed {
+		t.Fatalf("unexpected changes: %+v", out.Body.Results)
+	}
+
+	resp = assertRespCode(t, api.Get(fmt.Sprintf("/api/kara/%d/history", kara.ID)), 200)
+	history := GetKaraHistoryOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&history.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Body.History) != 1 {
+		t.Fatalf("expected one history entry, got %d", len(history.Body.History))
+	}
+
+	assertRespCode(t, api.Delete(fmt.Sprintf("/api/kara/%d?reason=test", kara.ID)), 204)
+	assertRespCode(t, api.Delete(fmt.Sprintf("/api/kara/%d?reason=test", other.ID)), 204)
+	assertRespCode(t, api.Delete(fmt.Sprintf("/api/tags/artist/%d", artist.ID)), 204)
+}
+
+func TestPatchKara(t *testing.T) {
+	api := getTestAPI(t)
+
+	kara := createTestKara(t, api, map[string]any{
+		"title":      "kara_patch_test",
+		"audio_tags": []string{"OP"},
+		"comment":    "comment",
+		"language":   "FR",
+	})
+	path := fmt.Sprintf("/api/kara/%d", kara.ID)
+
+	resp := assertRespCode(t, api.Patch(path, "If-Match: 1", map[string]any{"title": "kara_patch_test_2", "comment": nil}), 200)
+	if etagRevision(resp.Header().Get("ETag")) != "2" {
+		t.Fatalf("unexpected ETag after update: %s", resp.Header().Get("ETag"))
+	}
+	data := KaraOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched := data.Body.Kara
+	if patched.Title != "kara_patch_test_2" || patched.Comment != "" || patched.Language != "FR" ||
+		len(patched.AudioTags) != 1 || patched.AudioTags[0].ID != "OP" {
+		t.Fatalf("unexpected kara after patch: %+v", patched)
+	}
+
+	// based on the first version
+	resp = assertRespCode(t, api.Patch(path, "If-Match: 1", map[string]any{"language": "EN"}), 409)
+	conflict := RevisionConflictError[KaraInfoDB]{}
+	err = json.NewDecoder(resp.Body).Decode(&conflict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conflict.Current.Revision != 2 || conflict.Current.Title != "kara_patch_test_2" {
+		t.Fatalf("unexpected current kara in conflict: %+v", conflict.Current)
+	}
+	assertRespCode(t, api.Patch(path, map[string]any{"language": "EN"}), 428)
+	assertRespCode(t, api.Patch(path, "If-Match: 2", map[string]any{"unknown": "field"}), 422)
+	assertRespCode(t, api.Patch(path, "If-Match: 2", map[string]any{"audio_tags": []string{}}), 200)
+
+	resp = assertRespCode(t, api.Get(path+"/history"), 200)
+	history := GetKaraHistoryOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&history.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Body.History) != 2 {
+		t.Fatalf("expected 2 history entries, got %d", len(history.Body.History))
+	}
+
+	// internal updates aren't based on a revision sent by a user
+	err = GetDB(context.Background()).Model(&kara).Updates(KaraInfoDB{UploadInfo: UploadInfo{Duration: 42}}).Error
+	if err != nil {
+		t.Fatalf("internal update of an outdated kara failed: %s", err)
+	}
+
+	assertRespCode(t, api.Delete(path+"?reason=test"), 204)
+}
+
+func TestPatchArtist(t *testing.T) {
+	api := getTestAPI(t)
+
+	artist := createTestArtist(t, api, "artist_patch_test", []string{"artist_patch_alias"})
+	path := fmt.Sprintf("/api/tags/artist/%d", artist.ID)
+
+	resp := assertRespCode(t, api.Patch(path, "If-Match: 1", map[string]any{"name": "artist_patch_test_2"}), 200)
+	data := ArtistOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched := data.Body.Artist
+	if patched.Name != "artist_patch_test_2" || len(patched.AdditionalNames) != 1 || patched.AdditionalNames[0].Name != "artist_patch_alias" {
+		t.Fatalf("unexpected artist after patch: %+v", patched)
+	}
+
+	assertRespCode(t, api.Delete(path), 204)
+}
+
+func TestConditionalGet(t *testing.T) {
+	api := getTestAPI(t)
+
+	artist := createTestArtist(t, api, "artist_etag_test", []string{})
+	kara := createTestKara(t, api, map[string]any{
+		"title":   "kara_etag_test",
+		"artists": []uint{artist.ID},
+	})
+	path := fmt.Sprintf("/api/kara/%d", kara.ID)
+	artist_path := fmt.Sprintf("/api/tags/artist/%d", artist.ID)
+
+	resp := assertRespCode(t, api.Get(path), 200)
+	etag := resp.Header().Get("ETag")
+	last_modified := resp.Header().Get("Last-Modified")
+	if etagRevision(etag) != "1" || last_modified == "" {
+		t.Fatalf("unexpected validators: %q %q", etag, last_modified)
+	}
+	assertRespCode(t, api.Get(path, "If-None-Match: "+etag), 304)
+	assertRespCode(t, api.Get(path, "If-None-Match: \"other\""), 200)
+	assertRespCode(t, api.Get(path, "If-Modified-Since: "+last_modified), 304)
+
+	resp = assertRespCode(t, api.Get("/api/kara"), 200)
+	list_etag := resp.Header().Get("ETag")
+	assertRespCode(t, api.Get("/api/kara", "If-None-Match: "+list_etag), 304)
+
+	resp = assertRespCode(t, api.Get(artist_path), 200)
+	if resp.Header().Get("ETag") != "1" {
+		t.Fatalf("unexpected artist ETag: %s", resp.Header().Get("ETag"))
+	}
+	assertRespCode(t, api.Get(artist_path, "If-None-Match: 1"), 304)
+
+	// renaming the artist changes the karas including it
+	assertRespCode(t, api.Patch(artist_path, "If-Match: 1", map[string]any{"name": "artist_etag_test_2"}), 200)
+	assertRespCode(t, api.Get(artist_path, "If-None-Match: 1"), 200)
+	resp = assertRespCode(t, api.Get(path, "If-None-Match: "+etag), 200)
+	if resp.Header().Get("ETag") == etag || etagRevision(resp.Header().Get("ETag")) != "1" {
+		t.Fatalf("unexpected ETag after artist update: %s", resp.Header().Get("ETag"))
+	}
+	resp = assertRespCode(t, api.Get("/api/kara", "If-None-Match: "+list_etag), 200)
+	list_etag = resp.Header().Get("ETag")
+
+	assertRespCode(t, api.Delete(path+"?reason=test"), 204)
+	assertRespCode(t, api.Get("/api/kara", "If-None-Match: "+list_etag), 200)
+	assertRespCode(t, api.Delete(artist_path), 204)
+}
+
+func getTestChanges(t *testing.T, api humatest.TestAPI, since string) GetChangesOutput {
+	resp := assertRespCode(t, api.Get("/api/changes?limit=1000&since="+since), 200)
+	data := GetChangesOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestChanges(t *testing.T) {
+	api := getTestAPI(t)
+
+	since := ""
+	for {
+		data := getTestChanges(t, api, since)
+		since = data.Body.NextCursor
+		if data.Body.UpToDate {
+			break
+		}
+	}
+
+	artist := createTestArtist(t, api, "artist_changes_test", []string{})
+	artist_path := fmt.Sprintf("/api/tags/artist/%d", artist.ID)
+	assertRespCode(t, api.Patch(artist_path, "If-Match: 1", map[string]any{"name": "artist_changes_test_2"}), 200)
+	kara := createTestKara(t, api, map[string]any{"title": "kara_changes_test"})
+	kara_path := fmt.Sprintf("/api/kara/%d", kara.ID)
+	assertRespCode(t, api.Delete(kara_path+"?reason=test"), 204)
+	assertRespCode(t, api.Post(kara_path+"/restore", map[string]any{}), 200)
+
+	// changes are written when the transaction is committed
+	rollback := errors.New("rollback")
+	err := transaction(GetDB(context.Background()), func(tx *gorm.DB) error {
+		err := tx.Model(&KaraInfoDB{Model: gorm.Model{ID: kara.ID}}).Update("comment", "rolled back").Error
+		if err != nil {
+			return err
+		}
+		var count int64
+		err = tx.Model(&ChangeLogEntry{}).Where("type = ? AND object_id = ? AND action = ?", "kara", kara.ID, ChangeUpdated).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count != 0 {
+			t.Fatal("change written before the commit")
+		}
+		return rollback
+	})
+	if !errors.Is(err, rollback) {
+		t.Fatal(err)
+	}
+
+	assertRespCode(t, api.Delete(kara_path+"?reason=test"), 204)
+	assertRespCode(t, api.Delete(artist_path), 204)
+
+	data := getTestChanges(t, api, since)
+	expected := []Change{
+		{Type: "artist", ID: artist.ID, Action: ChangeCreated, Revision: 1},
+		{Type: "artist", ID: artist.ID, Action: ChangeUpdated, Revision: 2},
+		{Type: "kara", ID: kara.ID, Action: ChangeCreated, Revision: 1},
+		{Type: "kara", ID: kara.ID, Action: ChangeDeleted},
+		{Type: "kara", ID: kara.ID, Action: ChangeRestored, Revision: 1},
+		{Type: "kara", ID: kara.ID, Action: ChangeDeleted},
+		{Type: "artist", ID: artist.ID, Action: ChangeDeleted},
+	}
+	if len(data.Body.Changes) != len(expected) {
+		t.Fatalf("unexpected changes: %+v", data.Body.Changes)
+	}
+	for i, change := range data.Body.Changes {
+		change.Time = time.Time{}
+		if change != expected[i] {
+			t.Fatalf("unexpected change %d: %+v", i, change)
+		}
+	}
+
+	data = getTestChanges(t, api, data.Body.NextCursor)
+	if len(data.Body.Changes) != 0 || !data.Body.UpToDate {
+		t.Fatalf("unexpected changes after the last cursor: %+v", data.Body.Changes)
+	}
+	assertRespCode(t, api.Get("/api/changes?since=invalid"), 422)
+}
+
+func TestEvents(t *testing.T) {
+	api := getTestAPI(t)
+
+	last_id := EVENTS.LastID()
+	kara := createTestKara(t, api, map[string]any{"title": "kara_events_test"})
+	kara_path := fmt.Sprintf("/api/kara/%d", kara.ID)
+	assertRespCode(t, api.Patch(kara_path, "If-Match: 1", map[string]any{"title": "kara_events_test_2"}), 200)
+
+	// events of rolled back changes are not sent
+	rollback := errors.New("rollback")
+	err := transaction(GetDB(context.Background()), func(tx *gorm.DB) error {
+		err := tx.Model(&KaraInfoDB{Model: gorm.Model{ID: kara.ID}}).Update("comment", "rolled back").Error
+		if err != nil {
+			return err
+		}
+		return rollback
+	})
+	if !errors.Is(err, rollback) {
+		t.Fatal(err)
+	}
+	assertRespCode(t, api.Delete(kara_path+"?reason=test"), 204)
+
+	// resume from before the changes, the stream ends with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	resp := assertRespCode(t, api.GetCtx(ctx, "/api/events", fmt.Sprintf("Last-Event-ID: %d", last_id)), 200)
+	if resp.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type %s", resp.Header().Get("Content-Type"))
+	}
+
+	types := []EventType{}
+	for block := range strings.SplitSeq(resp.Body.String(), "\n\n") {
+		var typ EventType
+		data := KaraEventData{}
+		for line := range strings.SplitSeq(block, "\n") {
+			if value, ok := strings.CutPrefix(line, "event: "); ok {
+				typ = EventType(value)
+			} else if value, ok := strings.CutPrefix(line, "data: "); ok {
+				err := json.Unmarshal([]byte(value), &data)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if data.KaraID == kara.ID {
+			types = append(types, typ)
+		}
+	}
+	expected := []EventType{EventKaraCreated, EventKaraUpdated, EventKaraDeleted}
+	if !slices.Equal(types, expected) {
+		t.Fatalf("expected events %v, got %v", expected, types)
+	}
+
+	// unknown events reset the client
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	resp = assertRespCode(t, api.GetCtx(ctx, "/api/events", "Last-Event-ID: 1"), 200)
+	if !strings.Contains(resp.Body.String(), "event: reset\n") {
+		t.Fatalf("expected a reset event, got %s", resp.Body.String())
+	}
+	assertRespCode(t, api.Get("/api/events", "Last-Event-ID: invalid"), 422)
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	api := getTestAPI(t)
+
+	fail := true
+	received := []*http.Request{}
+	bodies := [][]byte{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, body)
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+
+	webhook := createTestWebhook(t, api, map[string]any{
+		"type":    "json",
+		"url":     receiver.URL,
+		"secret":  "webhook_secret",
+		"events":  []string{"issue_opened"},
+		"enabled": true,
+	})
+	defer func() { assertRespCode(t, api.Delete(fmt.Sprintf("/api/webhooks/%d", webhook.ID)), 204) }()
+
+	kara := createTestKara(t, api, map[string]any{"title": "kara_webhook_test"})
+	err := GetDB(context.Background()).Model(&KaraInfoDB{}).
+		Where("id = ?", kara.ID).
+		UpdateColumns(map[string]any{"video_uploaded": true, "subtitles_uploaded": true}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue_body := map[string]any{"type": "timing", "description": "late", "timestamp": 1500}
+	assertRespCode(t, api.Post(fmt.Sprintf("/api/kara/%d/issues", kara.ID), issue_body), 200)
+
+	// the receiver fails the first attempt, it is retried later
+	DeliverPendingWebhooks(context.Background())
+	resp := assertRespCode(t, api.Get("/api/webhooks/deliveries?status=pending"), 200)
+	deliveries := WebhookDeliveriesOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&deliveries.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries.Body.Deliveries) != 1 || len(received) != 1 {
+		t.Fatalf("unexpected deliveries: %+v", deliveries.Body.Deliveries)
+	}
+	delivery := deliveries.Body.Deliveries[0]
+	if delivery.WebhookID != webhook.ID || delivery.Event != WebhookIssueOpened || delivery.Attempts != 1 || delivery.LastStatus != 500 || delivery.LastError == "" {
+		t.Fatalf("unexpected delivery after a failure: %+v", delivery)
+	}
+	if delivery.NextAttemptAt == nil || !delivery.NextAttemptAt.After(time.Now()) {
+		t.Fatalf("delivery retried too early: %+v", delivery.NextAttemptAt)
+	}
+	DeliverPendingWebhooks(context.Background())
+	if len(received) != 1 {
+		t.Fatal("delivery retried before its next attempt")
+	}
+
+	// deliveries being sent are not sent again
+	claimed_until := time.Now().UTC().Add(time.Minute)
+	err = GetDB(context.Background()).Model(&WebhookDelivery{ID: delivery.ID}).UpdateColumn("claimed_until", claimed_until).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRespCode(t, api.Post(fmt.Sprintf("/api/webhooks/deliveries/%s/redeliver", delivery.ID), map[string]any{}), 409)
+	err = GetDB(context.Background()).Model(&WebhookDelivery{ID: delivery.ID}).UpdateColumn("claimed_until", nil).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fail = false
+	resp = assertRespCode(t, api.Post(fmt.Sprintf("/api/webhooks/deliveries/%s/redeliver", delivery.ID), map[string]any{}), 200)
+	redelivery := WebhookDeliveryOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&redelivery.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redelivery.Body.Delivery.Status != WebhookDeliveryDelivered || redelivery.Body.Delivery.Attempts != 2 {
+		t.Fatalf("unexpected delivery after a redelivery: %+v", redelivery.Body.Delivery)
+	}
+
+	for i, r := range received {
+		if r.Header.Get("X-Karaberus-Delivery") != delivery.ID.String() {
+			t.Fatalf("unexpected delivery ID %s", r.Header.Get("X-Karaberus-Delivery"))
+		}
+		if r.Header.Get("X-Karaberus-Event") != string(WebhookIssueOpened) {
+			t.Fatalf("unexpected event %s", r.Header.Get("X-Karaberus-Event"))
+		}
+		if r.Header.Get("X-Karaberus-Signature") != webhookSignature("webhook_secret", bodies[i]) {
+			t.Fatalf("invalid signature %s", r.Header.Get("X-Karaberus-Signature"))
+		}
+	}
+	data := WebhookTemplateContext{}
+	err = json.Unmarshal(bodies[1], &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Kara.ID != kara.ID || data.Issue == nil {
+		t.Fatalf("unexpected webhook body: %s", bodies[1])
+	}
+
+	resp = assertRespCode(t, api.Get("/api/webhooks/deliveries"), 200)
+	err = json.NewDecoder(resp.Body).Decode(&deliveries.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries.Body.Deliveries) == 0 || deliveries.Body.Deliveries[0].Status != WebhookDeliveryDelivered {
+		t.Fatalf("unexpected deliveries: %+v", deliveries.Body.Deliveries)
+	}
+	DeliverPendingWebhooks(context.Background())
+	if len(received) != 2 {
+		t.Fatal("delivered webhook sent again")
+	}
+}
+
+func TestImportWebhooksConfig(t *testing.T) {
+	getTestAPI(t)
+	db := GetDB(context.Background())
+
+	prev_webhooks, prev_secret := CONFIG.Webhooks, CONFIG.WebhooksSecret
+	defer func() { CONFIG.Webhooks, CONFIG.WebhooksSecret = prev_webhooks, prev_secret }()
+	CONFIG.Webhooks = []string{"json=http://127.0.0.1/import_webhooks_test"}
+	CONFIG.WebhooksSecret = "import_webhooks_secret"
+	importWebhooksConfig(db)
+
+	webhook := Webhook{}
+	err := db.Where(&Webhook{URL: "http://127.0.0.1/import_webhooks_test"}).First(&webhook).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Delete(&webhook)
+	if webhook.Type != "json" || webhook.Secret != "import_webhooks_secret" || !webhook.Enabled {
+		t.Fatalf("unexpected imported webhook: %+v", webhook)
+	}
+}
+
+func createTestWebhook(t *testing.T, api humatest.TestAPI, body map[string]any) Webhook {
+	resp := assertRespCode(t, api.Post("/api/webhooks", body), 200)
+	data := WebhookOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data.Body.Webhook
+}
+
+func TestWebhooks(t *testing.T) {
+	api := getTestAPI(t)
+
+	received := []string{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("X-Karaberus-Event"))
+	}))
+	defer receiver.Close()
+
+	body := map[string]any{
+		"type":    "discord",
+		"url":     receiver.URL,
+		"secret":  "webhooks_test_secret",
+		"events":  []string{"kara_updated", "kara_deleted"},
+		"enabled": true,
+	}
+	webhook := createTestWebhook(t, api, body)
+	path := fmt.Sprintf("/api/webhooks/%d", webhook.ID)
+	resp := assertRespCode(t, api.Get(path), 200)
+	if !webhook.HasSecret || strings.Contains(resp.Body.String(), "webhooks_test_secret") {
+		t.Fatalf("secret returned by the API: %s", resp.Body.String())
+	}
+
+	body["events"] = []string{"not_an_event"}
+	assertRespCode(t, api.Post("/api/webhooks", body), 422)
+
+	// only the subscribed events are delivered
+	kara := createTestKara(t, api, map[string]any{"title": "kara_webhooks_test"})
+	kara_path := fmt.Sprintf("/api/kara/%d", kara.ID)
+	assertRespCode(t, api.Patch(kara_path, "If-Match: 1", map[string]any{"title": "kara_webhooks_test_2"}), 200)
+	DeliverPendingWebhooks(context.Background())
+	if !slices.Equal(received, []string{"kara_updated"}) {
+		t.Fatalf("unexpected events %v", received)
+	}
+
+	// internal updates are not sent
+	err := GetDB(context.Background()).Model(&KaraInfoDB{Model: gorm.Model{ID: kara.ID}}).
+		Updates(&KaraInfoDB{UploadInfo: UploadInfo{Duration: 42}}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	DeliverPendingWebhooks(context.Background())
+	if len(received) != 1 {
+		t.Fatalf("internal update sent: %v", received)
+	}
+
+	// disabled webhooks don't get events, the secret is kept
+	delete(body, "secret")
+	body["events"] = []string{"kara_updated", "kara_deleted"}
+	body["enabled"] = false
+	resp = assertRespCode(t, api.Patch(path, body), 200)
+	data := WebhookOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&data.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.Body.Webhook.Enabled {
+		t.Fatalf("unexpected webhook after an update: %+v", data.Body.Webhook)
+	}
+	err = GetDB(context.Background()).First(&webhook, webhook.ID).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if webhook.Secret != "webhooks_test_secret" {
+		t.Fatalf("secret not kept: %s", webhook.Secret)
+	}
+	assertRespCode(t, api.Delete(kara_path+"?reason=test"), 204)
+	DeliverPendingWebhooks(context.Background())
+	if len(received) != 1 {
+		t.Fatalf("disabled webhook received %v", received)
+	}
+
+	// test events are sent to disabled webhooks
+	resp = assertRespCode(t, api.Post(path+"/test", map[string]any{}), 200)
+	delivery := WebhookDeliveryOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&delivery.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delivery.Body.Delivery.Status != WebhookDeliveryDelivered || received[1] != string(WebhookTest) {
+		t.Fatalf("test event not delivered: %+v", delivery.Body.Delivery)
+	}
+
+	resp = assertRespCode(t, api.Get("/api/webhooks"), 200)
+	all := AllWebhooksOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&all.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(all.Body.Webhooks, func(w Webhook) bool { return w.ID == webhook.ID }) {
+		t.Fatalf("webhook not listed: %+v", all.Body.Webhooks)
+	}
+
+	assertRespCode(t, api.Delete(path), 204)
+	assertRespCode(t, api.Get(path), 404)
+}
+
+func TestWebhookTemplates(t *testing.T) {
+	api := getTestAPI(t)
+
+	received_body := ""
+	received_headers := http.Header{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received_body = string(body)
+		received_headers = r.Header
+	}))
+	defer receiver.Close()
+
+	body := map[string]any{
+		"type":             "json",
+		"url":              receiver.URL,
+		"events":           []string{"kara_created"},
+		"enabled":          true,
+		"body_template":    "{{.Title}} ({{.Event}})",
+		"header_templates": map[string]string{"Content-Type": "text/plain", "Title": "{{.Event | upper}}"},
+	}
+	webhook := createTestWebhook(t, api, body)
+	path := fmt.Sprintf("/api/webhooks/%d", webhook.ID)
+
+	// templates are checked when saved
+	body["body_template"] = "{{.NotAField}}"
+	assertRespCode(t, api.Patch(path, body), 422)
+	body["body_template"] = "{{.Title"
+	assertRespCode(t, api.Post("/api/webhooks", body), 422)
+	body["body_template"] = ""
+	body["header_templates"] = map[string]string{"Not a header": "value"}
+	assertRespCode(t, api.Post("/api/webhooks", body), 422)
+
+	resp := assertRespCode(t, api.Post(path+"/test", map[string]any{}), 200)
+	if received_body != "Test event (test)" || received_headers.Get("Content-Type") != "text/plain" || received_headers.Get("Title") != "TEST" {
+		t.Fatalf("unexpected delivery %s %v: %s", received_body, received_headers, resp.Body.String())
+	}
+
+	kara := createTestKara(t, api, map[string]any{"title": "kara_webhook_templates_test"})
+	resp = assertRespCode(t, api.Post("/api/webhooks/preview", map[string]any{
+		"type":             "discord",
+		"body_template":    `{"text": {{json .Kara.Title}}}`,
+		"header_templates": map[string]string{"X-Kara": "{{.Kara.ID}}"},
+		"event":            "kara_updated",
+		"kara_id":          kara.ID,
+	}), 200)
+	preview := PreviewWebhookOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&preview.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Body.Body != `{"text": "kara_webhook_templates_test"}` || preview.Body.Headers["X-Kara"] != fmt.Sprint(kara.ID) {
+		t.Fatalf("unexpected preview: %+v", preview.Body)
+	}
+
+	// no issue to preview
+	assertRespCode(t, api.Post("/api/webhooks/preview", map[string]any{
+		"type":    "discord",
+		"event":   "issue_opened",
+		"kara_id": kara.ID,
+	}), 404)
+
+	assertRespCode(t, api.Delete(path), 204)
+}
+
+func TestChatWebhooks(t *testing.T) {
+	api := getTestAPI(t)
+
+	// the webhooks are sent concurrently
+	mutex := sync.Mutex{}
+	requests := map[string]*http.Request{}
+	bodies := map[string][]byte{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		typ, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests[typ] = r
+		bodies[typ] = body
+	}))
+	defer receiver.Close()
+
+	room_path := "/matrix/_matrix/client/v3/rooms/!room:karaberus/send/m.room.message"
+	for _, webhook := range []map[string]any{
+		{"type": "matrix", "url": receiver.URL + room_path, "secret": "matrix_token"},
+		{"type": "slack", "url": receiver.URL + "/slack/services/T0/B0/X0"},
+	} {
+		webhook["events"] = []string{"kara_updated"}
+		webhook["enabled"] = true
+		created := createTestWebhook(t, api, webhook)
+		defer func() { assertRespCode(t, api.Delete(fmt.Sprintf("/api/webhooks/%d", created.ID)), 204) }()
+	}
+
+	kara := createTestKara(t, api, map[string]any{"title": "kara_chat_webhooks_test", "version": "v2"})
+	kara_path := fmt.Sprintf("/api/kara/%d", kara.ID)
+	assertRespCode(t, api.Patch(kara_path, "If-Match: 1", map[string]any{"title": "kara_chat_webhooks_<test>"}), 200)
+	DeliverPendingWebhooks(context.Background())
+
+	matrix := requests["matrix"]
+	if matrix == nil || matrix.Method != http.MethodPut || !strings.HasPrefix(matrix.URL.Path, room_path+"/") {
+		t.Fatalf("unexpected matrix request: %+v", matrix)
+	}
+	if matrix.Header.Get("Authorization") != "Bearer matrix_token" || matrix.Header.Get("X-Karaberus-Signature") != "" {
+		t.Fatalf("unexpected matrix headers: %v", matrix.Header)
+	}
+	if strings.TrimPrefix(matrix.URL.Path, room_path+"/") != matrix.Header.Get("X-Karaberus-Delivery") {
+		t.Fatalf("transaction ID is not the delivery ID: %s", matrix.URL.Path)
+	}
+	message := MatrixMessage{}
+	err := json.Unmarshal(bodies["matrix"], &message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.MsgType != "m.notice" || !strings.Contains(message.Body, "kara_chat_webhooks_<test>") ||
+		!strings.Contains(message.FormattedBody, `data-mx-color="#3498db"`) ||
+		!strings.Contains(message.FormattedBody, "kara_chat_webhooks_&lt;test&gt;") ||
+		!strings.Contains(message.FormattedBody, "<b>Version</b>: v2") {
+		t.Fatalf("unexpected matrix message: %+v", message)
+	}
+
+	slack := requests["slack"]
+	if slack == nil || slack.Method != http.MethodPost {
+		t.Fatalf("unexpected slack request: %+v", slack)
+	}
+	slack_data := SlackWebhook{}
+	err = json.Unmarshal(bodies["slack"], &slack_data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slack_data.Attachments) != 1 || slack_data.Attachments[0].Color != "#3498db" {
+		t.Fatalf("unexpected slack message: %s", bodies["slack"])
+	}
+	blocks := slack_data.Attachments[0].Blocks
+	title := fmt.Sprintf("*<%s|kara_chat_webhooks_&lt;test&gt;>*", karaResource(kara))
+	if len(blocks) != 3 || blocks[0].Text.Text != WebhookKaraUpdated.DisplayName() || blocks[1].Text.Text != title || !strings.HasPrefix(blocks[2].Text.Text, "*Version*: v2\n") {
+		t.Fatalf("unexpected slack blocks: %s", bodies["slack"])
+	}
+}
+
+func getTestJob(t *testing.T, api humatest.TestAPI, id uint) Job {
+	resp := assertRespCode(t, api.Get(fmt.Sprintf("/api/jobs/%d", id)), 200)
+	out := JobOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&out.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Body.Job
+}
+
+func TestJobs(t *testing.T) {
+	api := getTestAPI(t)
+	db := GetDB(context.Background())
+
+	runs := 0
+	started := make(chan bool, 1)
+	jobHandlers["test_job"] = JobHandler{
+		Run: func(ctx context.Context, job Job) error {
+			payload := struct {
+				Block bool `json:"block"`
+			}{}
+			err := job.decode(&payload)
+			if err != nil {
+				return err
+			}
+			if payload.Block {
+				started <- true
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			runs++
+			if runs == 1 {
+				return errors.New("first attempt fails")
+			}
+			return nil
+		},
+		Concurrency: 1,
+		MaxAttempts: 1,
+	}
+	defer delete(jobHandlers, "test_job")
+
+	err := enqueueJob(db, "test_job", map[string]any{"block": false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startDueJobs(context.Background()).Wait()
+
+	resp := assertRespCode(t, api.Get("/api/jobs?type=test_job"), 200)
+	jobs := JobsOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&jobs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs.Body.Jobs) != 1 {
+		t.Fatalf("unexpected jobs: %+v", jobs.Body.Jobs)
+	}
+	job := jobs.Body.Jobs[0]
+	if job.Status != JobFailed || job.Attempts != 1 || job.LastError != "first attempt fails" || job.FinishedAt == nil {
+		t.Fatalf("unexpected job after a failure: %+v", job)
+	}
+
+	// only finished jobs can be retried
+	assertRespCode(t, api.Post(fmt.Sprintf("/api/jobs/%d/retry", job.ID), map[string]any{}), 202)
+	assertRespCode(t, api.Post(fmt.Sprintf("/api/jobs/%d/retry", job.ID), map[string]any{}), 409)
+	startDueJobs(context.Background()).Wait()
+	job = getTestJob(t, api, job.ID)
+	if job.Status != JobSucceeded || job.Attempts != 1 || job.LastError != "" || runs != 2 {
+		t.Fatalf("unexpected job after a retry: %+v", job)
+	}
+
+	// failed jobs are retried later while they have attempts left
+	jobHandlers["test_job"] = JobHandler{Run: jobHandlers["test_job"].Run, Concurrency: 1, MaxAttempts: 2}
+	runs = 0
+	err = enqueueJob(db, "test_job", map[string]any{"block": false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startDueJobs(context.Background()).Wait()
+	pending := Job{}
+	err = db.Where(&Job{Type: "test_job", Status: JobPending}).First(&pending).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Attempts != 1 || !pending.RunAt.After(time.Now()) {
+		t.Fatalf("job retried too early: %+v", pending)
+	}
+	assertRespCode(t, api.Post(fmt.Sprintf("/api/jobs/%d/cancel", pending.ID), map[string]any{}), 200)
+	startDueJobs(context.Background()).Wait()
+	if getTestJob(t, api, pending.ID).Status != JobCanceled || runs != 1 {
+		t.Fatal("canceled job was run")
+	}
+
+	// the same job is only pending once, it runs at the earliest time
+	later := time.Now().UTC().Add(time.Hour)
+	err = enqueueJobAt(db, "test_job", map[string]any{"block": false, "unique": true}, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = enqueueJob(db, "test_job", map[string]any{"block": false, "unique": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unique := []Job{}
+	err = db.Where(&Job{Type: "test_job", Status: JobPending}).Find(&unique).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unique) != 1 || unique[0].RunAt.After(time.Now()) {
+		t.Fatalf("unexpected pending jobs: %+v", unique)
+	}
+
+	// recurring jobs are enqueued again when they finish
+	jobHandlers["test_job"] = JobHandler{Run: jobHandlers["test_job"].Run, Concurrency: 1, MaxAttempts: 1, Interval: time.Hour}
+	startDueJobs(context.Background()).Wait()
+	next := Job{}
+	err = db.Where(&Job{Type: "test_job", Status: JobPending}).First(&next).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.ID == unique[0].ID || next.Payload != unique[0].Payload || !next.RunAt.After(later.Add(-time.Minute)) {
+		t.Fatalf("unexpected next run: %+v", next)
+	}
+	assertRespCode(t, api.Post(fmt.Sprintf("/api/jobs/%d/cancel", next.ID), map[string]any{}), 200)
+	jobHandlers["test_job"] = JobHandler{Run: jobHandlers["test_job"].Run, Concurrency: 1, MaxAttempts: 1}
+
+	// running jobs are stopped
+	err = enqueueJob(db, "test_job", map[string]any{"block": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg := startDueJobs(context.Background())
+	<-started
+	running := Job{}
+	err = db.Where(&Job{Type: "test_job", Status: JobRunning}).First(&running).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// jobs of a saturated type don't delay the other types
+	for i := range 150 {
+		err = enqueueJob(db, "test_job", map[string]any{"block": false, "index": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	other_runs := 0
+	jobHandlers["test_job_other"] = JobHandler{
+		Run: func(ctx context.Context, job Job) error {
+			other_runs++
+			return nil
+		},
+		Concurrency: 1,
+		MaxAttempts: 1,
+	}
+	defer delete(jobHandlers, "test_job_other")
+	err = enqueueJob(db, "test_job_other", struct{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	startDueJobs(context.Background()).Wait()
+	if other_runs != 1 {
+		t.Fatal("job starved by a saturated type")
+	}
+	err = db.Model(&Job{}).Where(&Job{Type: "test_job", Status: JobPending}).Update("status", JobCanceled).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertRespCode(t, api.Post(fmt.Sprintf("/api/jobs/%d/cancel", running.ID), map[string]any{}), 200)
+	wg.Wait()
+	running = getTestJob(t, api, running.ID)
+	if running.Status != JobCanceled || running.FinishedAt == nil {
+		t.Fatalf("unexpected job after cancel: %+v", running)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	api := getTestAPI(t)
+	ctx := context.Background()
+
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev_storage := STORAGE
+	STORAGE = storage
+	defer func() { STORAGE = prev_storage }()
+
+	content := "[Script Info]\n"
+	err = PutObject(ctx, strings.NewReader(content), "sub/1", int64(len(content)), map[string]string{"Mugenchecksum": "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = PutObject(ctx, strings.NewReader("font"), "font/1", 4, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := GetObject(ctx, "sub/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := obj.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size != int64(len(content)) || stat.UserMetadata["Mugenchecksum"] != "abc" {
+		t.Fatalf("unexpected object info: %+v", stat)
+	}
+	_, err = obj.Seek(1, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Closer(obj)
+	if string(b) != content[1:] {
+		t.Fatalf("unexpected content %q", b)
+	}
+
+	objects, err := storage.List(ctx, "sub/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "sub/1" {
+		t.Fatalf("unexpected objects: %+v", objects)
+	}
+
+	// the metadata is replaced at once and kept when the file is not written
+	entries, err := os.ReadDir(filepath.Join(storage.Directory, localMetadataDirectory, "sub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "1.json" {
+		t.Fatalf("unexpected metadata files: %v", entries)
+	}
+	err = PutObject(ctx, strings.NewReader(content), "sub/1", int64(len(content))+1, nil)
+	if err == nil {
+		t.Fatal("incomplete file accepted")
+	}
+	stat, err = StatObject(ctx, "sub/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.UserMetadata["Mugenchecksum"] != "abc" {
+		t.Fatalf("metadata replaced by a failed write: %+v", stat.UserMetadata)
+	}
+
+	// overwriting a file replaces its metadata
+	err = PutObject(ctx, strings.NewReader(content), "sub/1", int64(len(content)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err = StatObject(ctx, "sub/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stat.UserMetadata) != 0 {
+		t.Fatalf("metadata not replaced: %+v", stat.UserMetadata)
+	}
+
+	for _, key := range []string{"../sub/1", ".metadata/sub/1.json", "/sub/1"} {
+		err = PutObject(ctx, strings.NewReader(content), key, int64(len(content)), nil)
+		if err == nil {
+			t.Fatalf("invalid key %s accepted", key)
+		}
+	}
+
+	kara := createTestKara(t, api, map[string]any{"title": "kara_storage_test"})
+	err = PutObject(ctx, strings.NewReader(content), fmt.Sprintf("sub/%d", kara.ID), int64(len(content)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := assertRespCode(t, api.Do(http.MethodHead, fmt.Sprintf("/api/kara/%d/download/sub", kara.ID)), 200)
+	if resp.Header().Get("Content-Length") != fmt.Sprint(len(content)) {
+		t.Fatalf("unexpected headers: %+v", resp.Header())
+	}
+
+	err = deleteFile(ctx, fmt.Sprintf("sub/%d", kara.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRespCode(t, api.Do(http.MethodHead, fmt.Sprintf("/api/kara/%d/download/sub", kara.ID)), 404)
+	_, err = GetObject(ctx, fmt.Sprintf("sub/%d", kara.ID))
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("unexpected error for a deleted file: %v", err)
+	}
+}
+
+// In-memory stand-in for the nodes of a S3 cluster, they share their objects
+type testS3Object struct {
+	data     []byte
+	metadata http.Header
+}
+
+type testS3Cluster struct {
+	mutex   sync.Mutex
+	objects map[string]testS3Object
+}
+
+func (c *testS3Cluster) handler(requests *atomic.Int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if bucket != CONFIG.S3.BucketName {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if key == "" {
+			if r.URL.Query().Get("list-type") == "2" {
+				prefix := r.URL.Query().Get("prefix")
+				fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult><IsTruncated>false</IsTruncated>`)
+				for name, obj := range c.objects {
+					if strings.HasPrefix(name, prefix) {
+						fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size></Contents>", name, len(obj.data))
+					}
+				}
+				fmt.Fprint(w, "</ListBucketResult>")
+			}
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			data, _ := io.ReadAll(r.Body)
+			metadata := http.Header{}
+			for name, value := range r.Header {
+				if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+					metadata[name] = value
+				}
+			}
+			c.objects[key] = testS3Object{data, metadata}
+			w.Header().Set("ETag", `"etag"`)
+		case http.MethodDelete:
+			delete(c.objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet, http.MethodHead:
+			obj, ok := c.objects[key]
+			if !ok {
+				w.Header().Set("Content-Type", "application/xml")
+				w.WriteHeader(http.StatusNotFound)
+				fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>NoSuchKey</Code><Message>missing</Message></Error>`)
+				return
+			}
+			for name, value := range obj.metadata {
+				w.Header()[name] = value
+			}
+			w.Header().Set("ETag", `"etag"`)
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			start, end := 0, len(obj.data)
+			var range_start, range_end int
+			n, _ := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &range_start, &range_end)
+			if n >= 1 {
+				start = range_start
+				if n == 2 {
+					end = range_end + 1
+				}
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, len(obj.data)))
+				w.Header().Set("Content-Length", fmt.Sprint(end-start))
+				w.WriteHeader(http.StatusPartialContent)
+			} else {
+				w.Header().Set("Content-Length", fmt.Sprint(len(obj.data)))
+			}
+			if r.Method == http.MethodGet {
+				_, _ = w.Write(obj.data[start:end])
+			}
+		}
+	})
+}
+
+func (c *testS3Cluster) startNode(t *testing.T) (*httptest.Server, *s3Endpoint, *atomic.Int32) {
+	requests := &atomic.Int32{}
+	server := httptest.NewTLSServer(c.handler(requests))
+	endpoint, err := newS3Endpoint(strings.TrimPrefix(server.URL, "https://"), &minio.Options{
+		Creds:      credentials.NewStaticV4("keyid", "secret", ""),
+		Secure:     true,
+		Region:     "us-east-1",
+		Transport:  server.Client().Transport,
+		MaxRetries: s3MaxRetries,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, endpoint, requests
+}
+
+func TestS3Failover(t *testing.T) {
+	api := getTestAPI(t)
+	ctx := context.Background()
+
+	cluster := &testS3Cluster{objects: map[string]testS3Object{}}
+	server_a, endpoint_a, requests_a := cluster.startNode(t)
+	defer server_a.Close()
+	server_b, endpoint_b, requests_b := cluster.startNode(t)
+	defer server_b.Close()
+
+	prev_endpoints, prev_storage := S3_ENDPOINTS, STORAGE
+	S3_ENDPOINTS = []*s3Endpoint{endpoint_a, endpoint_b}
+	STORAGE = S3Storage{}
+	defer func() { S3_ENDPOINTS, STORAGE = prev_endpoints, prev_storage }()
+
+	content := "0123456789"
+	err := PutObject(ctx, strings.NewReader(content), "video/1", int64(len(content)), map[string]string{"Mugenchecksum": "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests_a.Load() == 0 || requests_b.Load() != 0 {
+		t.Fatal("the first endpoint was not used")
+	}
+	stat, err := StatObject(ctx, "video/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size != int64(len(content)) || stat.UserMetadata["Mugenchecksum"] != "abc" {
+		t.Fatalf("unexpected object info: %+v", stat)
+	}
+	_, err = StatObject(ctx, "video/2")
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("unexpected error for a missing object: %v", err)
+	}
+
+	// the read continues on the other endpoint when the first one stops
+	obj, err := GetObject(ctx, "video/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Closer(obj)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(obj, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server_a.Close()
+	_, err = obj.Seek(6, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = io.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != content[6:] || requests_b.Load() == 0 {
+		t.Fatalf("unexpected content after failover %q", b)
+	}
+
+	// bodies that can't be rewound are not sent to another endpoint
+	requests := requests_b.Load()
+	err = PutObject(ctx, io.MultiReader(strings.NewReader(content)), "video/1", int64(len(content)), nil)
+	if !errors.Is(err, ErrS3NotRewindable) || requests_b.Load() != requests {
+		t.Fatalf("unexpected error for a body that can't be rewound: %v", err)
+	}
+	endpoint_b.mutex.Lock()
+	failures := endpoint_b.failures
+	endpoint_b.mutex.Unlock()
+	if failures != 0 {
+		t.Fatal("endpoint failure recorded for a body that can't be rewound")
+	}
+
+	// the stopped endpoint is skipped after a few failures
+	for range s3BreakerThreshold {
+		err = PutObject(ctx, strings.NewReader(content), "video/1", int64(len(content)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp := assertRespCode(t, api.Get("/api/storage/s3"), 200)
+	endpoints := S3EndpointsOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&endpoints.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints.Body.Endpoints) != 2 || endpoints.Body.Endpoints[0].Name != endpoint_b.Name || endpoints.Body.Endpoints[1].Available {
+		t.Fatalf("unexpected endpoints: %+v", endpoints.Body.Endpoints)
+	}
+
+	objects, err := STORAGE.List(ctx, "video/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 || objects[0].Key != "video/1" {
+		t.Fatalf("unexpected objects: %+v", objects)
+	}
+
+	// without any endpoint left requests fail
+	server_b.Close()
+	err = PutObject(ctx, strings.NewReader(content), "video/1", int64(len(content)), nil)
+	if err == nil {
+		t.Fatal("upload succeeded without endpoints")
+	}
+	probeS3Endpoints(ctx)
+}
+
+func findAuditIssue(report StorageAuditReport, key string) *StorageAuditIssue {
+	for _, issue := range report.Issues {
+		if issue.Key == key {
+			return &issue
+		}
+	}
+	return nil
+}
+
+func TestStorageAudit(t *testing.T) {
+	api := getTestAPI(t)
+	ctx := context.Background()
+	db := GetDB(ctx)
+
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev_storage := STORAGE
+	STORAGE = storage
+	defer func() { STORAGE = prev_storage }()
+
+	kara := createTestKara(t, api, map[string]any{"title": "kara_audit_test"})
+	other_kara := createTestKara(t, api, map[string]any{"title": "kara_audit_test_2"})
+	err = db.Model(&KaraInfoDB{}).Where("id = ?", kara.ID).
+		UpdateColumns(map[string]any{"video_uploaded": true, "video_size": 10}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Model(&KaraInfoDB{}).Where("id = ?", other_kara.ID).
+		UpdateColumns(map[string]any{"subtitles_uploaded": true}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	video_key := fmt.Sprintf("video/%d", kara.ID)
+	orphan_key := fmt.Sprintf("inst/%d", kara.ID)
+	recent_key := fmt.Sprintf("inst/%d", other_kara.ID)
+	missing_key := fmt.Sprintf("sub/%d", other_kara.ID)
+	for _, key := range []string{video_key, orphan_key, recent_key} {
+		err = PutObject(ctx, strings.NewReader("0123456789ab"), key, 12, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * auditOrphanMinAge)
+	err = os.Chtimes(filepath.Join(storage.Directory, "inst", fmt.Sprint(kara.ID)), old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := assertRespCode(t, api.Get("/api/storage/audit"), 200)
+	report := StorageAuditOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&report.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issue := findAuditIssue(report.Body, video_key); issue == nil || issue.Problem != AuditSizeMismatch || issue.Size != 12 || issue.ExpectedSize != 10 {
+		t.Fatalf("unexpected size mismatch: %+v", issue)
+	}
+	if issue := findAuditIssue(report.Body, orphan_key); issue == nil || issue.Problem != AuditOrphan || issue.KaraID != kara.ID {
+		t.Fatalf("unexpected orphan: %+v", issue)
+	}
+	if issue := findAuditIssue(report.Body, missing_key); issue == nil || issue.Problem != AuditMissing || issue.KaraID != other_kara.ID {
+		t.Fatalf("unexpected missing file: %+v", issue)
+	}
+	if issue := findAuditIssue(report.Body, recent_key); issue != nil {
+		t.Fatalf("recent upload reported: %+v", issue)
+	}
+
+	resp = assertRespCode(t, api.Post("/api/storage/audit/fix", map[string]any{}), 200)
+	err = json.NewDecoder(resp.Body).Decode(&report.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issue := findAuditIssue(report.Body, orphan_key); issue == nil || !issue.Fixed {
+		t.Fatalf("orphan not fixed: %+v", issue)
+	}
+	if issue := findAuditIssue(report.Body, video_key); issue == nil || issue.Fixed {
+		t.Fatalf("size mismatch fixed: %+v", issue)
+	}
+	_, err = StatObject(ctx, orphan_key)
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("orphan not deleted: %v", err)
+	}
+	_, err = StatObject(ctx, recent_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed_kara := KaraInfoDB{}
+	err = db.First(&fixed_kara, other_kara.ID).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fixed_kara.SubtitlesUploaded {
+		t.Fatal("upload flag of the missing file not cleared")
+	}
+
+	resp = assertRespCode(t, api.Get("/api/storage/audit"), 200)
+	err = json.NewDecoder(resp.Body).Decode(&report.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findAuditIssue(report.Body, orphan_key) != nil || findAuditIssue(report.Body, missing_key) != nil {
+		t.Fatalf("issues left after fix: %+v", report.Body.Issues)
+	}
+}
+
+func TestStorageScrub(t *testing.T) {
+	api := getTestAPI(t)
+	ctx := context.Background()
+	db := GetDB(ctx)
+
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev_storage := STORAGE
+	STORAGE = storage
+	defer func() { STORAGE = prev_storage }()
+
+	webhook := createTestWebhook(t, api, map[string]any{
+		"type":    "json",
+		"url":     "http://127.0.0.1:1/",
+		"events":  []string{"file_corrupted"},
+		"enabled": true,
+	})
+	defer func() { assertRespCode(t, api.Delete(fmt.Sprintf("/api/webhooks/%d", webhook.ID)), 204) }()
+
+	content := "[Script Info]\n"
+	kara := createTestKara(t, api, map[string]any{"title": "kara_scrub_test"})
+	err = db.Model(&KaraInfoDB{}).Where("id = ?", kara.ID).
+		UpdateColumns(map[string]any{
+			"subtitles_uploaded": true,
+			"subtitles_size":     len(content),
+			"subtitles_crc32":    crc32.ChecksumIEEE([]byte(content)),
+		}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := fmt.Sprintf("sub/%d", kara.ID)
+	err = PutObject(ctx, strings.NewReader(content), key, int64(len(content)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ScrubFiles(ctx, db, 1000, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrub := KaraFileScrub{}
+	err = db.Where(&KaraFileScrub{KaraID: kara.ID, FileType: "sub"}).First(&scrub).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scrub.Status != ScrubOK || scrub.Size != int64(len(content)) {
+		t.Fatalf("unexpected scrub of a valid file: %+v", scrub)
+	}
+
+	// verified files are skipped until the period is over
+	candidates, err := scrubCandidates(db, 1000, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range candidates {
+		if file.Kara.ID == kara.ID {
+			t.Fatal("file verified again before the period")
+		}
+	}
+
+	sub := EVENTS.Subscribe(0)
+	defer sub.Close()
+
+	// same size, different content
+	err = os.WriteFile(filepath.Join(storage.Directory, "sub", fmt.Sprint(kara.ID)), []byte("[Script Inf0]\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ScrubFiles(ctx, db, 1000, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the scrub job runs in the background
+	assertRespCode(t, api.Post("/api/storage/scrub", map[string]any{}), 202)
+	err = db.Where(&Job{Type: JobStorageScrub, Status: JobPending}).Delete(&Job{}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := assertRespCode(t, api.Get("/api/storage/scrub"), 200)
+	status := ScrubStatusOutput{}
+	err = json.NewDecoder(resp.Body).Decode(&status.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var corrupted *KaraFileScrub
+	for _, file := range status.Body.Files {
+		if file.KaraID == kara.ID {
+			corrupted = &file
+		}
+	}
+	if corrupted == nil || corrupted.Status != ScrubCorrupted || !strings.HasPrefix(corrupted.Error, "CRC32") || status.Body.Counts[ScrubCorrupted] == 0 {
+		t.Fatalf("unexpected scrub status: %+v", status.Body)
+	}
+
+	found := false
+	for !found {
+		select {
+		case event := <-sub.Events:
+			data, ok := event.Data.(FileEventData)
+			found = event.Type == EventFileCorrupted && ok && data.KaraID == kara.ID
+		default:
+			t.Fatal("no event for the corrupted file")
+		}
+	}
+
+	// other tests' files are verified too
+	kara_deliveries := func() int {
+		deliveries := []WebhookDelivery{}
+		err := db.Where(&WebhookDelivery{WebhookID: webhook.ID, Event: WebhookFileCorrupted}).Find(&deliveries).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, delivery := range deliveries {
+			if strings.Contains(delivery.Body, fmt.Sprintf("/karaoke/browse/%d\"", kara.ID)) {
+				n++
+			}
+		}
+		return n
+	}
+	if kara_deliveries() != 1 {
+		t.Fatal("corrupted file not reported")
+	}
+
+	// still corrupted, not reported again
+	err = ScrubFiles(ctx, db, 1000, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kara_deliveries() != 1 {
+		t.Fatal("corrupted file reported again")
+	}
+}
+
+func getTestKaraFileVersions(t *testing.T, api humatest.TestAPI, kara_id uint) []KaraFileVersion {
+	resp := assertRespCode(t, api.Get(fmt.Sprintf("/api/kara/%d/versions/sub", kara_id)), 200)
+	out := KaraFileVersionsOutput{}
+	err := json.NewDecoder(resp.Body).Decode(&out.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Body.Versions
+}
+
+func readTestKaraFile(t *testing.T, kara_id uint) string {
+	ctx := context.Background()
+	kara, err := GetKaraByID(GetDB(ctx), kara_id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := GetKaraObject(ctx, kara, "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Closer(obj)
+	content, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestKaraFileVersions(t *testing.T) {
+	api := getTestAPI(t)
+	ctx := context.Background()
+	db := GetDB(ctx)
+
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev_storage := STORAGE
+	STORAGE = storage
+	defer func() { STORAGE = prev_storage }()
+
+	// uploaded before versioning
+	legacy_content := "[Script Info]\nTitle: legacy\n"
+	kara := createTestKara(t, api, map[string]any{"title": "kara_versions_test"})
+	err = db.Model(&KaraInfoDB{}).Where("id = ?", kara.ID).
+		UpdateColumns(map[string]any{
+			"subtitles_uploaded": true,
+			"subtitles_size":     len(legacy_content),
+			"subtitles_crc32":    crc32.ChecksumIEEE([]byte(legacy_content)),
+		}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy_key := fmt.Sprintf("sub/%d", kara.ID)
+	err = PutObject(ctx, strings.NewReader(legacy_content), legacy_key, int64(len(legacy_content)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(getTestKaraFileVersions(t, api, kara.ID)) != 0 {
+		t.Fatal("unexpected versions before the first upload")
+	}
+
+	content := "[Script Info]\nTitle: new\n"
+	path := fmt.Sprintf("/api/kara/%d", kara.ID)
+	assertRespCode(t, api.Put(path+"/upload/sub", "Content-Type: application/octet-stream", "Filename: new.ass", strings.NewReader(content)), 200)
+
+	versions := getTestKaraFileVersions(t, api, kara.ID)
+	if len(versions) != 2 {
+		t.Fatalf("unexpected versions: %+v", versions)
+	}
+	current, legacy := versions[0], versions[1]
+	if !current.Current || current.Size != int64(len(content)) || current.UploaderID == nil || *current.UploaderID != "test_user" || !current.CheckPassed {
+		t.Fatalf("unexpected current version: %+v", current)
+	}
+	if legacy.Current || legacy.Size != int64(len(legacy_content)) || legacy.CRC32 != crc32.ChecksumIEEE([]byte(legacy_content)) {
+		t.Fatalf("unexpected legacy version: %+v", legacy)
+	}
+	if readTestKaraFile(t, kara.ID) != content {
+		t.Fatal("uploaded file is not the current one")
+	}
+
+	assertRespCode(t, api.Post(fmt.Sprintf("%s/versions/sub/%d/promote", path, legacy.ID), map[string]any{}), 200)
+	updated, err := GetKaraByID(db, kara.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.SubtitlesVersionID != 0 || updated.SubtitlesCRC32 != legacy.CRC32 || readTestKaraFile(t, kara.ID) != legacy_content {
+		t.Fatalf("legacy version not promoted: %+v", updated.UploadInfo)
+	}
+	versions = getTestKaraFileVersions(t, api, kara.ID)
+	if versions[0].Current || !versions[1].Current {
+		t.Fatalf("unexpected versions: %+v", versions)
+	}
+
+	assertRespCode(t, api.Post(fmt.Sprintf("%s/versions/sub/%d/promote", path, current.ID), map[string]any{}), 200)
+	if readTestKaraFile(t, kara.ID) != content {
+		t.Fatal("version not promoted")
+	}
+	other_kara := createTestKara(t, api, map[string]any{"title": "kara_versions_other_test"})
+	assertRespCode(t, api.Post(fmt.Sprintf("/api/kara/%d/versions/sub/%d/promote", other_kara.ID, current.ID), map[string]any{}), 404)
+
+	// previous versions aren't orphans
+	report, err := AuditStorage(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, issue := range report.Issues {
+		if issue.KaraID == kara.ID {
+			t.Fatalf("unexpected audit issue: %+v", issue)
+		}
+	}
+
+	// the oldest versions above the limit are deleted
+	prev_max_versions := CONFIG.Storage.MaxVersions
+	CONFIG.Storage.MaxVersions = 2
+	defer func() { CONFIG.Storage.MaxVersions = prev_max_versions }()
+	latest_content := "[Script Info]\nTitle: latest\n"
+	assertRespCode(t, api.Put(path+"/upload/sub", "Content-Type: application/octet-stream", "Filename: latest.ass", strings.NewReader(latest_content)), 200)
+	versions = getTestKaraFileVersions(t, api, kara.ID)
+	if len(versions) != 2 || !versions[0].Current || versions[1].ID != current.ID {
+		t.Fatalf("unexpected versions after pruning: %+v", versions)
+	}
+	_, err = StatObject(ctx, legacy_key)
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("pruned version not deleted: %v", err)
+	}
+
+	// deleting the file deletes its current version
+	assertRespCode(t, api.Delete(path+"/sub"), 200)
+	updated, err = GetKaraByID(db, kara.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.SubtitlesUploaded || updated.SubtitlesVersionID != 0 {
+		t.Fatalf("deleted version still referenced: %+v", updated.UploadInfo)
+	}
+	versions = getTestKaraFileVersions(t, api, kara.ID)
+	if len(versions) != 1 || versions[0].ID != current.ID || versions[0].Current {
+		t.Fatalf("unexpected versions after a deletion: %+v", versions)
+	}
+}
@@ -96,6 +96,24 @@ type KaraberusS3Config struct {
 	BucketName string   `envkey:"BUCKET_NAME" default:"karaberus"`
 }
 
+type KaraberusStorageConfig struct {
+	// s3 or local
+	Backend string `envkey:"BACKEND" default:"s3"`
+	// files directory of the local backend
+	Directory string `envkey:"DIR"`
+	// versions kept of each file of a kara, 0 to keep them all
+	MaxVersions int `envkey:"MAX_VERSIONS" default:"10"`
+}
+
+type KaraberusScrubConfig struct {
+	// files verified by the scrub job, it is enqueued again an hour after it finished
+	BatchSize int `envkey:"BATCH_SIZE" default:"50"`
+	// in MiB/s, 0 to read files as fast as possible
+	RateLimit int `envkey:"RATE_LIMIT" default:"10"`
+	// days before a file is verified again
+	Period int `envkey:"PERIOD" default:"30"`
+}
+
 type KaraberusDBConfig struct {
 	Driver string `envkey:"DRIVER" default:"sqlite"`
 	DSN    string `envkey:"DSN" default:"user=karaberus password=karaberus dbname=karaberus port=5123 sslmode=disable TimeZone=UTC"`
@@ -108,14 +126,19 @@ type KaraberusDakaraConfig struct {
 }
 
 type KaraberusConfig struct {
-	S3        KaraberusS3Config     `env_prefix:"S3"`
-	OIDC      KaraberusOIDCConfig   `env_prefix:"OIDC"`
-	Listen    KaraberusListenConfig `env_prefix:"LISTEN"`
-	DB        KaraberusDBConfig     `env_prefix:"DB"`
-	Dakara    KaraberusDakaraConfig `env_prefix:"DAKARA"`
-	Mugen     KaraberusMugenConfig  `env_prefix:"MUGEN"`
-	UIDistDir string                `envkey:"UI_DIST_DIR" default:"/usr/share/karaberus/ui_dist"`
-	Webhooks  []string              `envkey:"WEBHOOKS" separator:" " example:"discord=<url1> discord=<url2> json=<url3>"`
+	Storage   KaraberusStorageConfig `env_prefix:"STORAGE"`
+	Scrub     KaraberusScrubConfig   `env_prefix:"SCRUB"`
+	S3        KaraberusS3Config      `env_prefix:"S3"`
+	OIDC      KaraberusOIDCConfig    `env_prefix:"OIDC"`
+	Listen    KaraberusListenConfig  `env_prefix:"LISTEN"`
+	DB        KaraberusDBConfig      `env_prefix:"DB"`
+	Dakara    KaraberusDakaraConfig  `env_prefix:"DAKARA"`
+	Mugen     KaraberusMugenConfig   `env_prefix:"MUGEN"`
+	UIDistDir string                 `envkey:"UI_DIST_DIR" default:"/usr/share/karaberus/ui_dist"`
+	// imported on the first start, webhooks are then managed through the API
+	Webhooks []string `envkey:"WEBHOOKS" separator:" " example:"discord=<url1> discord=<url2> json=<url3>"`
+	// key of the X-Karaberus-Signature header of the imported webhooks
+	WebhooksSecret string `envkey:"WEBHOOKS_SECRET"`
 }
 
 func getEnvDefault(name string, defaultValue string) string {
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"html"
+	"strings"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Lyrics extracted from the subtitles of a kara
+type KaraLyrics struct {
+	KaraID    uint      `gorm:"primarykey" json:"kara_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Lyrics    string    `json:"lyrics"`
+}
+
+var lyricsHighlightStart = "<mark>"
+var lyricsHighlightStop = "</mark>"
+
+// Markers of the matches in the snippets from the database, they are replaced
+// by the highlight tags once the lyrics are escaped.
+var lyricsMatchStart = "\x02"
+var lyricsMatchStop = "\x03"
+
+// Create the full-text index on the lyrics
+//
+// sqlite uses a FTS5 table with the kara ID as rowid which is updated by
+// setKaraLyrics, postgres uses a generated tsvector column.
+func initLyricsIndex(db *gorm.DB) {
+	var stmts []string
+	switch db.Dialector.Name() {
+	case "sqlite":
+		stmts = []string{
+			"CREATE VIRTUAL TABLE IF NOT EXISTS kara_lyrics_fts USING fts5(lyrics, tokenize = 'unicode61 remove_diacritics 2')",
+		}
+	case "postgres":
+		stmts = []string{
+			"ALTER TABLE kara_lyrics ADD COLUMN IF NOT EXISTS lyrics_tsv tsvector GENERATED ALWAYS AS (to_tsvector('simple', lyrics)) STORED",
+			"CREATE INDEX IF NOT EXISTS idx_kara_lyrics_tsv ON kara_lyrics USING GIN (lyrics_tsv)",
+		}
+	default:
+		panic("unknown db driver " + db.Dialector.Name())
+	}
+
+	for _, stmt := range stmts {
+		err := db.Exec(stmt).Error
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func setKaraLyrics(tx *gorm.DB, kara_id uint, lyrics string) error {
+	// reserved for the matches of the snippets
+	lyrics = strings.NewReplacer(lyricsMatchStart, "", lyricsMatchStop, "").Replace(lyrics)
+	kara_lyrics := KaraLyrics{KaraID: kara_id, Lyrics: lyrics}
+	err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&kara_lyrics).Error
+	if err != nil {
+		return err
+	}
+
+	if tx.Dialector.Name() == "sqlite" {
+		err = tx.Exec("DELETE FROM kara_lyrics_fts WHERE rowid = ?", kara_id).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Exec("INSERT INTO kara_lyrics_fts (rowid, lyrics) VALUES (?, ?)", kara_id, lyrics).Error
+	}
+	return err
+}
+
+func deleteKaraLyrics(tx *gorm.DB, kara_id uint) error {
+	err := tx.Delete(&KaraLyrics{}, kara_id).Error
+	if err != nil {
+		return err
+	}
+
+	if tx.Dialector.Name() == "sqlite" {
+		err = tx.Exec("DELETE FROM kara_lyrics_fts WHERE rowid = ?", kara_id).Error
+	}
+	return err
+}
+
+// Quote every term of the user input so it can't be interpreted as FTS5
+// query syntax.
+func fts5Query(query string) string {
+	terms := strings.Fields(query)
+	for i, term := range terms {
+		terms[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+	}
+	return strings.Join(terms, " ")
+}
+
+type lyricsMatch struct {
+	KaraID  uint
+	Snippet string
+}
+
+func searchLyrics(tx *gorm.DB, query string, limit int) ([]lyricsMatch, error) {
+	matches := []lyricsMatch{}
+
+	var err error
+	switch tx.Dialector.Name() {
+	case "sqlite":
+		err = tx.Raw(
+			`SELECT kara_lyrics_fts.rowid AS kara_id,
+				snippet(kara_lyrics_fts, 0, ?, ?, '…', 16) AS snippet
+			FROM kara_lyrics_fts
+			JOIN kara_info_dbs ON kara_info_dbs.id = kara_lyrics_fts.rowid
+			WHERE kara_lyrics_fts MATCH ?
+				AND kara_info_dbs.deleted_at IS NULL
+				AND kara_info_dbs.current_kara_info_id IS NULL
+			ORDER BY rank
+			LIMIT ?`,
+			lyricsMatchStart, lyricsMatchStop, fts5Query(query), limit,
+		).Scan(&matches).Error
+	case "postgres":
+		err = tx.Raw(
+			`SELECT kara_lyrics.kara_id AS kara_id,
+				ts_headline('simple', kara_lyrics.lyrics, q,
+					'StartSel=' || ? || ', StopSel=' || ? || ', MaxFragments=2') AS snippet
+			FROM kara_lyrics
+			JOIN kara_info_dbs ON kara_info_dbs.id = kara_lyrics.kara_id,
+				websearch_to_tsquery('simple', ?) q
+			WHERE kara_lyrics.lyrics_tsv @@ q
+				AND kara_info_dbs.deleted_at IS NULL
+				AND kara_info_dbs.current_kara_info_id IS NULL
+			ORDER BY ts_rank(kara_lyrics.lyrics_tsv, q) DESC
+			LIMIT ?`,
+			lyricsMatchStart, lyricsMatchStop, query, limit,
+		).Scan(&matches).Error
+	default:
+		err = errors.New("unknown db driver " + tx.Dialector.Name())
+	}
+
+	for i := range matches {
+		matches[i].Snippet = highlightSnippet(matches[i].Snippet)
+	}
+	return matches, err
+}
+
+// Escape the lyrics of a snippet, they can contain HTML, and highlight the
+// matches
+func highlightSnippet(snippet string) string {
+	return strings.NewReplacer(
+		lyricsMatchStart, lyricsHighlightStart,
+		lyricsMatchStop, lyricsHighlightStop,
+	).Replace(html.EscapeString(snippet))
+}
+
+type SearchLyricsInput struct {
+	Query string `query:"q" required:"true" minLength:"1" example:"zankoku na tenshi"`
+	Limit int    `query:"limit" default:"50" minimum:"1" maximum:"500"`
+}
+
+type LyricsSearchResult struct {
+	Kara KaraInfoDB `json:"kara"`
+	// part of the lyrics matching the query, matches are surrounded by <mark></mark>
+	Snippet string `json:"snippet"`
+}
+
+type SearchLyricsOutput struct {
+	Body struct {
+		Results []LyricsSearchResult `json:"results"`
+	}
+}
+
+func SearchLyrics(ctx context.Context, input *SearchLyricsInput) (*SearchLyricsOutput, error) {
+	db := GetDB(ctx)
+	out := &SearchLyricsOutput{}
+	out.Body.Results = []LyricsSearchResult{}
+
+	if strings.TrimSpace(input.Query) == "" {
+		return nil, huma.Error422UnprocessableEntity("empty query")
+	}
+
+	matches, err := searchLyrics(db, input.Query, input.Limit)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return out, nil
+	}
+
+	ids := make([]uint, len(matches))
+	for i, match := range matches {
+		ids[i] = match.KaraID
+	}
+
+	karas := []KaraInfoDB{}
+	err = db.Scopes(KaraAssociations, CurrentKaras).Find(&karas, ids).Error
+	if err != nil {
+		return nil, err
+	}
+	karas_by_id := make(map[uint]KaraInfoDB, len(karas))
+	for _, kara := range karas {
+		karas_by_id[kara.ID] = kara
+	}
+
+	// keep the ranking order
+	for _, match := range matches {
+		kara, ok := karas_by_id[match.KaraID]
+		if !ok {
+			continue
+		}
+		out.Body.Results = append(out.Body.Results, LyricsSearchResult{kara, match.Snippet})
+	}
+
+	return out, nil
+}
+
+// Extract the lyrics of every kara with uploaded subtitles and store them
+func BackfillLyrics(ctx context.Context, db *gorm.DB) error {
+	karas := []KaraInfoDB{}
+	err := db.Scopes(CurrentKaras).Where("subtitles_uploaded").Find(&karas).Error
+	if err != nil {
+		return err
+	}
+
+	getLogger().Printf("indexing lyrics of %d karaokes", len(karas))
+	for _, kara := range karas {
+		lyrics, err := GetKaraLyrics(ctx, kara)
+		if err != nil {
+			getLogger().Printf("failed to extract lyrics of kara %d: %s", kara.ID, err)
+			continue
+		}
+		err = setKaraLyrics(db, kara.ID, lyrics)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
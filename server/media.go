@@ -2,6 +2,7 @@ package server
 
 import (
 	"context"
+	"errors"
 
 	"gorm.io/gorm"
 )
@@ -17,6 +18,7 @@ type CreateMediaInput struct {
 }
 
 type MediaOutput struct {
+	ETag string `header:"ETag"`
 	Body struct {
 		Media MediaDB `json:"media"`
 	}
@@ -47,7 +49,7 @@ func getMediaByID(tx *gorm.DB, Id uint) (MediaDB, error) {
 // }
 
 func createMedia(db *gorm.DB, media *MediaDB, info *MediaInfo) error {
-	return db.Transaction(func(tx *gorm.DB) error {
+	return transaction(db, func(tx *gorm.DB) error {
 		if err := info.to_MediaDB(media); err != nil {
 			return err
 		}
@@ -60,7 +62,7 @@ func CreateMedia(ctx context.Context, input *CreateMediaInput) (*MediaOutput, er
 	db := GetDB(ctx)
 	output := MediaOutput{}
 
-	err := db.Transaction(func(tx *gorm.DB) error {
+	err := transaction(db, func(tx *gorm.DB) error {
 		media := MediaDB{}
 		if err := createMedia(tx, &media, &input.Body); err != nil {
 			return err
@@ -72,9 +74,19 @@ func CreateMedia(ctx context.Context, input *CreateMediaInput) (*MediaOutput, er
 	return &output, err
 }
 
+// MediaInfo with every field optional, used as a JSON Merge Patch
+type MediaInfoPatch struct {
+	Name            *string  `json:"name,omitempty" nullable:"true" example:"Shinseiki Evangelion"`
+	MediaType       *string  `json:"media_type,omitempty" enum:"ANIME,GAME,LIVE,CARTOON" example:"ANIME"`
+	AdditionalNames []string `json:"additional_names,omitempty" example:"[]"`
+}
+
+// Only the fields of the body are updated (JSON Merge Patch, RFC 7396)
 type UpdateMediaInput struct {
-	Id   uint `path:"id"`
-	Body MediaInfo
+	Id      uint   `path:"id"`
+	IfMatch string `header:"If-Match" doc:"ETag of the version the edit is based on"`
+	Body    MediaInfoPatch
+	RawBody []byte
 }
 
 func updateMedia(tx *gorm.DB, media *MediaDB) error {
@@ -94,29 +106,59 @@ func updateMedia(tx *gorm.DB, media *MediaDB) error {
 
 func UpdateMedia(ctx context.Context, input *UpdateMediaInput) (*MediaOutput, error) {
 	db := GetDB(ctx)
-	media := MediaDB{}
-	err := db.First(&media, input.Id).Error
-	if err != nil {
-		return nil, err
-	}
-	err = input.Body.to_MediaDB(&media)
-	if err != nil {
-		return nil, err
-	}
+	out := &MediaOutput{}
+
+	err := transaction(db, func(tx *gorm.DB) error {
+		media := &out.Body.Media
+		err := tx.Scopes(CurrentMedias).Preload("AdditionalNames").First(media, input.Id).Error
+		if err != nil {
+			return err
+		}
+
+		err = checkIfMatch(input.IfMatch, media.Revision)
+		if err != nil {
+			return err
+		}
+
+		info, err := mergePatchInfo(mediaInfoFromDB(*media), input.RawBody)
+		if err != nil {
+			return err
+		}
+		err = info.to_MediaDB(media)
+		if err != nil {
+			return err
+		}
 
-	err = db.Transaction(func(tx *gorm.DB) error {
-		return updateMedia(tx, &media)
+		err = updateMedia(WithRevisionCheck(tx), media)
+		if err != nil {
+			return err
+		}
+		out.ETag = revisionETag(media.Revision)
+		return nil
 	})
+	if errors.Is(err, ErrStaleRevision) {
+		current := MediaDB{}
+		err = db.Scopes(CurrentMedias).Preload("AdditionalNames").First(&current, input.Id).Error
+		if err != nil {
+			return nil, DBErrToHumaErr(err)
+		}
+		return nil, revisionConflict(current.Revision, current)
+	}
 	if err != nil {
-		return nil, err
+		return nil, DBErrToHumaErr(err)
 	}
 
-	out := &MediaOutput{}
-	out.Body.Media = media
-
 	return out, nil
 }
 
+func mediaInfoFromDB(media MediaDB) MediaInfo {
+	info := MediaInfo{Name: media.Name, MediaType: media.Type, AdditionalNames: make([]string, len(media.AdditionalNames))}
+	for i, name := range media.AdditionalNames {
+		info.AdditionalNames[i] = name.Name
+	}
+	return info
+}
+
 func (info MediaInfo) to_MediaDB(media *MediaDB) error {
 	media.Name = info.Name
 	media.Type = getMediaType(info.MediaType).ID
@@ -124,6 +166,67 @@ func (info MediaInfo) to_MediaDB(media *MediaDB) error {
 	return nil
 }
 
+type RevertMediaInput struct {
+	Id        uint `path:"id"`
+	HistoryId uint `path:"history_id"`
+}
+
+func RevertMedia(ctx context.Context, input *RevertMediaInput) (*MediaOutput, error) {
+	db := GetDB(ctx)
+	out := &MediaOutput{}
+
+	err := transaction(db, func(tx *gorm.DB) error {
+		media, err := getMediaByID(tx, input.Id)
+		if err != nil {
+			return err
+		}
+		historic := MediaDB{}
+		err = tx.Preload("AdditionalNames").
+			Where(&MediaDB{CurrentMediaID: &input.Id}).
+			First(&historic, input.HistoryId).Error
+		if err != nil {
+			return DBErrToHumaErr(err)
+		}
+
+		media.Name = historic.Name
+		media.Type = historic.Type
+		media.AdditionalNames = historic.AdditionalNames
+		err = updateMedia(tx, &media)
+		out.Body.Media = media
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+type MediaHistoryOutput struct {
+	CacheHeaders
+	Status int
+	Body   struct {
+		History []MediaDB `json:"history"`
+	}
+}
+
+func GetMediaHistory(ctx context.Context, input *GetMediaConditionalInput) (*MediaHistoryOutput, error) {
+	out := &MediaHistoryOutput{}
+	db := GetDB(ctx)
+	err := db.Preload("AdditionalNames").Where(&MediaDB{CurrentMediaID: &input.Id}).Find(&out.Body.History).Error
+	if err != nil {
+		return nil, err
+	}
+
+	out.CacheHeaders = historyValidators(out.Body.History, func(m MediaDB) gorm.Model { return m.Model })
+	if input.notModified(out.CacheHeaders) {
+		out.Status = 304
+	} else {
+		out.Status = 200
+	}
+	return out, nil
+}
+
 type DeleteMediaResponse struct {
 	Status int
 }
@@ -134,15 +237,47 @@ type GetMediaInput struct {
 
 func DeleteMedia(ctx context.Context, input *GetMediaInput) (*DeleteMediaResponse, error) {
 	db := GetDB(ctx)
-	err := db.Scopes(CurrentMedias).Delete(&MediaDB{}, input.Id).Error
+	media := MediaDB{}
+	err := db.Scopes(CurrentMedias).First(&media, input.Id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &DeleteMediaResponse{204}, nil
+	}
+	if err == nil {
+		// delete the loaded media so its hooks know which one it is
+		err = db.Delete(&media).Error
+	}
 	return &DeleteMediaResponse{204}, DBErrToHumaErr(err)
 }
 
-func GetMedia(ctx context.Context, input *GetMediaInput) (*MediaOutput, error) {
+type GetMediaConditionalInput struct {
+	Id uint `path:"id" example:"1"`
+	ConditionalGetInput
+}
+
+type GetMediaOutput struct {
+	CacheHeaders
+	Status int
+	Body   struct {
+		Media MediaDB `json:"media"`
+	}
+}
+
+func GetMedia(ctx context.Context, input *GetMediaConditionalInput) (*GetMediaOutput, error) {
 	db := GetDB(ctx)
-	media_output := &MediaOutput{}
-	err := db.Scopes(CurrentMedias).First(&media_output.Body.Media, input.Id).Error
-	return media_output, DBErrToHumaErr(err)
+	media_output := &GetMediaOutput{}
+	media := &media_output.Body.Media
+	err := db.Scopes(CurrentMedias).First(media, input.Id).Error
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	media_output.setValidators(revisionETag(media.Revision), media.UpdatedAt)
+	if input.notModified(media_output.CacheHeaders) {
+		media_output.Status = 304
+	} else {
+		media_output.Status = 200
+	}
+	return media_output, nil
 }
 
 type FindMediaInput struct {
@@ -151,6 +286,11 @@ type FindMediaInput struct {
 
 func findMedia(tx *gorm.DB, names []string, media *MediaDB) error {
 	err := tx.Scopes(CurrentMedias).Where("Name in ?", names).First(&media).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// names of merged duplicates are kept as additional names
+		ids := additionalNameOwners(tx, "media_additional_name", "media_db_id", names)
+		err = tx.Scopes(CurrentMedias).Where("id IN (?)", ids).First(&media).Error
+	}
 	return err
 }
 
@@ -161,11 +301,11 @@ func FindMedia(ctx context.Context, input *FindMediaInput) (*MediaOutput, error)
 }
 
 type AllMediasInput struct {
-	IfNoneMatch string `header:"If-None-Match"`
+	ConditionalGetInput
 }
 
 type AllMediasOutput struct {
-	ETag   string `header:"ETag"`
+	CacheHeaders
 	Status int
 	Body   []MediaDB `json:"medias"`
 }
@@ -174,14 +314,13 @@ func GetAllMedias(ctx context.Context, input *AllMediasInput) (*AllMediasOutput,
 	out := &AllMediasOutput{}
 	db := GetDB(ctx)
 
-	last_media := MediaDB{}
-	err := db.Last(&last_media).Error
-	err = setETag(last_media.ID, err, &out.ETag)
+	var err error
+	out.CacheHeaders, err = tablesValidators(db, &MediaDB{})
 	if err != nil {
 		return nil, err
 	}
 
-	if out.ETag == input.IfNoneMatch {
+	if input.notModified(out.CacheHeaders) {
 		out.Status = 304
 	} else {
 		out.Status = 200
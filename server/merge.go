@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"github.com/danielgtaylor/huma/v2"
+	"gorm.io/gorm"
+)
+
+// Additional names of the target with the names of the merged duplicate
+// appended, names already known for the target are skipped.
+func mergeAdditionalNames(target_name string, target_names []AdditionalName, source_name string, source_names []AdditionalName) []AdditionalName {
+	names := append([]AdditionalName{}, target_names...)
+
+	known := map[string]bool{strings.ToLower(target_name): true}
+	for _, name := range target_names {
+		known[strings.ToLower(name.Name)] = true
+	}
+
+	new_names := []string{source_name}
+	for _, name := range source_names {
+		new_names = append(new_names, name.Name)
+	}
+	for _, name := range new_names {
+		key := strings.ToLower(trimWhitespace(name))
+		if key == "" || known[key] {
+			continue
+		}
+		known[key] = true
+		names = append(names, AdditionalName{Name: name})
+	}
+
+	return names
+}
+
+// subquery on a many2many table of additional names for the owners having one of the names
+func additionalNameOwners(tx *gorm.DB, table string, column string, names []string) *gorm.DB {
+	return tx.Session(&gorm.Session{NewDB: true}).
+		Table(table).
+		Select(table+"."+column).
+		Joins("JOIN additional_names ON additional_names.id = "+table+".additional_name_id").
+		Where("additional_names.name IN ?", names)
+}
+
+// Replace the source with the target in tags, the target is not added twice
+func replaceMergedTag[T any](tags []T, id func(T) uint, source_id uint, target T) []T {
+	replaced := []T{}
+	has_target := false
+	for _, tag := range tags {
+		if id(tag) == source_id || id(tag) == id(target) {
+			if !has_target {
+				replaced = append(replaced, target)
+				has_target = true
+			}
+			continue
+		}
+		replaced = append(replaced, tag)
+	}
+	return replaced
+}
+
+// Save the artists and medias of a kara after a merge.
+// The previous version is kept in the history, unlike updateKara this does
+// not disable the metadata import of Mugen karas, the merged names are
+// matched by getMugenArtist and getMugenMedia.
+func saveMergedKara(tx *gorm.DB, kara *KaraInfoDB) error {
+	err := tx.Model(kara).Select("SourceMediaID", "EditorUserID", "UpdatedAt").Updates(kara).Error
+	if err != nil {
+		return err
+	}
+	prev_context := tx.Statement.Context
+	tx = WithAssociationsUpdate(tx)
+	defer tx.WithContext(prev_context)
+	err = tx.Model(kara).Association("Artists").Replace(&kara.Artists)
+	if err != nil {
+		return err
+	}
+	return tx.Model(kara).Association("Medias").Replace(&kara.Medias)
+}
+
+// Only current karas are updated, historic entries and deleted karas keep
+// the merged duplicate which points to the target with MergedIntoID.
+func mergeArtists(tx *gorm.DB, target *Artist, source *Artist) error {
+	target.AdditionalNames = mergeAdditionalNames(target.Name, target.AdditionalNames, source.Name, source.AdditionalNames)
+	err := updateArtist(tx, target)
+	if err != nil {
+		return err
+	}
+
+	target_tag := *target
+	target_tag.AdditionalNames = nil
+
+	karas := []KaraInfoDB{}
+	err = tx.Scopes(KaraAssociations, CurrentKaras, KarasWithArtist(source.ID)).Find(&karas).Error
+	if err != nil {
+		return err
+	}
+	for i := range karas {
+		kara := &karas[i]
+		kara.Artists = replaceMergedTag(kara.Artists, func(a Artist) uint { return a.ID }, source.ID, target_tag)
+		err = saveMergedKara(tx, kara)
+		if err != nil {
+			return err
+		}
+	}
+
+	source.MergedIntoID = &target.ID
+	err = tx.Model(source).Select("MergedIntoID").Updates(source).Error
+	if err != nil {
+		return err
+	}
+	return tx.Delete(source).Error
+}
+
+func mergeMedias(tx *gorm.DB, target *MediaDB, source *MediaDB) error {
+	target.AdditionalNames = mergeAdditionalNames(target.Name, target.AdditionalNames, source.Name, source.AdditionalNames)
+	err := updateMedia(tx, target)
+	if err != nil {
+		return err
+	}
+
+	target_tag := *target
+	target_tag.AdditionalNames = nil
+
+	karas := []KaraInfoDB{}
+	err = tx.Scopes(KaraAssociations, CurrentKaras, KarasWithMedia(source.ID)).Find(&karas).Error
+	if err != nil {
+		return err
+	}
+	for i := range karas {
+		kara := &karas[i]
+		if kara.SourceMediaID != nil && *kara.SourceMediaID == source.ID {
+			kara.SourceMediaID = &target.ID
+			kara.SourceMedia = &target_tag
+		}
+		kara.Medias = replaceMergedTag(kara.Medias, func(m MediaDB) uint { return m.ID }, source.ID, target_tag)
+		err = saveMergedKara(tx, kara)
+		if err != nil {
+			return err
+		}
+	}
+
+	source.MergedIntoID = &target.ID
+	err = tx.Model(source).Select("MergedIntoID").Updates(source).Error
+	if err != nil {
+		return err
+	}
+	return tx.Delete(source).Error
+}
+
+type MergeInput struct {
+	Id   uint `path:"id" doc:"ID of the kept artist or media"`
+	Body struct {
+		Source uint `json:"source" doc:"ID of the duplicate merged into the target"`
+	}
+}
+
+func MergeArtist(ctx context.Context, input *MergeInput) (*ArtistOutput, error) {
+	db := GetDB(ctx)
+	out := &ArtistOutput{}
+
+	if input.Id == input.Body.Source {
+		return nil, huma.Error422UnprocessableEntity("can't merge an artist into itself")
+	}
+
+	err := transaction(db, func(tx *gorm.DB) error {
+		target := &out.Body.Artist
+		err := tx.Scopes(CurrentArtists).Preload("AdditionalNames").First(target, input.Id).Error
+		if err != nil {
+			return err
+		}
+		source := &Artist{}
+		err = tx.Scopes(CurrentArtists).Preload("AdditionalNames").First(source, input.Body.Source).Error
+		if err != nil {
+			return err
+		}
+
+		err = mergeArtists(tx, target, source)
+		if err != nil {
+			return err
+		}
+
+		return SyncDakaraNotify(tx)
+	})
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	return out, nil
+}
+
+func MergeMedia(ctx context.Context, input *MergeInput) (*MediaOutput, error) {
+	db := GetDB(ctx)
+	out := &MediaOutput{}
+
+	if input.Id == input.Body.Source {
+		return nil, huma.Error422UnprocessableEntity("can't merge a media into itself")
+	}
+
+	err := transaction(db, func(tx *gorm.DB) error {
+		target := &out.Body.Media
+		err := tx.Scopes(CurrentMedias).Preload("AdditionalNames").First(target, input.Id).Error
+		if err != nil {
+			return err
+		}
+		source := &MediaDB{}
+		err = tx.Scopes(CurrentMedias).Preload("AdditionalNames").First(source, input.Body.Source).Error
+		if err != nil {
+			return err
+		}
+
+		err = mergeMedias(tx, target, source)
+		if err != nil {
+			return err
+		}
+
+		return SyncDakaraNotify(tx)
+	})
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	return out, nil
+}
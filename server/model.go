@@ -101,6 +101,18 @@ func (name *TimingAuthor) BeforeSave(tx *gorm.DB) error {
 	return nil
 }
 
+func (name *TimingAuthor) AfterCreate(tx *gorm.DB) error {
+	return logChange(tx, "author", name.ID, ChangeCreated, 0)
+}
+
+func (name *TimingAuthor) AfterUpdate(tx *gorm.DB) error {
+	return logChange(tx, "author", name.ID, ChangeUpdated, 0)
+}
+
+func (name *TimingAuthor) AfterDelete(tx *gorm.DB) error {
+	return logChange(tx, "author", name.ID, ChangeDeleted, 0)
+}
+
 type Scopes struct {
 	Kara   bool `json:"kara"`
 	KaraRO bool `json:"kara_ro"`
@@ -146,6 +158,10 @@ type Artist struct {
 	AdditionalNames []AdditionalName `gorm:"many2many:artists_additional_name"`
 	CurrentArtistID *uint
 	CurrentArtist   *Artist
+	// incremented on each update, historic entries keep their revision
+	Revision uint `gorm:"not null;default:1"`
+	// set on deleted duplicates merged into another artist
+	MergedIntoID *uint
 	Editor
 }
 
@@ -153,9 +169,30 @@ func CurrentArtists(tx *gorm.DB) *gorm.DB {
 	return tx.Where("current_artist_id IS NULL")
 }
 
+// the current version is also saved when its historic entry is created
+func (a *Artist) AfterCreate(tx *gorm.DB) error {
+	if a.CurrentArtist == nil && a.CurrentArtistID == nil && a.Revision <= 1 {
+		return logChange(tx, "artist", a.ID, ChangeCreated, 1)
+	}
+	return nil
+}
+
 func (a *Artist) AfterUpdate(tx *gorm.DB) error {
 	if a.CurrentArtistID == nil {
-		SyncDakaraNotify()
+		if !isAssociationsUpdate(tx) {
+			err := logChange(tx, "artist", a.ID, ChangeUpdated, a.Revision)
+			if err != nil {
+				return err
+			}
+		}
+		return SyncDakaraNotify(tx)
+	}
+	return nil
+}
+
+func (a *Artist) AfterDelete(tx *gorm.DB) error {
+	if a.CurrentArtistID == nil {
+		return logChange(tx, "artist", a.ID, ChangeDeleted, 0)
 	}
 	return nil
 }
@@ -165,7 +202,11 @@ func (a *Artist) BeforeUpdate(tx *gorm.DB) error {
 		return nil
 	}
 	orig_artist := &Artist{}
-	err := tx.First(orig_artist, a.ID).Error
+	err := lockForUpdate(tx).Preload("AdditionalNames").First(orig_artist, a.ID).Error
+	if err != nil {
+		return err
+	}
+	err = checkRevision(tx, &a.Revision, orig_artist.Revision)
 	if err != nil {
 		return err
 	}
@@ -190,10 +231,12 @@ func getCurrentUserNilable(tx *gorm.DB) *User {
 func (a *Artist) BeforeSave(tx *gorm.DB) error {
 	a.Name = trimWhitespace(a.Name)
 
-	// set editor for this new update
-	a.EditorUser = getCurrentUserNilable(tx)
-	if a.EditorUser == nil {
-		a.EditorUserID = nil
+	// set editor for this new update, historic entries keep their editor
+	if a.CurrentArtist == nil && a.CurrentArtistID == nil {
+		a.EditorUser = getCurrentUserNilable(tx)
+		if a.EditorUser == nil {
+			a.EditorUserID = nil
+		}
 	}
 	return nil
 }
@@ -213,6 +256,10 @@ type MediaDB struct {
 	AdditionalNames []AdditionalName `json:"additional_name" gorm:"many2many:media_additional_name"`
 	CurrentMediaID  *uint
 	CurrentMedia    *MediaDB
+	// incremented on each update, historic entries keep their revision
+	Revision uint `json:"revision" gorm:"not null;default:1"`
+	// set on deleted duplicates merged into another media
+	MergedIntoID *uint `json:"merged_into_id"`
 	Editor
 }
 
@@ -224,9 +271,30 @@ func CurrentMedias(tx *gorm.DB) *gorm.DB {
 	return tx.Where("current_media_id IS NULL")
 }
 
+// the current version is also saved when its historic entry is created
+func (m *MediaDB) AfterCreate(tx *gorm.DB) error {
+	if m.CurrentMedia == nil && m.CurrentMediaID == nil && m.Revision <= 1 {
+		return logChange(tx, "media", m.ID, ChangeCreated, 1)
+	}
+	return nil
+}
+
 func (m *MediaDB) AfterUpdate(tx *gorm.DB) error {
 	if m.CurrentMediaID == nil {
-		SyncDakaraNotify()
+		if !isAssociationsUpdate(tx) {
+			err := logChange(tx, "media", m.ID, ChangeUpdated, m.Revision)
+			if err != nil {
+				return err
+			}
+		}
+		return SyncDakaraNotify(tx)
+	}
+	return nil
+}
+
+func (m *MediaDB) AfterDelete(tx *gorm.DB) error {
+	if m.CurrentMediaID == nil {
+		return logChange(tx, "media", m.ID, ChangeDeleted, 0)
 	}
 	return nil
 }
@@ -236,7 +304,11 @@ func (m *MediaDB) BeforeUpdate(tx *gorm.DB) error {
 		return nil
 	}
 	orig_media := &MediaDB{}
-	err := tx.First(orig_media, m.ID).Error
+	err := lockForUpdate(tx).Preload("AdditionalNames").First(orig_media, m.ID).Error
+	if err != nil {
+		return err
+	}
+	err = checkRevision(tx, &m.Revision, orig_media.Revision)
 	if err != nil {
 		return err
 	}
@@ -252,10 +324,12 @@ func (m *MediaDB) BeforeUpdate(tx *gorm.DB) error {
 func (m *MediaDB) BeforeSave(tx *gorm.DB) error {
 	m.Name = trimWhitespace(m.Name)
 
-	// set editor for this new update
-	m.EditorUser = getCurrentUserNilable(tx)
-	if m.EditorUser == nil {
-		m.EditorUserID = nil
+	// set editor for this new update, historic entries keep their editor
+	if m.CurrentMedia == nil && m.CurrentMediaID == nil {
+		m.EditorUser = getCurrentUserNilable(tx)
+		if m.EditorUser == nil {
+			m.EditorUserID = nil
+		}
 	}
 	return nil
 }
@@ -289,6 +363,8 @@ var AudioTags = []AudioTag{
 type AdditionalName struct {
 	gorm.Model
 	Name string
+	// to find the karas with the same title
+	NormalizedName string `gorm:"index" json:"-"`
 }
 
 func trimWhitespace(s string) string {
@@ -297,6 +373,7 @@ func trimWhitespace(s string) string {
 
 func (name *AdditionalName) BeforeSave(tx *gorm.DB) error {
 	name.Name = trimWhitespace(name.Name)
+	name.NormalizedName = normalizeTitle(name.Name)
 	return nil
 }
 
@@ -308,21 +385,26 @@ type AudioTagDB struct {
 	ID string
 }
 
+// The VersionID fields are the current KaraFileVersion of the files, 0 for
+// files uploaded before versioning
 type UploadInfo struct {
-	VideoUploaded        bool
-	VideoModTime         time.Time
-	VideoSize            int64
-	VideoCRC32           uint32
-	InstrumentalUploaded bool
-	InstrumentalModTime  time.Time
-	InstrumentalSize     int64
-	InstrumentalCRC32    uint32
-	SubtitlesUploaded    bool
-	SubtitlesModTime     time.Time
-	SubtitlesSize        int64
-	SubtitlesCRC32       uint32
-	Hardsubbed           bool
-	Duration             int32
+	VideoUploaded         bool
+	VideoModTime          time.Time
+	VideoSize             int64
+	VideoCRC32            uint32
+	VideoVersionID        uint
+	InstrumentalUploaded  bool
+	InstrumentalModTime   time.Time
+	InstrumentalSize      int64
+	InstrumentalCRC32     uint32
+	InstrumentalVersionID uint
+	SubtitlesUploaded     bool
+	SubtitlesModTime      time.Time
+	SubtitlesSize         int64
+	SubtitlesCRC32        uint32
+	SubtitlesVersionID    uint
+	Hardsubbed            bool
+	Duration              int32
 	// date of the first upload of the sub file
 	KaraokeCreationTime time.Time
 }
@@ -342,16 +424,24 @@ type KaraInfoDB struct {
 	SourceMedia   *MediaDB  `gorm:"foreignKey:SourceMediaID;references:ID"`
 	Medias        []MediaDB `gorm:"many2many:kara_media_tags"`
 	Title         string
-	ExtraTitles   []AdditionalName `gorm:"many2many:kara_info_additional_name"`
-	Private       bool
-	Version       string
-	Comment       string
-	SongOrder     uint
-	Language      string
+	// to find the karas with the same title
+	NormalizedTitle string           `gorm:"index" json:"-"`
+	ExtraTitles     []AdditionalName `gorm:"many2many:kara_info_additional_name"`
+	Private         bool
+	Version         string
+	Comment         string
+	SongOrder       uint
+	Language        string
 	UploadInfo
+	Status string `gorm:"default:in_progress;index"`
+	// timing profile of the user working on the kara
+	ClaimedByID *uint
+	ClaimedBy   *TimingAuthor `gorm:"foreignKey:ClaimedByID;references:ID"`
 	// Can't be set by users
 	CurrentKaraInfoID *uint
 	CurrentKaraInfo   *KaraInfoDB
+	// incremented on each update, historic entries keep their revision
+	Revision uint `gorm:"not null;default:1"`
 	Editor
 }
 
@@ -380,6 +470,11 @@ func (k KaraInfoDB) FriendlyName() string {
 	return strings.Join(parts, " – ")
 }
 
+// Same condition as the UploadedKaras scope
+func (k KaraInfoDB) isUploaded() bool {
+	return k.VideoUploaded && (k.SubtitlesUploaded || k.Hardsubbed)
+}
+
 func (k KaraInfoDB) HasNoVideoTrack() bool {
 	for _, video_tag := range k.VideoTags {
 		if video_tag.ID == "NO_VIDEO" {
@@ -398,6 +493,21 @@ func KaraAssociations(db *gorm.DB) *gorm.DB {
 		Preload("SourceMedia." + clause.Associations)
 }
 
+// Associations of the revisions of a kara with the profile of their editor
+func KaraRevisionAssociations(db *gorm.DB) *gorm.DB {
+	return db.Scopes(KaraAssociations).Preload("EditorUser.TimingProfile")
+}
+
+// Associations copied to historic entries, they can be restored with revertKara
+func KaraHistoryAssociations(db *gorm.DB) *gorm.DB {
+	return db.Preload("Authors").
+		Preload("Artists").
+		Preload("VideoTags").
+		Preload("AudioTags").
+		Preload("Medias").
+		Preload("ExtraTitles")
+}
+
 func ImportAssociations(db *gorm.DB) *gorm.DB {
 	return db.Preload(clause.Associations).
 		Preload("Kara." + clause.Associations).
@@ -411,6 +521,84 @@ func CurrentKaras(tx *gorm.DB) *gorm.DB {
 	return tx.Where("current_kara_info_id IS NULL")
 }
 
+// escape LIKE wildcards, use with ESCAPE '!'
+func escapeLike(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+// subquery on a many2many join table of KaraInfoDB
+func karaJoinTableIDs(tx *gorm.DB, table string, column string, value any) *gorm.DB {
+	return tx.Session(&gorm.Session{NewDB: true}).
+		Table(table).
+		Select("kara_info_db_id").
+		Where(column+" = ?", value)
+}
+
+// Filter karas with a title or extra title containing text (case insensitive)
+func KarasMatchingTitle(text string) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		pattern := "%" + escapeLike(strings.ToLower(text)) + "%"
+		extra_titles := tx.Session(&gorm.Session{NewDB: true}).
+			Table("kara_info_additional_name").
+			Select("kara_info_additional_name.kara_info_db_id").
+			Joins("JOIN additional_names ON additional_names.id = kara_info_additional_name.additional_name_id").
+			Where("LOWER(additional_names.name) LIKE ? ESCAPE '!'", pattern)
+		return tx.Where("LOWER(title) LIKE ? ESCAPE '!' OR id IN (?)", pattern, extra_titles)
+	}
+}
+
+func KarasWithArtist(artist_id uint) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("id IN (?)", karaJoinTableIDs(tx, "kara_artist_tags", "artist_id", artist_id))
+	}
+}
+
+// Filter karas with the given source media or related media
+func KarasWithMedia(media_id uint) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where(
+			"source_media_id = ? OR id IN (?)",
+			media_id,
+			karaJoinTableIDs(tx, "kara_media_tags", "media_db_id", media_id),
+		)
+	}
+}
+
+func KarasWithAuthor(author_id uint) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("id IN (?)", karaJoinTableIDs(tx, "kara_authors_tags", "timing_author_id", author_id))
+	}
+}
+
+func KarasWithAudioTag(tag_id string) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("id IN (?)", karaJoinTableIDs(tx, "kara_audio_tags", "audio_tag_db_id", tag_id))
+	}
+}
+
+func KarasWithVideoTag(tag_id string) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("id IN (?)", karaJoinTableIDs(tx, "kara_video_tags", "video_tag_db_id", tag_id))
+	}
+}
+
+func KarasWithLanguage(language string) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("LOWER(language) = ?", strings.ToLower(trimWhitespace(language)))
+	}
+}
+
+func KarasWithPrivate(private bool) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("private = ?", private)
+	}
+}
+
+// Opposite of UploadedKaras
+func NotUploadedKaras(tx *gorm.DB) *gorm.DB {
+	return tx.Where("NOT (video_uploaded AND (subtitles_uploaded OR hardsubbed))")
+}
+
 func isNewKaraUpdate(tx *gorm.DB) bool {
 	return tx.Statement.Context.Value(NewKaraUpdate{}) != nil
 }
@@ -431,6 +619,18 @@ func isAssociationsUpdate(tx *gorm.DB) bool {
 	return tx.Statement.Context.Value(UpdateAssociations{}) != nil
 }
 
+// Update of the information of a kara, as opposed to the updates of its
+// files, status or flags
+type MetadataUpdate struct{}
+
+func WithMetadataUpdate(tx *gorm.DB) *gorm.DB {
+	return tx.WithContext(context.WithValue(tx.Statement.Context, MetadataUpdate{}, true))
+}
+
+func isMetadataUpdate(tx *gorm.DB) bool {
+	return tx.Statement.Context.Value(MetadataUpdate{}) != nil
+}
+
 var gitlabUpdateMutex = sync.Mutex{}
 
 func UploadHookGitlab(tx *gorm.DB, ki *KaraInfoDB) error {
@@ -489,8 +689,16 @@ func (ki *KaraInfoDB) AfterUpdate(tx *gorm.DB) error {
 	}
 
 	if ki.CurrentKaraInfoID == nil {
-		if CONFIG.Dakara.BaseURL != "" && ki.VideoUploaded && ki.SubtitlesUploaded {
-			SyncDakaraNotify()
+		err = updateUploadStatus(tx, ki)
+		if err != nil {
+			return err
+		}
+
+		if ki.VideoUploaded && ki.SubtitlesUploaded {
+			err = SyncDakaraNotify(tx)
+			if err != nil {
+				return err
+			}
 		}
 
 		err = UploadHookGitlab(tx, ki)
@@ -504,12 +712,50 @@ func (ki *KaraInfoDB) AfterUpdate(tx *gorm.DB) error {
 			mugen_import := &MugenImport{}
 			err := tx.Where(&MugenImport{KaraID: ki.ID}).First(mugen_import).Error
 			if errors.Is(err, gorm.ErrRecordNotFound) {
-				go PostWebhooks(*ki)
+				err = postKaraWebhooks(tx, WebhookKaraCreated, *ki)
+				if err != nil {
+					return err
+				}
 			} else if err != nil {
 				return err
 			}
 
 		}
+
+		if !isAssociationsUpdate(tx) {
+			err = logChange(tx, "kara", ki.ID, ChangeUpdated, ki.Revision)
+			if err != nil {
+				return err
+			}
+			publishKaraEvent(tx, EventKaraUpdated, ki)
+		}
+		if isMetadataUpdate(tx) {
+			err = postKaraWebhooks(tx, WebhookKaraUpdated, *ki)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ki *KaraInfoDB) AfterCreate(tx *gorm.DB) error {
+	// historic entries are created with the current version they belong to
+	if ki.CurrentKaraInfo == nil && ki.CurrentKaraInfoID == nil && !isAssociationsUpdate(tx) {
+		publishKaraEvent(tx, EventKaraCreated, ki)
+		return logChange(tx, "kara", ki.ID, ChangeCreated, 1)
+	}
+	return nil
+}
+
+func (ki *KaraInfoDB) AfterDelete(tx *gorm.DB) error {
+	if ki.CurrentKaraInfoID == nil {
+		publishKaraEvent(tx, EventKaraDeleted, ki)
+		err := logChange(tx, "kara", ki.ID, ChangeDeleted, 0)
+		if err != nil {
+			return err
+		}
+		return postKaraWebhooks(tx, WebhookKaraDeleted, *ki)
 	}
 	return nil
 }
@@ -519,7 +765,11 @@ func (ki *KaraInfoDB) BeforeUpdate(tx *gorm.DB) error {
 		return nil
 	}
 	orig_kara_info := &KaraInfoDB{}
-	err := tx.First(orig_kara_info, ki.ID).Error
+	err := lockForUpdate(tx).Scopes(KaraHistoryAssociations).First(orig_kara_info, ki.ID).Error
+	if err != nil {
+		return err
+	}
+	err = checkRevision(tx, &ki.Revision, orig_kara_info.Revision)
 	if err != nil {
 		return err
 	}
@@ -527,7 +777,9 @@ func (ki *KaraInfoDB) BeforeUpdate(tx *gorm.DB) error {
 	// create historic entry with the current value
 	orig_kara_info.ID = 0
 	orig_kara_info.CurrentKaraInfo = ki
-	err = tx.Create(orig_kara_info).Error
+	// the current version is upserted as an association
+	history_ctx := context.WithValue(tx.Statement.Context, UpdateAssociations{}, true)
+	err = tx.Session(&gorm.Session{NewDB: true, Context: history_ctx}).Create(orig_kara_info).Error
 
 	getLogger().Printf("Updating kara %d", ki.ID)
 	return err
@@ -537,12 +789,17 @@ func (ki *KaraInfoDB) BeforeSave(tx *gorm.DB) error {
 	ki.Version = trimWhitespace(ki.Version)
 	ki.Comment = trimWhitespace(ki.Comment)
 	ki.Title = trimWhitespace(ki.Title)
+	ki.NormalizedTitle = normalizeTitle(ki.Title)
 	ki.Language = trimWhitespace(ki.Language)
 
-	// set editor for this new version
-	ki.EditorUser = getCurrentUserNilable(tx)
-	if ki.EditorUser == nil {
-		ki.EditorUserID = nil
+	// set editor for this new version, historic entries keep their editor
+	if ki.CurrentKaraInfo == nil && ki.CurrentKaraInfoID == nil {
+		ki.EditorUser = getCurrentUserNilable(tx)
+		if ki.EditorUser == nil {
+			ki.EditorUserID = nil
+		} else {
+			ki.EditorUserID = &ki.EditorUser.ID
+		}
 	}
 
 	if ki.SubtitlesUploaded && ki.Hardsubbed {
@@ -562,6 +819,18 @@ type MugenImport struct {
 	Metadata bool `gorm:"default:true"`
 }
 
+// Reason given when a kara was deleted, the row is kept when it is restored
+type KaraDeletion struct {
+	KaraID       uint       `gorm:"primarykey" json:"kara_id"`
+	Reason       string     `json:"reason"`
+	UserID       *string    `json:"user_id"`
+	User         *User      `gorm:"foreignKey:UserID;references:ID" json:"user"`
+	Date         time.Time  `json:"date"`
+	RestoredAt   *time.Time `json:"restored_at"`
+	RestoredByID *string    `json:"restored_by_id"`
+	RestoredBy   *User      `gorm:"foreignKey:RestoredByID;references:ID" json:"restored_by"`
+}
+
 type MugenExport struct {
 	KaraID         uint       `gorm:"primarykey" json:"kid"`
 	Kara           KaraInfoDB `gorm:"foreignKey:KaraID;references:ID;constraint:OnDelete:CASCADE" json:"kara"`
@@ -626,6 +895,19 @@ type OAuthToken struct {
 }
 
 func init_model(db *gorm.DB) {
+	add_kara_status := !db.Migrator().HasColumn(&KaraInfoDB{}, "Status")
+	add_kara_revision := !db.Migrator().HasColumn(&KaraInfoDB{}, "Revision")
+	add_artist_revision := !db.Migrator().HasColumn(&Artist{}, "Revision")
+	add_media_revision := !db.Migrator().HasColumn(&MediaDB{}, "Revision")
+	add_webhooks := !db.Migrator().HasTable(&Webhook{})
+	add_pending_job_index := db.Migrator().HasTable(&Job{}) && !db.Migrator().HasIndex(&Job{}, "idx_pending_job")
+	add_change_log := !db.Migrator().HasTable(&ChangeLogEntry{})
+	add_normalized_titles := !db.Migrator().HasColumn(&KaraInfoDB{}, "NormalizedTitle")
+
+	if add_pending_job_index {
+		removePendingDuplicateJobs(db)
+	}
+
 	err := db.AutoMigrate(
 		&User{},
 		&TimingAuthor{},
@@ -640,11 +922,45 @@ func init_model(db *gorm.DB) {
 		&MugenExport{},
 		&Font{},
 		&OAuthToken{},
+		&KaraLyrics{},
+		&KaraDeletion{},
+		&KaraIssue{},
+		&KaraDuplicate{},
+		&Webhook{},
+		&WebhookDelivery{},
+		&Job{},
+		&KaraFileScrub{},
+		&KaraFileVersion{},
+		&ChangeLogEntry{},
 	)
 	if err != nil {
 		panic(err)
 	}
 
+	initLyricsIndex(db)
+
+	if add_kara_status {
+		initKaraStatus(db)
+	}
+	if add_kara_revision {
+		initRevisions(db, "kara_info_dbs", "current_kara_info_id")
+	}
+	if add_artist_revision {
+		initRevisions(db, "artists", "current_artist_id")
+	}
+	if add_media_revision {
+		initRevisions(db, "media_dbs", "current_media_id")
+	}
+	if add_webhooks {
+		importWebhooksConfig(db)
+	}
+	if add_normalized_titles {
+		initNormalizedTitles(db)
+	}
+	if add_change_log {
+		initChangeLog(db)
+	}
+
 	// https://github.com/Japan7/karaberus/pull/73
 	// drop previous indexes
 	if db.Migrator().HasIndex(&Artist{}, "idx_artist_name") {
@@ -663,19 +979,30 @@ func init_model(db *gorm.DB) {
 	// some karas might not have the right creation date at some point...
 	fixCreationTime(db)
 
-	// set size and crc32 for files uploaded before they were introduced
 	ctx := db.Statement.Context
 	if isKaraberusInit(ctx) {
-		err = exportRemainingKaras(ctx, db)
+		// token refresh could fail in bad ways, the job is retried instead of
+		// crashing on startup
+		err = enqueueJob(db, JobExportRemainingKaras, struct{}{})
 		if err != nil {
-			// would panic ideally, but token refresh could fail in bad ways that
-			// would constantly crash on startup
-			getLogger().Println(err.Error())
+			panic(err)
+		}
+		// set size and crc32 for files uploaded before they were introduced
+		err = enqueueJob(db, JobInitSizeCRC, struct{}{})
+		if err != nil {
+			panic(err)
 		}
-		go initSizeCRC(db)
 	}
 }
 
+func runExportRemainingKarasJob(ctx context.Context, job Job) error {
+	return exportRemainingKaras(ctx, GetDB(ctx))
+}
+
+func runInitSizeCRCJob(ctx context.Context, job Job) error {
+	return initSizeCRC(GetDB(ctx))
+}
+
 func fixCreationTime(db *gorm.DB) {
 	var karas []KaraInfoDB
 	err := db.Scopes(CurrentKaras).Find(&karas).Error
@@ -711,69 +1038,65 @@ func fixCreationTime(db *gorm.DB) {
 	}
 }
 
-func initSizeCRC(db *gorm.DB) {
+// Size and CRC32 of an uploaded file
+func karaObjectSizeCRC(ctx context.Context, kara KaraInfoDB, type_directory string) (int64, uint32, error) {
+	obj, err := GetKaraObject(ctx, kara, type_directory)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer Closer(obj)
+	hasher := crc32.NewIEEE()
+	size, err := io.Copy(hasher, obj)
+	if err != nil {
+		return 0, 0, err
+	}
+	return size, hasher.Sum32(), nil
+}
+
+func initSizeCRC(db *gorm.DB) error {
 	var karas []KaraInfoDB
 	err := db.Scopes(CurrentKaras).Find(&karas).Error
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		return
-	}
 	if err != nil {
-		panic(err)
+		return err
 	}
 
+	ctx := db.Statement.Context
 	// could be done concurrently but also probably doesn’t matter that much
 	for _, kara := range karas {
 		changed := false
 		if kara.VideoUploaded && kara.VideoSize <= 0 {
 			getLogger().Printf("%d: calculating video crc/size\n", kara.ID)
-			obj, err := GetKaraObject(db.Statement.Context, kara, "video")
-			if err != nil {
-				panic(err)
-			}
-			hasher := crc32.NewIEEE()
-			kara.VideoSize, err = io.Copy(hasher, obj)
+			kara.VideoSize, kara.VideoCRC32, err = karaObjectSizeCRC(ctx, kara, "video")
 			if err != nil {
-				panic(err)
+				return err
 			}
-			kara.VideoCRC32 = hasher.Sum32()
 			changed = true
 		}
 		if kara.InstrumentalUploaded && kara.InstrumentalSize <= 0 {
 			getLogger().Printf("%d: calculating inst crc/size\n", kara.ID)
-			obj, err := GetKaraObject(db.Statement.Context, kara, "inst")
-			if err != nil {
-				panic(err)
-			}
-			hasher := crc32.NewIEEE()
-			kara.InstrumentalSize, err = io.Copy(hasher, obj)
+			kara.InstrumentalSize, kara.InstrumentalCRC32, err = karaObjectSizeCRC(ctx, kara, "inst")
 			if err != nil {
-				panic(err)
+				return err
 			}
-			kara.InstrumentalCRC32 = hasher.Sum32()
 			changed = true
 		}
 		if kara.SubtitlesUploaded && kara.SubtitlesSize <= 0 {
 			getLogger().Printf("%d: calculating sub crc/size\n", kara.ID)
-			obj, err := GetKaraObject(db.Statement.Context, kara, "sub")
-			if err != nil {
-				panic(err)
-			}
-			hasher := crc32.NewIEEE()
-			kara.SubtitlesSize, err = io.Copy(hasher, obj)
+			kara.SubtitlesSize, kara.SubtitlesCRC32, err = karaObjectSizeCRC(ctx, kara, "sub")
 			if err != nil {
-				panic(err)
+				return err
 			}
-			kara.SubtitlesCRC32 = hasher.Sum32()
 			changed = true
 		}
 
 		if changed {
 			err := db.Save(&kara).Error
 			if err != nil {
-				panic(err)
+				return err
 			}
 		}
 	}
+	return nil
 }
 
 func createAdditionalNames(names []string) []AdditionalName {
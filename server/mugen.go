@@ -8,14 +8,11 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"runtime/debug"
 	"strings"
 
 	"github.com/Japan7/karaberus/server/clients/mugen"
 	"github.com/danielgtaylor/huma/v2"
 	"github.com/google/uuid"
-	"github.com/minio/minio-go/v7"
-	"golang.org/x/sync/semaphore"
 	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 )
@@ -227,22 +224,21 @@ func reimportMugenKara(ctx context.Context, tx *gorm.DB, mugen_import *MugenImpo
 		return err
 	}
 
-	err = GetDB(context.Background()).Transaction(func(tx *gorm.DB) error {
+	err = transaction(GetDB(context.Background()), func(tx *gorm.DB) error {
 		kara_info := &mugen_import.Kara
 		err = mugenKaraToKaraInfoDB(tx, *kara, kara_info)
 		if err != nil {
 			return err
 		}
 
-		return updateKara(tx, kara_info)
-	})
-	if err != nil {
-		return err
-	}
-
-	go MugenDownload(ctx, tx, *mugen_import)
+		err = updateKara(tx, kara_info)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		return enqueueMugenDownload(tx, mugen_import.MugenKID, RedownloadSubs(ctx))
+	})
+	return err
 }
 
 func importMugenKara(ctx context.Context, kid uuid.UUID, mugen_import *MugenImport) error {
@@ -260,7 +256,7 @@ func importMugenKara(ctx context.Context, kid uuid.UUID, mugen_import *MugenImpo
 		return err
 	}
 	getLogger().Printf("Importing kid %s for %s\n", kid, user.ID)
-	err = db.Transaction(func(tx *gorm.DB) error {
+	err = transaction(db, func(tx *gorm.DB) error {
 		kara_info := KaraInfoDB{}
 		err = mugenKaraToKaraInfoDB(tx, *kara, &kara_info)
 		if err != nil {
@@ -272,6 +268,14 @@ func importMugenKara(ctx context.Context, kid uuid.UUID, mugen_import *MugenImpo
 			return err
 		}
 
+		duplicates, err := findKaraDuplicates(tx, kara_info)
+		if err != nil {
+			return err
+		}
+		for _, duplicate := range duplicates {
+			getLogger().Printf("imported kid %s looks like kara %d: %s", kid, duplicate.KaraID, strings.Join(duplicate.Reasons, ", "))
+		}
+
 		mugen_import.MugenKID = kid
 		mugen_import.Kara = kara_info
 		err = tx.Create(mugen_import).Error
@@ -279,16 +283,9 @@ func importMugenKara(ctx context.Context, kid uuid.UUID, mugen_import *MugenImpo
 			return err
 		}
 
-		return nil
+		return enqueueMugenDownload(tx, kid, false)
 	})
-
-	if err != nil {
-		return err
-	}
-
-	go MugenDownload(db_ctx, db, *mugen_import)
-
-	return nil
+	return err
 }
 
 type ImportMugenKaraInput struct {
@@ -354,7 +351,10 @@ func RefreshMugen(ctx context.Context, input *RefreshMugenInput) (*struct{}, err
 		if mugen_import.Kara.EditorUserID != nil {
 			getLogger().Printf("Not updating %d because the editor is not NULL", mugen_import.Kara.ID)
 			if input.Body.RedownloadSubs {
-				go MugenDownload(ctx, db, mugen_import)
+				err = enqueueMugenDownload(db, mugen_import.MugenKID, true)
+				if err != nil {
+					return nil, err
+				}
 			}
 			continue
 		}
@@ -368,7 +368,10 @@ func RefreshMugen(ctx context.Context, input *RefreshMugenInput) (*struct{}, err
 
 			getLogger().Printf("Not updating %d because it was updated by %s", mugen_import.Kara.ID, *kara.EditorUserID)
 			if input.Body.RedownloadSubs {
-				go MugenDownload(ctx, db, mugen_import)
+				err = enqueueMugenDownload(db, mugen_import.MugenKID, true)
+				if err != nil {
+					return nil, err
+				}
 			}
 			continue
 		}
@@ -399,22 +402,7 @@ func SaveMugenResponseToS3(ctx context.Context, tx *gorm.DB, resp *http.Response
 	return SaveTempFileToS3WithMetadata(ctx, tx, tempfile, &kara.Kara, type_directory, user_metadata)
 }
 
-var MugenDownloadSemaphore = semaphore.NewWeighted(5)
-
 func mugenDownload(ctx context.Context, tx *gorm.DB, mugen_import MugenImport) error {
-	err := MugenDownloadSemaphore.Acquire(ctx, 1)
-	if err != nil {
-		return err
-	}
-
-	defer func() {
-		r := recover()
-		if r != nil {
-			getLogger().Printf("recovered from panic: %s\n%s\n", r, string(debug.Stack()))
-		}
-		MugenDownloadSemaphore.Release(1)
-	}()
-
 	mugen_client := mugen.GetClient()
 	mugen_kara, err := mugen_client.GetKara(ctx, mugen_import.MugenKID)
 	if err != nil {
@@ -422,23 +410,14 @@ func mugenDownload(ctx context.Context, tx *gorm.DB, mugen_import MugenImport) e
 	}
 
 	// video
-	obj, err := GetKaraObject(ctx, mugen_import.Kara, "video")
-	if err != nil {
-		return err
-	}
-	defer Closer(obj)
-
 	should_download_video := !mugen_import.Kara.VideoUploaded
 
 	if !should_download_video {
-		stat, err := obj.Stat()
-		if err != nil {
-			resp := minio.ToErrorResponse(err)
-			if resp.Code == "NoSuchKey" {
-				should_download_video = true
-			} else {
-				return resp
-			}
+		stat, err := StatKaraObject(ctx, mugen_import.Kara, "video")
+		if errors.Is(err, ErrObjectNotFound) {
+			should_download_video = true
+		} else if err != nil {
+			return err
 		} else {
 			// afaik file size is the only possible check (other than downloading on
 			// any update of the metadata)
@@ -461,24 +440,14 @@ func mugenDownload(ctx context.Context, tx *gorm.DB, mugen_import MugenImport) e
 	}
 
 	// sub
-
-	obj, err = GetKaraObject(ctx, mugen_import.Kara, "sub")
-	if err != nil {
-		return err
-	}
-	defer Closer(obj)
-
 	should_download_sub := RedownloadSubs(ctx) || !mugen_import.Kara.SubtitlesUploaded
 
 	if !should_download_sub {
-		stat, err := obj.Stat()
-		if err != nil {
-			resp := minio.ToErrorResponse(err)
-			if resp.Code == "NoSuchKey" {
-				should_download_sub = true
-			} else {
-				return resp
-			}
+		stat, err := StatKaraObject(ctx, mugen_import.Kara, "sub")
+		if errors.Is(err, ErrObjectNotFound) {
+			should_download_sub = true
+		} else if err != nil {
+			return err
 		} else {
 			should_download_sub = stat.UserMetadata["Mugenchecksum"] != mugen_kara.SubChecksum
 		}
@@ -502,20 +471,57 @@ func mugenDownload(ctx context.Context, tx *gorm.DB, mugen_import MugenImport) e
 	return nil
 }
 
-func MugenDownload(ctx context.Context, tx *gorm.DB, mugen_import MugenImport) {
+func MugenDownload(ctx context.Context, tx *gorm.DB, mugen_import MugenImport) error {
+	event := MugenImportEventData{KaraID: mugen_import.KaraID, MugenKID: mugen_import.MugenKID}
 	err := mugenDownload(ctx, tx, mugen_import)
 	if err != nil {
-		getLogger().Println(err)
+		event.Error = err.Error()
+		EVENTS.Publish(EventMugenImportFinished, event)
+		return err
+	}
+	afterCommit(tx, func() { EVENTS.Publish(EventMugenImportFinished, event) })
+	return nil
+}
+
+type MugenDownloadPayload struct {
+	MugenKID       uuid.UUID `json:"mugen_kid"`
+	RedownloadSubs bool      `json:"redownload_subs"`
+}
+
+// Download the files of the import in a job
+func enqueueMugenDownload(tx *gorm.DB, kid uuid.UUID, redownload_subs bool) error {
+	return enqueueJob(tx, JobMugenDownload, MugenDownloadPayload{MugenKID: kid, RedownloadSubs: redownload_subs})
+}
+
+func runMugenDownloadJob(ctx context.Context, job Job) error {
+	payload := MugenDownloadPayload{}
+	err := job.decode(&payload)
+	if err != nil {
+		return err
 	}
+
+	db := GetDB(ctx)
+	mugen_import := MugenImport{}
+	err = db.Scopes(ImportAssociations).First(&mugen_import, payload.MugenKID).Error
+	if err != nil {
+		return err
+	}
+
+	dl_ctx := context.WithValue(ctx, RedownloadSubsKey{}, payload.RedownloadSubs)
+	return MugenDownload(dl_ctx, db, mugen_import)
+}
+
+func runMugenSyncJob(ctx context.Context, job Job) error {
+	return SyncMugen(ctx)
 }
 
-func SyncMugen(ctx context.Context) {
+// Remove the imports of deleted karas and check the files of the others
+func SyncMugen(ctx context.Context) error {
 	mugen_imports := []MugenImport{}
 	db := GetDB(ctx)
 	err := db.Scopes(ImportAssociations).Find(&mugen_imports).Error
 	if err != nil {
-		getLogger().Println(err)
-		return
+		return err
 	}
 
 	getLogger().Printf("Syncing %d karaokes from Mugen", len(mugen_imports))
@@ -531,12 +537,13 @@ func SyncMugen(ctx context.Context) {
 		}
 
 		if mugen_import.Files {
-			err = mugenDownload(ctx, db, mugen_import)
+			err = enqueueMugenDownload(db, mugen_import.MugenKID, false)
 			if err != nil {
-				getLogger().Println(err)
+				return err
 			}
 		}
 	}
+	return nil
 }
 
 type GetMugenImportsOutput struct {
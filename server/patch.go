@@ -0,0 +1,64 @@
+package server
+
+import (
+	"encoding/json"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// Apply a JSON Merge Patch (RFC 7396) to target
+func applyMergePatch(target any, patch any) any {
+	patch_obj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	target_obj, ok := target.(map[string]any)
+	if !ok {
+		target_obj = map[string]any{}
+	}
+	for key, value := range patch_obj {
+		if value == nil {
+			delete(target_obj, key)
+		} else {
+			target_obj[key] = applyMergePatch(target_obj[key], value)
+		}
+	}
+	return target_obj
+}
+
+// Apply a JSON Merge Patch to the JSON representation of current.
+// Fields missing from the patch keep their current value, null fields are
+// reset to their zero value.
+func mergePatchInfo[T any](current T, patch []byte) (T, error) {
+	var merged T
+
+	var patch_doc any
+	err := json.Unmarshal(patch, &patch_doc)
+	if err != nil {
+		return merged, huma.Error400BadRequest("invalid merge patch", err)
+	}
+	if _, ok := patch_doc.(map[string]any); !ok {
+		return merged, huma.Error422UnprocessableEntity("merge patch must be an object")
+	}
+
+	current_json, err := json.Marshal(current)
+	if err != nil {
+		return merged, err
+	}
+	var current_doc any
+	err = json.Unmarshal(current_json, &current_doc)
+	if err != nil {
+		return merged, err
+	}
+
+	merged_json, err := json.Marshal(applyMergePatch(current_doc, patch_doc))
+	if err != nil {
+		return merged, err
+	}
+	err = json.Unmarshal(merged_json, &merged)
+	if err != nil {
+		return merged, huma.Error422UnprocessableEntity("invalid merge patch", err)
+	}
+	return merged, nil
+}
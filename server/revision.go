@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/danielgtaylor/huma/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Returned when a kara, artist or media was edited since the version the
+// update is based on
+var ErrStaleRevision = errors.New("edit based on an outdated revision")
+
+// Body of the 409 Conflict responses with the current version so clients can
+// merge their edit with it
+type RevisionConflictError[T any] struct {
+	huma.ErrorModel
+	Current T `json:"current"`
+}
+
+func revisionConflict[T any](revision uint, current T) error {
+	return &RevisionConflictError[T]{
+		ErrorModel: huma.ErrorModel{
+			Status: 409,
+			Title:  "Conflict",
+			Detail: fmt.Sprintf("edit based on an outdated version, current revision is %d", revision),
+		},
+		Current: current,
+	}
+}
+
+func revisionETag(revision uint) string {
+	return fmt.Sprint(revision)
+}
+
+// Check the If-Match header of an edit against the current revision
+func checkIfMatch(if_match string, revision uint) error {
+	if if_match == "" {
+		return huma.Error428PreconditionRequired("If-Match header with the revision of the edited version is required")
+	}
+
+	// kara ETags also track the included tags, only the revision matters for edits
+	for etag := range strings.SplitSeq(if_match, ",") {
+		if etagMatches(etagRevision(etag), revisionETag(revision)) {
+			return nil
+		}
+	}
+
+	return ErrStaleRevision
+}
+
+// Lock the row of the version being replaced until the end of the transaction
+func lockForUpdate(tx *gorm.DB) *gorm.DB {
+	return tx.Clauses(clause.Locking{Strength: clause.LockingStrengthUpdate})
+}
+
+type RevisionCheck struct{}
+
+// Edits of the users are refused if the edited value was changed since it was
+// loaded, internal updates (uploads, jobs…) apply to the current version.
+func WithRevisionCheck(tx *gorm.DB) *gorm.DB {
+	return tx.WithContext(context.WithValue(tx.Statement.Context, RevisionCheck{}, true))
+}
+
+func isRevisionCheck(tx *gorm.DB) bool {
+	return tx.Statement.Context.Value(RevisionCheck{}) != nil
+}
+
+// Called from BeforeUpdate with the locked previous version: for user edits
+// the updated value must have been loaded from it (revision is 0 if unknown),
+// it gets the next revision.
+func checkRevision(tx *gorm.DB, revision *uint, orig_revision uint) error {
+	if isRevisionCheck(tx) && *revision != 0 && *revision != orig_revision {
+		return ErrStaleRevision
+	}
+	*revision = orig_revision + 1
+	tx.Statement.SetColumn("Revision", *revision)
+	if len(tx.Statement.Selects) > 0 && !slices.Contains(tx.Statement.Selects, "*") {
+		tx.Statement.Selects = append(tx.Statement.Selects, "Revision")
+	}
+	return nil
+}
+
+// Number the versions of the existing karas, artists and medias from their history
+func initRevisions(db *gorm.DB, table string, current_column string) {
+	err := db.Exec(fmt.Sprintf(
+		`UPDATE %[1]s SET revision = 1 + (
+			SELECT COUNT(*) FROM %[1]s AS history WHERE history.%[2]s = %[1]s.id
+		) WHERE %[2]s IS NULL`,
+		table, current_column,
+	)).Error
+	if err != nil {
+		panic(err)
+	}
+	err = db.Exec(fmt.Sprintf(
+		`UPDATE %[1]s SET revision = 1 + (
+			SELECT COUNT(*) FROM %[1]s AS history WHERE history.%[2]s = %[1]s.%[2]s AND history.id < %[1]s.id
+		) WHERE %[2]s IS NOT NULL`,
+		table, current_column,
+	)).Error
+	if err != nil {
+		panic(err)
+	}
+}
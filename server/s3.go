@@ -8,112 +8,164 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"sync"
-	"time"
 
 	"github.com/Japan7/karaberus/karaberus_tools"
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 	"gorm.io/gorm"
 )
 
-var S3_CLIENTS map[string]*minio.Client = map[string]*minio.Client{}
-var S3_BEST_CLIENT *minio.Client
+// Files stored in the bucket, requests fail over across the S3 endpoints
+type S3Storage struct{}
 
-var clientsMutex = sync.Mutex{}
+func s3Error(err error, key string) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return err
+}
 
-type TestedClient struct {
-	Client      *minio.Client
-	ListLatency int64
+// Object read from an endpoint, it is opened again on the next endpoint at
+// the same offset if the current one fails.
+type s3Object struct {
+	ctx      context.Context
+	key      string
+	obj      *minio.Object
+	endpoint *s3Endpoint
+	offset   int64
 }
 
-func initS3Clients(ctx context.Context) {
-	if len(CONFIG.S3.Endpoints) == 0 {
-		panic("No S3 endpoints configured")
-	}
+func (o *s3Object) open() error {
+	return withS3Failover(o.ctx, func(endpoint *s3Endpoint) error {
+		obj, err := endpoint.Client.GetObject(o.ctx, CONFIG.S3.BucketName, o.key, minio.GetObjectOptions{})
+		if err != nil {
+			return err
+		}
+		// the object is only requested on its first use
+		_, err = obj.Stat()
+		if err == nil && o.offset > 0 {
+			_, err = obj.Seek(o.offset, io.SeekStart)
+		}
+		if err != nil {
+			Closer(obj)
+			return err
+		}
 
-	var err error
-	for _, endpoint := range CONFIG.S3.Endpoints {
-		S3_CLIENTS[endpoint], err = minio.New(endpoint, &minio.Options{
-			Creds:  credentials.NewStaticV4(CONFIG.S3.KeyID, CONFIG.S3.Secret, ""),
-			Secure: CONFIG.S3.Secure,
-		})
+		if o.obj != nil {
+			Closer(o.obj)
+		}
+		o.obj = obj
+		o.endpoint = endpoint
+		return nil
+	})
+}
+
+func (o *s3Object) Read(b []byte) (int, error) {
+	n, err := o.obj.Read(b)
+	o.offset += int64(n)
+	for range S3_ENDPOINTS {
+		if n > 0 || err == nil || err == io.EOF || !isS3EndpointError(o.ctx, err) {
+			break
+		}
+		getLogger().Printf("S3 endpoint %s failed while reading %s: %s", o.endpoint.Name, o.key, err)
+		o.endpoint.failure(err)
+		err = o.open()
 		if err != nil {
-			panic(err)
+			break
 		}
+		n, err = o.obj.Read(b)
+		o.offset += int64(n)
+	}
+	if err != nil && err != io.EOF {
+		err = s3Error(err, o.key)
 	}
+	return n, err
+}
 
-	pickBestClient(ctx)
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	offset, err := o.obj.Seek(offset, whence)
+	if err == nil {
+		o.offset = offset
+	}
+	return offset, err
+}
 
-	go func() {
-		for {
-			pickBestClient(ctx)
-			time.Sleep(60 * time.Second)
-		}
-	}()
+func (o *s3Object) Close() error {
+	return o.obj.Close()
 }
 
-// We’re assuming that a garage node among one of the addresses is on the
-// local host, which would have the lowest latency and probably offer the best
-// bandwidth.
-func pickBestClient(ctx context.Context) {
-	clientsMutex.Lock()
-	defer clientsMutex.Unlock()
-
-	var best_client *TestedClient = nil
-
-	c := make(chan TestedClient, len(S3_CLIENTS))
-
-	var err error
-	for _, client := range S3_CLIENTS {
-		go func(client *minio.Client) {
-			begin_time := time.Now()
-			_, err = client.BucketExists(ctx, CONFIG.S3.BucketName)
-			if err == nil {
-				tested := TestedClient{client, time.Since(begin_time).Nanoseconds()}
-				c <- tested
-			}
-		}(client)
+func (o *s3Object) Stat() (ObjectInfo, error) {
+	info, err := o.obj.Stat()
+	if err != nil {
+		return ObjectInfo{}, s3Error(err, o.key)
 	}
-	timeout := 5 * time.Second
-
-	for range S3_CLIENTS {
-		select {
-		case tested := <-c:
-			if best_client == nil || tested.ListLatency < best_client.ListLatency {
-				best_client = &tested
-				timeout = 500 * time.Millisecond
+	return ObjectInfo{Key: o.key, Size: info.Size, ModTime: info.LastModified, UserMetadata: info.UserMetadata}, nil
+}
+
+// The upload can only be retried on another endpoint if r can be rewound
+func (S3Storage) Put(ctx context.Context, key string, r io.Reader, size int64, user_metadata map[string]string) error {
+	seeker, seekable := r.(io.Seeker)
+	start := int64(0)
+	if seekable {
+		var err error
+		start, err = seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			seekable = false
+		}
+	}
+
+	var last_err error
+	return withS3Failover(ctx, func(endpoint *s3Endpoint) error {
+		if last_err != nil {
+			if !seekable {
+				return fmt.Errorf("%w: %s: %w", ErrS3NotRewindable, key, last_err)
 			}
-		case <-time.After(timeout):
-			if best_client == nil {
-				if err == nil {
-					panic("timeout")
-				} else {
-					panic(err)
-				}
+			_, err := seeker.Seek(start, io.SeekStart)
+			if err != nil {
+				return fmt.Errorf("%w: %s: %w", ErrS3NotRewindable, key, err)
 			}
 		}
-	}
 
-	if best_client != nil {
-		S3_BEST_CLIENT = best_client.Client
-	}
+		info, err := endpoint.Client.PutObject(ctx, CONFIG.S3.BucketName, key, r, size, minio.PutObjectOptions{
+			UserMetadata: user_metadata,
+			PartSize:     5 * 1024 * 1024,
+		})
+		if err == nil {
+			getLogger().Printf("upload info: %+v\n", info)
+		}
+		last_err = err
+		return err
+	})
 }
 
-func getS3Client() *minio.Client {
-	return S3_BEST_CLIENT
+func (S3Storage) Get(ctx context.Context, key string) (StorageObject, error) {
+	obj := &s3Object{ctx: ctx, key: key}
+	err := obj.open()
+	if err != nil {
+		return nil, s3Error(err, key)
+	}
+	return obj, nil
 }
 
-func UploadToS3(ctx context.Context, file io.Reader, filename string, filesize int64, user_metadata map[string]string) error {
-	client := getS3Client()
-
-	info, err := client.PutObject(ctx, CONFIG.S3.BucketName, filename, file, filesize, minio.PutObjectOptions{
-		UserMetadata: user_metadata,
-		PartSize:     5 * 1024 * 1024,
+func (S3Storage) Delete(ctx context.Context, key string) error {
+	return withS3Failover(ctx, func(endpoint *s3Endpoint) error {
+		return endpoint.Client.RemoveObject(ctx, CONFIG.S3.BucketName, key, minio.RemoveObjectOptions{})
 	})
-	getLogger().Printf("upload info: %+v\n", info)
+}
 
-	return err
+func (S3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	err := withS3Failover(ctx, func(endpoint *s3Endpoint) error {
+		objects = []ObjectInfo{}
+		opts := minio.ListObjectsOptions{Prefix: prefix, Recursive: true}
+		for info := range endpoint.Client.ListObjects(ctx, CONFIG.S3.BucketName, opts) {
+			if info.Err != nil {
+				return info.Err
+			}
+			objects = append(objects, ObjectInfo{Key: info.Key, Size: info.Size, ModTime: info.LastModified})
+		}
+		return nil
+	})
+	return objects, err
 }
 
 func CheckValidFiletype(type_directory string) bool {
@@ -125,6 +177,8 @@ func CheckValidFiletype(type_directory string) bool {
 	}
 }
 
+// The file is stored as a new version and becomes the current one, previous
+// versions are kept
 func SaveFileToS3WithMetadata(ctx context.Context, tx *gorm.DB, fd io.Reader, kara *KaraInfoDB, type_directory string, filesize int64, crc32 uint32, user_metadata map[string]string) (*CheckKaraOutput, error) {
 	if kara.ID == 0 {
 		return nil, errors.New("trying to upload to a karaoke that doesn't exist")
@@ -133,78 +187,53 @@ func SaveFileToS3WithMetadata(ctx context.Context, tx *gorm.DB, fd io.Reader, ka
 	if !CheckValidFiletype(type_directory) {
 		return nil, errors.New("Unknown file type " + type_directory)
 	}
-	filename := fmt.Sprintf("%s/%d", type_directory, kara.ID)
-	err := UploadToS3(ctx, fd, filename, filesize, user_metadata)
-	if err != nil {
-		return nil, err
-	}
 
-	res := &CheckKaraOutput{}
-
-	err = tx.Transaction(func(tx *gorm.DB) error {
-		currentTime := time.Now().UTC()
-		switch type_directory {
-		case "video":
-			// primary key should be set so it should work properly
-			err = tx.Model(&kara).Updates(KaraInfoDB{
-				UploadInfo: UploadInfo{
-					VideoUploaded: true,
-					VideoModTime:  currentTime,
-					VideoSize:     filesize,
-					VideoCRC32:    crc32,
-				},
-			}).Error
-		case "inst":
-			err = tx.Model(&kara).Updates(KaraInfoDB{
-				UploadInfo: UploadInfo{
-					InstrumentalUploaded: true,
-					InstrumentalModTime:  currentTime,
-					InstrumentalSize:     filesize,
-					InstrumentalCRC32:    crc32,
-				},
-			}).Error
-		case "sub":
-			update := UploadInfo{
-				SubtitlesUploaded: true,
-				SubtitlesModTime:  currentTime,
-				SubtitlesSize:     filesize,
-				SubtitlesCRC32:    crc32,
-			}
-			if kara.KaraokeCreationTime.Before(time.Unix(1, 0)) {
-				update.KaraokeCreationTime = currentTime
-				tx = WithNewKaraUpdate(tx)
-			}
-
-			err = tx.Model(&kara).Updates(KaraInfoDB{
-				UploadInfo: update,
-			}).Error
+	var res *CheckKaraOutput
+	version := &KaraFileVersion{KaraID: kara.ID, FileType: type_directory, Size: filesize, CRC32: crc32}
+	err := transaction(tx, func(tx *gorm.DB) error {
+		err := archiveLegacyKaraFile(tx, *kara, type_directory)
+		if err != nil {
+			return err
 		}
 
+		uploader := getCurrentUserNilable(tx)
+		if uploader != nil {
+			version.UploaderID = &uploader.ID
+		}
+		err = tx.Create(version).Error
 		if err != nil {
 			return err
 		}
-
-		res, err = CheckKara(ctx, *kara)
+		version.Key = karaFileVersionKey(*version)
+		err = tx.Model(version).UpdateColumn("key", version.Key).Error
 		if err != nil {
 			return err
 		}
 
-		if res.Video != nil {
-			if res.Video.Duration != kara.Duration {
-				err = tx.Model(&kara).Updates(KaraInfoDB{
-					UploadInfo: UploadInfo{Duration: res.Video.Duration},
-				}).Error
+		err = PutObject(ctx, fd, version.Key, filesize, user_metadata)
+		if err != nil {
+			return err
+		}
 
-				if err != nil {
-					return err
-				}
+		res, err = setCurrentKaraFile(ctx, tx, kara, version)
+		if err != nil {
+			// the version isn't saved
+			delete_err := deleteFile(ctx, version.Key)
+			if delete_err != nil {
+				getLogger().Println(delete_err)
 			}
+			return err
 		}
-
-		return nil
+		return pruneKaraFileVersions(ctx, tx, *kara, type_directory)
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return res, err
+	afterCommit(tx, func() {
+		EVENTS.Publish(EventFileUploaded, FileEventData{KaraID: kara.ID, FileType: type_directory, Size: filesize, CRC32: crc32})
+	})
+	return res, nil
 }
 
 func SaveTempFileToS3WithMetadata(ctx context.Context, tx *gorm.DB, tempfile UploadTempFile, kara *KaraInfoDB, type_directory string, user_metadata map[string]string) (*CheckKaraOutput, error) {
@@ -250,7 +279,7 @@ func SaveTempFileToS3(ctx context.Context, tx *gorm.DB, tempfile UploadTempFile,
 
 func SaveFontToS3(ctx context.Context, fd io.Reader, id uint, filesize int64) error {
 	filename := getS3FontFilename(id)
-	return UploadToS3(ctx, fd, filename, filesize, nil)
+	return PutObject(ctx, fd, filename, filesize, nil)
 }
 
 type CheckS3FileOutput struct {
@@ -327,11 +356,7 @@ func getS3FontFilename(id uint) string {
 	return fmt.Sprintf("font/%d", id)
 }
 
-func GetObject(ctx context.Context, filename string) (*minio.Object, error) {
-	return getS3Client().GetObject(ctx, CONFIG.S3.BucketName, filename, minio.GetObjectOptions{})
-}
-
-func GetFontObject(ctx context.Context, id uint) (*minio.Object, error) {
+func GetFontObject(ctx context.Context, id uint) (StorageObject, error) {
 	filename := getS3FontFilename(id)
 	return GetObject(ctx, filename)
 }
@@ -341,11 +366,15 @@ func getKaraObjectFilename(kara KaraInfoDB, filetype string) (string, error) {
 		return "", errors.New("Unknown file type " + filetype)
 	}
 
-	filename := fmt.Sprintf("%s/%d", filetype, kara.ID)
-	return filename, nil
+	version_id := karaFileVersionID(kara, filetype)
+	if version_id == 0 {
+		return legacyKaraObjectFilename(kara.ID, filetype), nil
+	}
+	version := KaraFileVersion{ID: version_id, KaraID: kara.ID, FileType: filetype}
+	return karaFileVersionKey(version), nil
 }
 
-func GetKaraObject(ctx context.Context, kara KaraInfoDB, filetype string) (*minio.Object, error) {
+func GetKaraObject(ctx context.Context, kara KaraInfoDB, filetype string) (StorageObject, error) {
 	filename, err := getKaraObjectFilename(kara, filetype)
 	if err != nil {
 		return nil, err
@@ -353,6 +382,14 @@ func GetKaraObject(ctx context.Context, kara KaraInfoDB, filetype string) (*mini
 	return GetObject(ctx, filename)
 }
 
+func StatKaraObject(ctx context.Context, kara KaraInfoDB, filetype string) (ObjectInfo, error) {
+	filename, err := getKaraObjectFilename(kara, filetype)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return StatObject(ctx, filename)
+}
+
 func GetKaraLyrics(ctx context.Context, kara KaraInfoDB) (string, error) {
 	if !kara.SubtitlesUploaded {
 		return "", nil
@@ -362,6 +399,7 @@ func GetKaraLyrics(ctx context.Context, kara KaraInfoDB) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	defer Closer(obj)
 	stat, err := obj.Stat()
 	if err != nil {
 		return "", err
@@ -392,8 +430,3 @@ func CheckS3Ass(ctx context.Context, obj io.ReadSeeker, size int64) (karaberus_t
 	out, err := karaberus_tools.DakaraCheckSub(obj, size)
 	return out, err
 }
-
-func deleteFile(ctx context.Context, obj_name string) error {
-	client := getS3Client()
-	return client.RemoveObject(ctx, CONFIG.S3.BucketName, obj_name, minio.RemoveObjectOptions{})
-}
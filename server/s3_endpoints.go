@@ -0,0 +1,233 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Consecutive failures after which an endpoint is skipped
+var s3BreakerThreshold = 3
+
+// How long an endpoint is skipped, it is tried again afterwards
+var s3BreakerCooldown = 30 * time.Second
+
+// Retries of a request on the same endpoint before failing over
+var s3MaxRetries = 2
+
+var s3ProbeInterval = 60 * time.Second
+var s3ProbeTimeout = 5 * time.Second
+
+// S3 node and its health, requests go to the healthy endpoints with the
+// lowest latency first and fail over to the next ones.
+type s3Endpoint struct {
+	Name   string
+	Client *minio.Client
+
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+	// moving average of the probes latency
+	latency   time.Duration
+	lastError string
+}
+
+var S3_ENDPOINTS []*s3Endpoint
+
+func newS3Endpoint(name string, opts *minio.Options) (*s3Endpoint, error) {
+	client, err := minio.New(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Endpoint{Name: name, Client: client}, nil
+}
+
+func initS3Clients(ctx context.Context) {
+	if len(CONFIG.S3.Endpoints) == 0 {
+		panic("No S3 endpoints configured")
+	}
+
+	endpoints := []*s3Endpoint{}
+	for _, name := range CONFIG.S3.Endpoints {
+		endpoint, err := newS3Endpoint(name, &minio.Options{
+			Creds:      credentials.NewStaticV4(CONFIG.S3.KeyID, CONFIG.S3.Secret, ""),
+			Secure:     CONFIG.S3.Secure,
+			MaxRetries: s3MaxRetries,
+		})
+		if err != nil {
+			panic(err)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	S3_ENDPOINTS = endpoints
+
+	probeS3Endpoints(ctx)
+
+	go func() {
+		for {
+			time.Sleep(s3ProbeInterval)
+			probeS3Endpoints(ctx)
+		}
+	}()
+}
+
+func (e *s3Endpoint) available(now time.Time) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return !now.Before(e.openUntil)
+}
+
+func (e *s3Endpoint) success() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.failures = 0
+	e.openUntil = time.Time{}
+}
+
+func (e *s3Endpoint) failure(err error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.failures++
+	e.lastError = err.Error()
+	if e.failures >= s3BreakerThreshold {
+		e.openUntil = time.Now().Add(s3BreakerCooldown)
+	}
+}
+
+func (e *s3Endpoint) recordLatency(latency time.Duration) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.latency == 0 {
+		e.latency = latency
+	} else {
+		e.latency = (3*e.latency + latency) / 4
+	}
+}
+
+func (e *s3Endpoint) getLatency() time.Duration {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.latency
+}
+
+// We’re assuming that a garage node among one of the addresses is on the
+// local host, which would have the lowest latency and probably offer the best
+// bandwidth.
+func probeS3Endpoints(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for _, endpoint := range S3_ENDPOINTS {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probe_ctx, cancel := context.WithTimeout(ctx, s3ProbeTimeout)
+			defer cancel()
+
+			begin_time := time.Now()
+			_, err := endpoint.Client.BucketExists(probe_ctx, CONFIG.S3.BucketName)
+			if err != nil {
+				getLogger().Printf("S3 endpoint %s is unhealthy: %s", endpoint.Name, err)
+				endpoint.failure(err)
+				return
+			}
+			endpoint.recordLatency(time.Since(begin_time))
+			endpoint.success()
+		}()
+	}
+	wg.Wait()
+}
+
+// Endpoints in the order they should be tried: the available ones by latency
+// then the ones with an open circuit, as a last resort.
+func orderedS3Endpoints() []*s3Endpoint {
+	now := time.Now()
+	available := []*s3Endpoint{}
+	unavailable := []*s3Endpoint{}
+	for _, endpoint := range S3_ENDPOINTS {
+		if endpoint.available(now) {
+			available = append(available, endpoint)
+		} else {
+			unavailable = append(unavailable, endpoint)
+		}
+	}
+	slices.SortStableFunc(available, func(a, b *s3Endpoint) int {
+		return cmp.Compare(a.getLatency(), b.getLatency())
+	})
+	return append(available, unavailable...)
+}
+
+// Errors from an endpoint that another one might not have, errors about the
+// request itself (missing object, denied access…) are returned directly.
+func isS3EndpointError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, ErrS3NotRewindable) {
+		return false
+	}
+	resp := minio.ToErrorResponse(err)
+	if resp.StatusCode >= 500 {
+		return true
+	}
+	return resp.StatusCode == 0 && resp.Code == ""
+}
+
+var ErrNoS3Endpoint = errors.New("no S3 endpoint configured")
+
+// The body of a failed upload can't be read again for the next endpoint
+var ErrS3NotRewindable = errors.New("can't upload to another endpoint")
+
+// Run the request on the endpoints until one answers
+func withS3Failover(ctx context.Context, request func(endpoint *s3Endpoint) error) error {
+	err := ErrNoS3Endpoint
+	for _, endpoint := range orderedS3Endpoints() {
+		err = request(endpoint)
+		if errors.Is(err, ErrS3NotRewindable) {
+			// the request was not sent to this endpoint
+			return err
+		}
+		if err == nil || !isS3EndpointError(ctx, err) {
+			endpoint.success()
+			return err
+		}
+		getLogger().Printf("S3 endpoint %s failed: %s", endpoint.Name, err)
+		endpoint.failure(err)
+	}
+	return err
+}
+
+type S3EndpointStatus struct {
+	Name      string `json:"name"`
+	Available bool   `json:"available"`
+	Failures  int    `json:"failures"`
+	// milliseconds
+	Latency   float64 `json:"latency"`
+	LastError string  `json:"last_error"`
+}
+
+type S3EndpointsOutput struct {
+	Body struct {
+		Endpoints []S3EndpointStatus `json:"endpoints"`
+	}
+}
+
+func GetS3Endpoints(ctx context.Context, input *struct{}) (*S3EndpointsOutput, error) {
+	out := &S3EndpointsOutput{}
+	out.Body.Endpoints = []S3EndpointStatus{}
+	now := time.Now()
+	for _, endpoint := range orderedS3Endpoints() {
+		available := endpoint.available(now)
+		endpoint.mutex.Lock()
+		out.Body.Endpoints = append(out.Body.Endpoints, S3EndpointStatus{
+			Name:      endpoint.Name,
+			Available: available,
+			Failures:  endpoint.failures,
+			Latency:   float64(endpoint.latency.Microseconds()) / 1000,
+			LastError: endpoint.lastError,
+		})
+		endpoint.mutex.Unlock()
+	}
+	return out, nil
+}
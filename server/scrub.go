@@ -0,0 +1,308 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ScrubOK = "ok"
+var ScrubCorrupted = "corrupted"
+var ScrubMissing = "missing"
+
+// the file couldn't be read, it might be fine
+var ScrubError = "error"
+
+// Result of the last verification of a kara file
+type KaraFileScrub struct {
+	KaraID     uint      `gorm:"primaryKey;autoIncrement:false" json:"kara_id"`
+	FileType   string    `gorm:"primaryKey" json:"file_type" enum:"video,inst,sub"`
+	VerifiedAt time.Time `json:"verified_at"`
+	Status     string    `gorm:"index" json:"status" enum:"ok,corrupted,missing,error"`
+	// size and CRC32 of the stored file
+	Size  int64  `json:"size"`
+	CRC32 uint32 `json:"crc32"`
+	Error string `json:"error"`
+}
+
+type karaFile struct {
+	Kara     KaraInfoDB
+	FileType string
+	Size     int64
+	CRC32    uint32
+	ModTime  time.Time
+}
+
+func karaUploadedFiles(kara KaraInfoDB) []karaFile {
+	files := []karaFile{}
+	if kara.VideoUploaded {
+		files = append(files, karaFile{kara, "video", kara.VideoSize, kara.VideoCRC32, kara.VideoModTime})
+	}
+	if kara.InstrumentalUploaded {
+		files = append(files, karaFile{kara, "inst", kara.InstrumentalSize, kara.InstrumentalCRC32, kara.InstrumentalModTime})
+	}
+	if kara.SubtitlesUploaded {
+		files = append(files, karaFile{kara, "sub", kara.SubtitlesSize, kara.SubtitlesCRC32, kara.SubtitlesModTime})
+	}
+	return files
+}
+
+type scrubKey struct {
+	kara_id   uint
+	file_type string
+}
+
+// Uploaded files with a known size and CRC32 and their last verification
+func scrubbableFiles(db *gorm.DB) ([]karaFile, map[scrubKey]KaraFileScrub, error) {
+	karas := []KaraInfoDB{}
+	err := db.Unscoped().Scopes(CurrentKaras).
+		Where("video_uploaded OR instrumental_uploaded OR subtitles_uploaded").
+		Find(&karas).Error
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scrubs := []KaraFileScrub{}
+	err = db.Find(&scrubs).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	scrubs_by_file := map[scrubKey]KaraFileScrub{}
+	for _, scrub := range scrubs {
+		scrubs_by_file[scrubKey{scrub.KaraID, scrub.FileType}] = scrub
+	}
+
+	files := []karaFile{}
+	for _, kara := range karas {
+		for _, file := range karaUploadedFiles(kara) {
+			// computed later by the init_size_crc job
+			if file.Size > 0 {
+				files = append(files, file)
+			}
+		}
+	}
+	return files, scrubs_by_file, nil
+}
+
+// Files to verify: the ones never verified, then the ones verified the
+// longest time ago, before period or their last upload
+func scrubCandidates(db *gorm.DB, batch_size int, period time.Duration) ([]karaFile, error) {
+	files, scrubs, err := scrubbableFiles(db)
+	if err != nil {
+		return nil, err
+	}
+
+	verified_before := time.Now().Add(-period)
+	candidates := []karaFile{}
+	for _, file := range files {
+		scrub, ok := scrubs[scrubKey{file.Kara.ID, file.FileType}]
+		if !ok || scrub.VerifiedAt.Before(verified_before) || scrub.VerifiedAt.Before(file.ModTime) {
+			candidates = append(candidates, file)
+		}
+	}
+
+	slices.SortStableFunc(candidates, func(a, b karaFile) int {
+		return cmp.Compare(
+			scrubs[scrubKey{a.Kara.ID, a.FileType}].VerifiedAt.UnixNano(),
+			scrubs[scrubKey{b.Kara.ID, b.FileType}].VerifiedAt.UnixNano(),
+		)
+	})
+	return candidates[:min(batch_size, len(candidates))], nil
+}
+
+// Reader limited to rate bytes per second, 0 for no limit
+type rateLimitedReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func newRateLimitedReader(ctx context.Context, r io.Reader, rate int64) *rateLimitedReader {
+	return &rateLimitedReader{ctx: ctx, r: r, rate: rate, start: time.Now()}
+}
+
+func (r *rateLimitedReader) Read(b []byte) (int, error) {
+	err := r.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(b)
+	r.read += int64(n)
+	if r.rate > 0 {
+		expected := time.Duration(float64(r.read) / float64(r.rate) * float64(time.Second))
+		wait := expected - time.Since(r.start)
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-r.ctx.Done():
+				return n, r.ctx.Err()
+			}
+		}
+	}
+	return n, err
+}
+
+func verifyKaraFile(ctx context.Context, file karaFile, rate int64) (KaraFileScrub, error) {
+	scrub := KaraFileScrub{KaraID: file.Kara.ID, FileType: file.FileType, VerifiedAt: time.Now().UTC()}
+
+	obj, err := GetKaraObject(ctx, file.Kara, file.FileType)
+	if err == nil {
+		defer Closer(obj)
+		hasher := crc32.NewIEEE()
+		scrub.Size, err = io.Copy(hasher, newRateLimitedReader(ctx, obj, rate))
+		scrub.CRC32 = hasher.Sum32()
+	}
+
+	switch {
+	case ctx.Err() != nil:
+		return scrub, ctx.Err()
+	case errors.Is(err, ErrObjectNotFound):
+		scrub.Status = ScrubMissing
+		scrub.Size = 0
+		scrub.CRC32 = 0
+	case err != nil:
+		scrub.Status = ScrubError
+		scrub.Error = err.Error()
+	case scrub.Size != file.Size:
+		scrub.Status = ScrubCorrupted
+		scrub.Error = fmt.Sprintf("size is %d, expected %d", scrub.Size, file.Size)
+	case scrub.CRC32 != file.CRC32:
+		scrub.Status = ScrubCorrupted
+		scrub.Error = fmt.Sprintf("CRC32 is %08x, expected %08x", scrub.CRC32, file.CRC32)
+	default:
+		scrub.Status = ScrubOK
+	}
+	return scrub, nil
+}
+
+// Save the result, corrupted and missing files are reported when they are
+// first found.
+func saveKaraFileScrub(db *gorm.DB, file karaFile, scrub KaraFileScrub) error {
+	reported := false
+	err := transaction(db, func(tx *gorm.DB) error {
+		kara := KaraInfoDB{}
+		err := tx.Unscoped().First(&kara, file.Kara.ID).Error
+		if err != nil {
+			return err
+		}
+		for _, current := range karaUploadedFiles(kara) {
+			if current.FileType == file.FileType && !current.ModTime.Equal(file.ModTime) {
+				// uploaded again while it was verified
+				return nil
+			}
+		}
+
+		previous := KaraFileScrub{}
+		err = tx.Where(&KaraFileScrub{KaraID: scrub.KaraID, FileType: scrub.FileType}).
+			Limit(1).
+			Find(&previous).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&scrub).Error
+		if err != nil {
+			return err
+		}
+
+		if (scrub.Status == ScrubCorrupted || scrub.Status == ScrubMissing) && previous.Status != scrub.Status {
+			getLogger().Printf("kara %d: %s file is %s %s", kara.ID, scrub.FileType, scrub.Status, scrub.Error)
+			reported = true
+			return postFileCorruptedWebhooks(tx, kara, scrub)
+		}
+		return nil
+	})
+	if err == nil && reported {
+		EVENTS.Publish(EventFileCorrupted, FileEventData{
+			KaraID:   scrub.KaraID,
+			FileType: scrub.FileType,
+			Size:     scrub.Size,
+			CRC32:    scrub.CRC32,
+			Error:    scrub.Status + ": " + scrub.Error,
+		})
+	}
+	return err
+}
+
+// Verify the size and CRC32 of a batch of files
+func ScrubFiles(ctx context.Context, db *gorm.DB, batch_size int, period time.Duration, rate int64) error {
+	files, err := scrubCandidates(db, batch_size, period)
+	if err != nil {
+		return err
+	}
+
+	getLogger().Printf("verifying %d files", len(files))
+	for _, file := range files {
+		scrub, err := verifyKaraFile(ctx, file, rate)
+		if err != nil {
+			return err
+		}
+		err = saveKaraFileScrub(db, file, scrub)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runStorageScrubJob(ctx context.Context, job Job) error {
+	period := time.Duration(CONFIG.Scrub.Period) * 24 * time.Hour
+	rate := int64(CONFIG.Scrub.RateLimit) * 1024 * 1024
+	return ScrubFiles(ctx, GetDB(ctx), CONFIG.Scrub.BatchSize, period, rate)
+}
+
+type GetScrubStatusInput struct {
+	Status string `query:"status" enum:"ok,corrupted,missing,error," doc:"files with this status, the ones with a problem by default"`
+}
+
+type ScrubStatusOutput struct {
+	Body struct {
+		// files by status of their last verification
+		Counts map[string]int `json:"counts"`
+		// files that were never verified
+		Unverified int             `json:"unverified"`
+		Files      []KaraFileScrub `json:"files"`
+	}
+}
+
+func GetScrubStatus(ctx context.Context, input *GetScrubStatusInput) (*ScrubStatusOutput, error) {
+	db := GetDB(ctx)
+	out := &ScrubStatusOutput{}
+
+	files, scrubs, err := scrubbableFiles(db)
+	if err != nil {
+		return nil, err
+	}
+
+	out.Body.Counts = map[string]int{ScrubOK: 0, ScrubCorrupted: 0, ScrubMissing: 0, ScrubError: 0}
+	out.Body.Files = []KaraFileScrub{}
+	for _, file := range files {
+		scrub, ok := scrubs[scrubKey{file.Kara.ID, file.FileType}]
+		if !ok {
+			out.Body.Unverified++
+			continue
+		}
+		out.Body.Counts[scrub.Status]++
+		if scrub.Status == input.Status || (input.Status == "" && scrub.Status != ScrubOK) {
+			out.Body.Files = append(out.Body.Files, scrub)
+		}
+	}
+	return out, nil
+}
+
+func StartStorageScrub(ctx context.Context, input *struct{}) (*struct{}, error) {
+	err := enqueueJob(GetDB(ctx), JobStorageScrub, struct{}{})
+	if err != nil {
+		return nil, err
+	}
+	return &struct{}{}, nil
+}
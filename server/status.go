@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/danielgtaylor/huma/v2"
+	"gorm.io/gorm"
+)
+
+var KaraStatusPlanned = "planned"
+var KaraStatusInProgress = "in_progress"
+var KaraStatusUploaded = "uploaded"
+var KaraStatusNeedsFix = "needs_fix"
+var KaraStatusRetired = "retired"
+
+// Statuses of the karas someone still has to work on
+var KaraWIPStatuses = []string{KaraStatusPlanned, KaraStatusInProgress, KaraStatusNeedsFix}
+
+// Set the status of karas created before it was introduced from their files
+func initKaraStatus(db *gorm.DB) {
+	err := db.Unscoped().Model(&KaraInfoDB{}).
+		Scopes(UploadedKaras).
+		UpdateColumn("status", KaraStatusUploaded).Error
+	if err != nil {
+		panic(err)
+	}
+	err = db.Unscoped().Model(&KaraInfoDB{}).
+		Scopes(NotUploadedKaras).
+		UpdateColumn("status", KaraStatusInProgress).Error
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Follow the files of the kara: it is uploaded once the files are there and
+// goes back to in progress if they are deleted.
+// This is part of the same update so it doesn't create another history entry.
+func updateUploadStatus(tx *gorm.DB, kara *KaraInfoDB) error {
+	status := kara.Status
+	if kara.isUploaded() && (status == KaraStatusPlanned || status == KaraStatusInProgress) {
+		status = KaraStatusUploaded
+	} else if !kara.isUploaded() && status == KaraStatusUploaded {
+		status = KaraStatusInProgress
+	}
+
+	if status == kara.Status {
+		return nil
+	}
+	kara.Status = status
+	return tx.Model(kara).UpdateColumn("status", status).Error
+}
+
+func KarasWithStatus(statuses ...string) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("status IN ?", statuses)
+	}
+}
+
+func KarasClaimedBy(author_id uint) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where(&KaraInfoDB{ClaimedByID: &author_id})
+	}
+}
+
+// Save the status and claim of a kara, the previous ones are kept in the history
+func saveKaraStatus(tx *gorm.DB, kara *KaraInfoDB) error {
+	return tx.Model(kara).
+		Select("Status", "ClaimedByID", "EditorUserID", "UpdatedAt").
+		Updates(kara).Error
+}
+
+// The user in the context might not have the latest timing profile
+func getCurrentUserFromDB(ctx context.Context, tx *gorm.DB) (User, error) {
+	user, err := getCurrentUser(ctx)
+	if err != nil {
+		return user, err
+	}
+	err = tx.First(&user, "id = ?", user.ID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return user, nil
+	}
+	return user, err
+}
+
+type UpdateKaraStatusInput struct {
+	Id   uint `path:"id"`
+	Body struct {
+		Status string `json:"status" enum:"planned,in_progress,uploaded,needs_fix,retired" example:"needs_fix"`
+	}
+}
+
+func UpdateKaraStatus(ctx context.Context, input *UpdateKaraStatusInput) (*KaraOutput, error) {
+	db := GetDB(ctx)
+	out := &KaraOutput{}
+
+	err := transaction(db, func(tx *gorm.DB) error {
+		kara := &out.Body.Kara
+		err := tx.Scopes(CurrentKaras).First(kara, input.Id).Error
+		if err != nil {
+			return err
+		}
+
+		if input.Body.Status == KaraStatusUploaded && !kara.isUploaded() {
+			return huma.Error422UnprocessableEntity("the karaoke files are not uploaded")
+		}
+		if input.Body.Status == kara.Status {
+			return tx.Scopes(KaraAssociations).First(kara, kara.ID).Error
+		}
+
+		kara.Status = input.Body.Status
+		err = saveKaraStatus(tx, kara)
+		if err != nil {
+			return err
+		}
+
+		return tx.Scopes(KaraAssociations).First(kara, kara.ID).Error
+	})
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	return out, nil
+}
+
+func ClaimKara(ctx context.Context, input *GetKaraInput) (*KaraOutput, error) {
+	db := GetDB(ctx)
+	out := &KaraOutput{}
+
+	err := transaction(db, func(tx *gorm.DB) error {
+		user, err := getCurrentUserFromDB(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if user.TimingProfileID == nil {
+			return huma.Error422UnprocessableEntity("set your timing profile before claiming a karaoke")
+		}
+
+		kara := &out.Body.Kara
+		err = tx.Scopes(CurrentKaras).First(kara, input.Id).Error
+		if err != nil {
+			return err
+		}
+
+		if kara.Status == KaraStatusRetired {
+			return huma.Error422UnprocessableEntity("retired karaokes can't be claimed")
+		}
+		if kara.ClaimedByID != nil && *kara.ClaimedByID != *user.TimingProfileID && !user.Admin {
+			return huma.Error409Conflict(fmt.Sprintf("kara %d is already claimed", kara.ID))
+		}
+
+		kara.ClaimedByID = user.TimingProfileID
+		if kara.Status == KaraStatusPlanned {
+			kara.Status = KaraStatusInProgress
+		}
+		err = saveKaraStatus(tx, kara)
+		if err != nil {
+			return err
+		}
+
+		return tx.Scopes(KaraAssociations).First(kara, kara.ID).Error
+	})
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	return out, nil
+}
+
+func UnclaimKara(ctx context.Context, input *GetKaraInput) (*KaraOutput, error) {
+	db := GetDB(ctx)
+	out := &KaraOutput{}
+
+	err := transaction(db, func(tx *gorm.DB) error {
+		user, err := getCurrentUserFromDB(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		kara := &out.Body.Kara
+		err = tx.Scopes(CurrentKaras).First(kara, input.Id).Error
+		if err != nil {
+			return err
+		}
+
+		if kara.ClaimedByID == nil {
+			return tx.Scopes(KaraAssociations).First(kara, kara.ID).Error
+		}
+		claimer := user.TimingProfileID != nil && *user.TimingProfileID == *kara.ClaimedByID
+		if !claimer && !user.Admin {
+			return huma.Error403Forbidden("kara claimed by someone else")
+		}
+
+		kara.ClaimedByID = nil
+		if kara.Status == KaraStatusInProgress && !kara.isUploaded() {
+			kara.Status = KaraStatusPlanned
+		}
+		err = saveKaraStatus(tx, kara)
+		if err != nil {
+			return err
+		}
+
+		return tx.Scopes(KaraAssociations).First(kara, kara.ID).Error
+	})
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	return out, nil
+}
+
+type MyWIPKarasOutput struct {
+	Body struct {
+		Karas []KaraInfoDB `json:"karas"`
+	}
+}
+
+func GetMyWIPKaras(ctx context.Context, input *struct{}) (*MyWIPKarasOutput, error) {
+	db := GetDB(ctx)
+	out := &MyWIPKarasOutput{}
+	out.Body.Karas = []KaraInfoDB{}
+
+	user, err := getCurrentUserFromDB(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	if user.TimingProfileID == nil {
+		return out, nil
+	}
+
+	err = db.Scopes(
+		KaraAssociations,
+		CurrentKaras,
+		KarasClaimedBy(*user.TimingProfileID),
+		KarasWithStatus(KaraWIPStatuses...),
+	).Order("updated_at DESC").Find(&out.Body.Karas).Error
+	return out, err
+}
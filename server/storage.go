@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var ErrObjectNotFound = errors.New("object not found")
+
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	ModTime      time.Time
+	UserMetadata map[string]string
+}
+
+// Stored file, errors for missing files can be returned when it is opened or
+// on the first Stat/Read
+type StorageObject interface {
+	io.ReadSeekCloser
+	Stat() (ObjectInfo, error)
+}
+
+// Backend where the karaoke files and fonts are stored
+type Storage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, user_metadata map[string]string) error
+	Get(ctx context.Context, key string) (StorageObject, error)
+	Delete(ctx context.Context, key string) error
+	// objects with keys starting with prefix, without their user metadata
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+var STORAGE Storage
+
+var StorageS3 = "s3"
+var StorageLocal = "local"
+
+func initStorage(ctx context.Context) {
+	switch CONFIG.Storage.Backend {
+	case StorageS3:
+		initS3Clients(ctx)
+		STORAGE = S3Storage{}
+	case StorageLocal:
+		storage, err := NewLocalStorage(CONFIG.Storage.Directory)
+		if err != nil {
+			panic(err)
+		}
+		STORAGE = storage
+	default:
+		panic(fmt.Sprintf("unknown storage backend %s", CONFIG.Storage.Backend))
+	}
+}
+
+func getStorage() Storage {
+	return STORAGE
+}
+
+func PutObject(ctx context.Context, file io.Reader, filename string, filesize int64, user_metadata map[string]string) error {
+	return getStorage().Put(ctx, filename, file, filesize, user_metadata)
+}
+
+func GetObject(ctx context.Context, filename string) (StorageObject, error) {
+	return getStorage().Get(ctx, filename)
+}
+
+func deleteFile(ctx context.Context, obj_name string) error {
+	return getStorage().Delete(ctx, obj_name)
+}
+
+func StatObject(ctx context.Context, filename string) (ObjectInfo, error) {
+	obj, err := GetObject(ctx, filename)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer Closer(obj)
+	return obj.Stat()
+}
@@ -0,0 +1,273 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var AuditOrphan = "orphan"
+var AuditMissing = "missing"
+var AuditSizeMismatch = "size_mismatch"
+
+// Objects more recent than this are not reported as orphans, uploads write
+// the file before committing the kara.
+var auditOrphanMinAge = time.Hour
+
+type StorageAuditIssue struct {
+	Key     string `json:"key"`
+	Problem string `json:"problem" enum:"orphan,missing,size_mismatch"`
+	KaraID  uint   `json:"kara_id,omitempty"`
+	FontID  uint   `json:"font_id,omitempty"`
+	// KaraFileVersion of the object
+	VersionID uint `json:"version_id,omitempty"`
+	// size of the object
+	Size int64 `json:"size,omitempty"`
+	// size saved in the database
+	ExpectedSize int64 `json:"expected_size,omitempty"`
+	Fixed        bool  `json:"fixed"`
+}
+
+type StorageAuditReport struct {
+	Objects int                 `json:"objects"`
+	Issues  []StorageAuditIssue `json:"issues"`
+}
+
+type auditedFile struct {
+	kara_id    uint
+	size       int64
+	version_id uint
+}
+
+// Objects expected in the storage: the files of the current karas (deleted
+// ones can be restored so their files are kept), their previous versions and
+// the fonts.
+func expectedStorageObjects(db *gorm.DB) (map[string]auditedFile, error) {
+	expected := map[string]auditedFile{}
+	versions := []KaraFileVersion{}
+	err := db.Find(&versions).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		expected[version.Key] = auditedFile{version.KaraID, version.Size, version.ID}
+	}
+
+	karas := []KaraInfoDB{}
+	err = db.Unscoped().Scopes(CurrentKaras).Find(&karas).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, kara := range karas {
+		for _, file := range karaUploadedFiles(kara) {
+			key, err := getKaraObjectFilename(kara, file.FileType)
+			if err != nil {
+				return nil, err
+			}
+			expected[key] = auditedFile{kara.ID, file.Size, expected[key].version_id}
+		}
+	}
+
+	fonts := []Font{}
+	err = db.Unscoped().Find(&fonts).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, font := range fonts {
+		expected[getS3FontFilename(font.ID)] = auditedFile{}
+	}
+	return expected, nil
+}
+
+// ID of the kara or font of an object key, 0 if it doesn't follow the naming
+// of the files
+func objectKeyID(key string) uint {
+	parts := strings.Split(strings.TrimPrefix(key, "versions/"), "/")
+	if len(parts) < 2 {
+		return 0
+	}
+	id, err := strconv.ParseUint(parts[1], 10, 0)
+	if err != nil {
+		return 0
+	}
+	return uint(id)
+}
+
+// Compare the objects with the database
+func AuditStorage(ctx context.Context, db *gorm.DB) (*StorageAuditReport, error) {
+	report := &StorageAuditReport{Issues: []StorageAuditIssue{}}
+
+	expected, err := expectedStorageObjects(db)
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+	now := time.Now()
+	for _, prefix := range []string{"video/", "inst/", "sub/", "versions/", "font/"} {
+		objects, err := getStorage().List(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objects {
+			report.Objects++
+			found[obj.Key] = true
+
+			file, ok := expected[obj.Key]
+			if !ok {
+				if now.Sub(obj.ModTime) < auditOrphanMinAge {
+					continue
+				}
+				issue := StorageAuditIssue{Key: obj.Key, Problem: AuditOrphan, Size: obj.Size}
+				if prefix == "font/" {
+					issue.FontID = objectKeyID(obj.Key)
+				} else {
+					issue.KaraID = objectKeyID(obj.Key)
+				}
+				report.Issues = append(report.Issues, issue)
+				continue
+			}
+
+			// older uploads don't have a size until the init_size_crc job is done
+			if file.kara_id != 0 && file.size > 0 && file.size != obj.Size {
+				report.Issues = append(report.Issues, StorageAuditIssue{
+					Key:          obj.Key,
+					Problem:      AuditSizeMismatch,
+					KaraID:       file.kara_id,
+					VersionID:    file.version_id,
+					Size:         obj.Size,
+					ExpectedSize: file.size,
+				})
+			}
+		}
+	}
+
+	for key, file := range expected {
+		if found[key] {
+			continue
+		}
+		issue := StorageAuditIssue{Key: key, Problem: AuditMissing, KaraID: file.kara_id, VersionID: file.version_id}
+		if file.kara_id == 0 {
+			issue.FontID = objectKeyID(key)
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	slices.SortFunc(report.Issues, func(a, b StorageAuditIssue) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return report, nil
+}
+
+// Clear the upload flag of a missing file, without creating a history entry
+// like when the file is deleted.
+func clearKaraFileUploaded(tx *gorm.DB, kara_id uint, filetype string) error {
+	kara := &KaraInfoDB{}
+	err := tx.Unscoped().First(kara, kara_id).Error
+	if err != nil {
+		return err
+	}
+
+	switch filetype {
+	case "video":
+		kara.VideoUploaded = false
+		err = tx.Unscoped().Model(kara).UpdateColumn("video_uploaded", false).Error
+	case "inst":
+		kara.InstrumentalUploaded = false
+		err = tx.Unscoped().Model(kara).UpdateColumn("instrumental_uploaded", false).Error
+	case "sub":
+		kara.SubtitlesUploaded = false
+		err = tx.Unscoped().Model(kara).UpdateColumn("subtitles_uploaded", false).Error
+		if err == nil {
+			err = deleteKaraLyrics(tx, kara.ID)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return updateUploadStatus(tx.Unscoped(), kara)
+}
+
+// Delete the version of a missing file and clear the upload flag if it was
+// the current file of the kara
+func fixMissingKaraFile(tx *gorm.DB, issue StorageAuditIssue) error {
+	if issue.VersionID != 0 {
+		err := tx.Delete(&KaraFileVersion{}, issue.VersionID).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	kara := KaraInfoDB{}
+	err := tx.Unscoped().First(&kara, issue.KaraID).Error
+	if err != nil {
+		return err
+	}
+	for _, file := range karaUploadedFiles(kara) {
+		key, err := getKaraObjectFilename(kara, file.FileType)
+		if err != nil {
+			return err
+		}
+		if key == issue.Key {
+			return clearKaraFileUploaded(tx, kara.ID, file.FileType)
+		}
+	}
+	return nil
+}
+
+// Delete the orphan objects and forget the missing files.
+// Size mismatches and missing fonts are only reported.
+func FixStorage(ctx context.Context, db *gorm.DB, report *StorageAuditReport) error {
+	for i := range report.Issues {
+		issue := &report.Issues[i]
+		switch issue.Problem {
+		case AuditOrphan:
+			err := deleteFile(ctx, issue.Key)
+			if err != nil {
+				return err
+			}
+			issue.Fixed = true
+		case AuditMissing:
+			if issue.KaraID == 0 {
+				continue
+			}
+			err := transaction(db, func(tx *gorm.DB) error {
+				return fixMissingKaraFile(tx, *issue)
+			})
+			if err != nil {
+				return err
+			}
+			issue.Fixed = true
+		}
+	}
+	return nil
+}
+
+type StorageAuditOutput struct {
+	Body StorageAuditReport
+}
+
+func GetStorageAudit(ctx context.Context, input *struct{}) (*StorageAuditOutput, error) {
+	report, err := AuditStorage(ctx, GetDB(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return &StorageAuditOutput{Body: *report}, nil
+}
+
+func FixStorageAudit(ctx context.Context, input *struct{}) (*StorageAuditOutput, error) {
+	db := GetDB(ctx)
+	report, err := AuditStorage(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	err = FixStorage(ctx, db, report)
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+	return &StorageAuditOutput{Body: *report}, nil
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Files stored in a directory, the user metadata of a file is kept in a JSON
+// file of the .metadata directory.
+type LocalStorage struct {
+	Directory string
+}
+
+var localMetadataDirectory = ".metadata"
+
+func NewLocalStorage(directory string) (*LocalStorage, error) {
+	if directory == "" {
+		return nil, errors.New("storage directory is not set")
+	}
+	err := os.MkdirAll(directory, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStorage{Directory: directory}, nil
+}
+
+func (s *LocalStorage) path(key string) (string, error) {
+	path := filepath.FromSlash(key)
+	if !filepath.IsLocal(path) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		// reserved for metadata and files being written
+		if strings.HasPrefix(part, ".") {
+			return "", fmt.Errorf("invalid object key %q", key)
+		}
+	}
+	return filepath.Join(s.Directory, path), nil
+}
+
+func (s *LocalStorage) metadataPath(key string) string {
+	return filepath.Join(s.Directory, localMetadataDirectory, filepath.FromSlash(key)+".json")
+}
+
+func (s *LocalStorage) readMetadata(key string) (map[string]string, error) {
+	b, err := os.ReadFile(s.metadataPath(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	user_metadata := map[string]string{}
+	err = json.Unmarshal(b, &user_metadata)
+	return user_metadata, err
+}
+
+func (s *LocalStorage) writeMetadata(key string, user_metadata map[string]string) error {
+	path := s.metadataPath(key)
+	if len(user_metadata) == 0 {
+		err := os.Remove(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	b, err := json.Marshal(user_metadata)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	// replaced at once so readers never get partial metadata
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".metadata-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// no-op once renamed
+		_ = os.Remove(tmp.Name())
+	}()
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	close_err := tmp.Close()
+	if err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// The file is written next to its destination and renamed once complete so
+// readers never get a partial file.
+func (s *LocalStorage) Put(ctx context.Context, key string, r io.Reader, size int64, user_metadata map[string]string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// no-op once renamed
+		_ = os.Remove(tmp.Name())
+	}()
+
+	written, err := io.Copy(tmp, r)
+	if err == nil && size >= 0 && written != size {
+		err = fmt.Errorf("wrote %d bytes of %s, expected %d", written, key, size)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	close_err := tmp.Close()
+	if err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return err
+	}
+
+	// the metadata of the previous file is kept if the file can't be replaced
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return err
+	}
+	return s.writeMetadata(key, user_metadata)
+}
+
+type localObject struct {
+	*os.File
+	storage *LocalStorage
+	key     string
+}
+
+func (o localObject) Stat() (ObjectInfo, error) {
+	stat, err := o.File.Stat()
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	user_metadata, err := o.storage.readMetadata(o.key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Key: o.key, Size: stat.Size(), ModTime: stat.ModTime(), UserMetadata: user_metadata}, nil
+}
+
+func (s *LocalStorage) Get(ctx context.Context, key string) (StorageObject, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return localObject{fd, s, key}, nil
+}
+
+// Deleting a missing file is not an error, like on S3
+func (s *LocalStorage) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return s.writeMetadata(key, nil)
+}
+
+func (s *LocalStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	err := filepath.WalkDir(s.Directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), ".") && path != s.Directory {
+			// metadata and files being written
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.Directory, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return objects, err
+}
@@ -18,7 +18,6 @@ import (
 
 	"github.com/danielgtaylor/huma/v2"
 	"github.com/ironsmile/nedomi/utils/httputils"
-	"github.com/minio/minio-go/v7"
 	"github.com/valyala/fasthttp"
 	"gorm.io/gorm"
 )
@@ -194,7 +193,7 @@ func UploadKaraFile(ctx context.Context, input *UploadInput) (*UploadOutput, err
 	}
 
 	resp := &UploadOutput{}
-	err = db.Transaction(func(tx *gorm.DB) error {
+	err = transaction(db, func(tx *gorm.DB) error {
 		res, err := SaveTempFileToS3(ctx, tx, input.File, &kara, input.FileType)
 		if err != nil {
 			return err
@@ -210,7 +209,7 @@ func UploadKaraFile(ctx context.Context, input *UploadInput) (*UploadOutput, err
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, DBErrToHumaErr(err)
 	}
 
 	return resp, err
@@ -248,8 +247,13 @@ func serveObject(obj_file string, range_header string, filename string) (*huma.S
 			fiber_ctx := ctx.BodyWriter().(*fasthttp.RequestCtx)
 
 			obj, err := GetObject(context.Background(), obj_file)
+			if errors.Is(err, ErrObjectNotFound) {
+				ctx.SetStatus(404)
+				return
+			}
 			if err != nil {
 				ctx.SetStatus(500)
+				getLogger().Println(err)
 				return
 			}
 
@@ -268,12 +272,12 @@ func serveObject(obj_file string, range_header string, filename string) (*huma.S
 			stat, err := obj.Stat()
 
 			if err != nil {
-				resp := minio.ToErrorResponse(err)
-				if resp.Code == "NoSuchKey" {
+				Closer(obj)
+				if errors.Is(err, ErrObjectNotFound) {
 					ctx.SetStatus(404)
 				} else {
 					ctx.SetStatus(500)
-					getLogger().Printf("%+v\n", resp)
+					getLogger().Printf("%+v\n", err)
 				}
 				return
 			}
@@ -349,12 +353,10 @@ func DownloadHead(ctx context.Context, input *DownloadInput) (*DownloadHeadOutpu
 		return nil, err
 	}
 
-	obj, err := GetKaraObject(ctx, kara, input.FileType)
-	if err != nil {
-		return nil, err
+	stat, err := StatKaraObject(ctx, kara, input.FileType)
+	if errors.Is(err, ErrObjectNotFound) {
+		return nil, huma.Error404NotFound("file not found")
 	}
-
-	stat, err := obj.Stat()
 	if err != nil {
 		return nil, err
 	}
@@ -419,15 +421,40 @@ func DeleteKaraFile(ctx context.Context, input *DownloadInput) (*DeleteOutput, e
 	if err != nil {
 		return nil, err
 	}
+	err = transaction(db, func(tx *gorm.DB) error {
+		// older versions are kept
+		err := tx.Where(&KaraFileVersion{Key: obj}).Delete(&KaraFileVersion{}).Error
+		if err != nil {
+			return err
+		}
 
-	switch input.FileType {
-	case "video":
-		err = db.Model(&kara).Updates(&KaraInfoDB{UploadInfo: UploadInfo{VideoUploaded: false}}).Error
-	case "inst":
-		err = db.Model(&kara).Updates(&KaraInfoDB{UploadInfo: UploadInfo{InstrumentalUploaded: false}}).Error
-	case "sub":
-		err = db.Model(&kara).Updates(&KaraInfoDB{UploadInfo: UploadInfo{SubtitlesUploaded: false}}).Error
-	}
+		// the kara doesn't point to the deleted version anymore
+		var columns []string
+		switch input.FileType {
+		case "video":
+			kara.VideoUploaded = false
+			kara.VideoVersionID = 0
+			columns = []string{"VideoUploaded", "VideoVersionID"}
+		case "inst":
+			kara.InstrumentalUploaded = false
+			kara.InstrumentalVersionID = 0
+			columns = []string{"InstrumentalUploaded", "InstrumentalVersionID"}
+		case "sub":
+			kara.SubtitlesUploaded = false
+			kara.SubtitlesVersionID = 0
+			columns = []string{"SubtitlesUploaded", "SubtitlesVersionID"}
+		}
+		columns = append(columns, "EditorUserID", "UpdatedAt")
+		err = tx.Model(&kara).Select(columns).Updates(&kara).Error
+		if err != nil {
+			return err
+		}
+
+		if input.FileType == "sub" {
+			return deleteKaraLyrics(tx, kara.ID)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
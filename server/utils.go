@@ -1,12 +1,9 @@
 package server
 
 import (
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
-
-	"gorm.io/gorm"
 )
 
 // Close but you can’t have an error returned so you can safely defer it
@@ -33,26 +30,3 @@ func Do(client *http.Client, req *http.Request) (*http.Response, error) {
 
 	return resp, err
 }
-
-func extendETag(last_item_id uint, err error, etag *uint) error {
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			err = nil
-		}
-	} else {
-		*etag += last_item_id
-	}
-
-	return err
-}
-
-func setETag(last_item_id uint, err error, etag *string) error {
-	etag_n := uint(0)
-	err = extendETag(last_item_id, err, &etag_n)
-	if err != nil {
-		return err
-	}
-
-	*etag = fmt.Sprint(etag_n)
-	return nil
-}
@@ -0,0 +1,346 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"gorm.io/gorm"
+)
+
+// Uploaded file of a kara, the current one is referenced by the UploadInfo of
+// the kara. Files uploaded before versioning get a version with their
+// original key when they are replaced.
+type KaraFileVersion struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	KaraID    uint      `gorm:"index" json:"kara_id"`
+	FileType  string    `json:"file_type" enum:"video,inst,sub"`
+	// object key in the storage
+	Key        string  `json:"-"`
+	Size       int64   `json:"size"`
+	CRC32      uint32  `json:"crc32"`
+	UploaderID *string `json:"uploader_id"`
+	// results of the last checks of the file
+	CheckPassed   bool     `json:"check_passed"`
+	CheckMessages []string `gorm:"serializer:json" json:"check_messages"`
+	Duration      int32    `json:"duration"`
+	Current       bool     `gorm:"-" json:"current"`
+}
+
+func karaFileVersionKey(version KaraFileVersion) string {
+	return fmt.Sprintf("versions/%s/%d/%d", version.FileType, version.KaraID, version.ID)
+}
+
+func legacyKaraObjectFilename(kara_id uint, filetype string) string {
+	return fmt.Sprintf("%s/%d", filetype, kara_id)
+}
+
+// ID of the current version of a file, 0 for files uploaded before versioning
+func karaFileVersionID(kara KaraInfoDB, filetype string) uint {
+	switch filetype {
+	case "video":
+		return kara.VideoVersionID
+	case "inst":
+		return kara.InstrumentalVersionID
+	case "sub":
+		return kara.SubtitlesVersionID
+	}
+	return 0
+}
+
+func karaFileUploaded(kara KaraInfoDB, filetype string) bool {
+	switch filetype {
+	case "video":
+		return kara.VideoUploaded
+	case "inst":
+		return kara.InstrumentalUploaded
+	case "sub":
+		return kara.SubtitlesUploaded
+	}
+	return false
+}
+
+// Keep the file uploaded before versioning as a version so it isn't lost
+// when it is replaced
+func archiveLegacyKaraFile(tx *gorm.DB, kara KaraInfoDB, filetype string) error {
+	if !karaFileUploaded(kara, filetype) || karaFileVersionID(kara, filetype) != 0 {
+		return nil
+	}
+	file := karaFile{}
+	for _, uploaded := range karaUploadedFiles(kara) {
+		if uploaded.FileType == filetype {
+			file = uploaded
+		}
+	}
+
+	key := legacyKaraObjectFilename(kara.ID, filetype)
+	var count int64
+	err := tx.Model(&KaraFileVersion{}).Where(&KaraFileVersion{Key: key}).Count(&count).Error
+	if err != nil || count > 0 {
+		return err
+	}
+	return tx.Create(&KaraFileVersion{
+		CreatedAt:   file.ModTime,
+		KaraID:      kara.ID,
+		FileType:    filetype,
+		Key:         key,
+		Size:        file.Size,
+		CRC32:       file.CRC32,
+		CheckPassed: true,
+		Duration:    kara.Duration,
+	}).Error
+}
+
+// Make version the current file of the kara and check it
+func setCurrentKaraFile(ctx context.Context, tx *gorm.DB, kara *KaraInfoDB, version *KaraFileVersion) (*CheckKaraOutput, error) {
+	version_id := version.ID
+	if version.Key == legacyKaraObjectFilename(kara.ID, version.FileType) {
+		version_id = 0
+	}
+
+	currentTime := time.Now().UTC()
+	var columns []string
+	switch version.FileType {
+	case "video":
+		kara.VideoUploaded = true
+		kara.VideoModTime = currentTime
+		kara.VideoSize = version.Size
+		kara.VideoCRC32 = version.CRC32
+		kara.VideoVersionID = version_id
+		columns = []string{"VideoUploaded", "VideoModTime", "VideoSize", "VideoCRC32", "VideoVersionID"}
+	case "inst":
+		kara.InstrumentalUploaded = true
+		kara.InstrumentalModTime = currentTime
+		kara.InstrumentalSize = version.Size
+		kara.InstrumentalCRC32 = version.CRC32
+		kara.InstrumentalVersionID = version_id
+		columns = []string{"InstrumentalUploaded", "InstrumentalModTime", "InstrumentalSize", "InstrumentalCRC32", "InstrumentalVersionID"}
+	case "sub":
+		kara.SubtitlesUploaded = true
+		kara.SubtitlesModTime = currentTime
+		kara.SubtitlesSize = version.Size
+		kara.SubtitlesCRC32 = version.CRC32
+		kara.SubtitlesVersionID = version_id
+		columns = []string{"SubtitlesUploaded", "SubtitlesModTime", "SubtitlesSize", "SubtitlesCRC32", "SubtitlesVersionID", "Hardsubbed"}
+		if kara.KaraokeCreationTime.Before(time.Unix(1, 0)) {
+			kara.KaraokeCreationTime = currentTime
+			columns = append(columns, "KaraokeCreationTime")
+			tx = WithNewKaraUpdate(tx)
+		}
+	default:
+		return nil, errors.New("Unknown file type " + version.FileType)
+	}
+	columns = append(columns, "EditorUserID", "UpdatedAt")
+
+	err := tx.Model(kara).Select(columns).Updates(kara).Error
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := CheckKara(ctx, *kara)
+	if err != nil {
+		EVENTS.Publish(EventCheckFailed, FileEventData{KaraID: kara.ID, FileType: version.FileType, Error: err.Error()})
+		return nil, err
+	}
+
+	// files that are not uploaded have no results
+	switch {
+	case version.FileType == "video" && res.Video != nil:
+		version.CheckPassed = res.Video.Passed
+		version.CheckMessages = res.Video.Messages
+		version.Duration = res.Video.Duration
+	case version.FileType == "inst" && res.Instrumental != nil:
+		version.CheckPassed = res.Instrumental.Passed
+		version.CheckMessages = res.Instrumental.Messages
+		version.Duration = res.Instrumental.Duration
+	case version.FileType == "sub" && res.Subtitles != nil:
+		version.CheckPassed = res.Subtitles.Passed
+		err = setKaraLyrics(tx, kara.ID, res.Subtitles.Lyrics)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tx.Model(version).
+		Select("CheckPassed", "CheckMessages", "Duration").
+		Updates(version).Error
+	if err != nil {
+		return nil, err
+	}
+
+	err = postFileWebhooks(tx, *kara, version.FileType)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Video != nil {
+		if res.Video.Duration != kara.Duration {
+			err = tx.Model(kara).Updates(KaraInfoDB{
+				UploadInfo: UploadInfo{Duration: res.Video.Duration},
+			}).Error
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// Delete the oldest versions of a file above the configured limit, the
+// current one is kept
+func pruneKaraFileVersions(ctx context.Context, tx *gorm.DB, kara KaraInfoDB, filetype string) error {
+	if CONFIG.Storage.MaxVersions <= 0 {
+		return nil
+	}
+	current_key, err := getKaraObjectFilename(kara, filetype)
+	if err != nil {
+		return err
+	}
+
+	versions := []KaraFileVersion{}
+	err = tx.Where(&KaraFileVersion{KaraID: kara.ID, FileType: filetype}).
+		Where("key <> ?", current_key).
+		Order("created_at DESC, id DESC").
+		Offset(CONFIG.Storage.MaxVersions - 1).
+		Find(&versions).Error
+	if err != nil {
+		return err
+	}
+
+	for _, version := range versions {
+		err = tx.Delete(&version).Error
+		if err != nil {
+			return err
+		}
+		afterCommit(tx, func() {
+			err := deleteFile(ctx, version.Key)
+			if err != nil {
+				getLogger().Printf("could not delete version %d of kara %d: %s", version.ID, kara.ID, err)
+			}
+		})
+	}
+	return nil
+}
+
+type KaraFileVersionsInput struct {
+	KID      uint   `path:"id" example:"1"`
+	FileType string `path:"filetype" enum:"video,sub,inst" example:"video"`
+}
+
+type KaraFileVersionsOutput struct {
+	Body struct {
+		Versions []KaraFileVersion `json:"versions"`
+	}
+}
+
+// Versions of a file, the most recent first
+func GetKaraFileVersions(ctx context.Context, input *KaraFileVersionsInput) (*KaraFileVersionsOutput, error) {
+	db := GetDB(ctx)
+	kara, err := GetKaraByID(db, input.KID)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &KaraFileVersionsOutput{}
+	err = db.Where(&KaraFileVersion{KaraID: kara.ID, FileType: input.FileType}).
+		Order("created_at DESC, id DESC").
+		Find(&out.Body.Versions).Error
+	if err != nil {
+		return nil, err
+	}
+
+	current_key, err := getKaraObjectFilename(kara, input.FileType)
+	if err != nil {
+		return nil, err
+	}
+	for i := range out.Body.Versions {
+		version := &out.Body.Versions[i]
+		version.Current = karaFileUploaded(kara, input.FileType) && version.Key == current_key
+	}
+	return out, nil
+}
+
+type KaraFileVersionInput struct {
+	KID       uint   `path:"id" example:"1"`
+	FileType  string `path:"filetype" enum:"video,sub,inst" example:"video"`
+	VersionID uint   `path:"version_id" example:"1"`
+}
+
+func getKaraFileVersion(tx *gorm.DB, kara_id uint, filetype string, version_id uint) (KaraFileVersion, error) {
+	version := KaraFileVersion{}
+	err := tx.Where(&KaraFileVersion{KaraID: kara_id, FileType: filetype}).
+		First(&version, version_id).Error
+	return version, DBErrToHumaErr(err)
+}
+
+type DownloadKaraFileVersionInput struct {
+	KaraFileVersionInput
+	Range string `header:"Range"`
+}
+
+func DownloadKaraFileVersion(ctx context.Context, input *DownloadKaraFileVersionInput) (*huma.StreamResponse, error) {
+	db := GetDB(ctx)
+	kara, err := GetKaraByID(db, input.KID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, user_err := getCurrentUser(ctx)
+	if kara.Private && user_err != nil {
+		// return forbidden response for private karas for external users
+		return nil, huma.Error403Forbidden("private kara")
+	}
+
+	version, err := getKaraFileVersion(db, kara.ID, input.FileType, input.VersionID)
+	if err != nil {
+		return nil, err
+	}
+
+	filename := fmt.Sprintf("%s.%d%s", kara.FriendlyName(), version.ID, FileTypeExtension(input.FileType))
+	return serveObject(version.Key, input.Range, filename)
+}
+
+// Make an older version the current file again
+func PromoteKaraFileVersion(ctx context.Context, input *KaraFileVersionInput) (*UploadOutput, error) {
+	db := GetDB(ctx)
+	resp := &UploadOutput{}
+	version := KaraFileVersion{}
+	err := transaction(db, func(tx *gorm.DB) error {
+		kara, err := GetKaraByID(tx, input.KID)
+		if err != nil {
+			return err
+		}
+		version, err = getKaraFileVersion(tx, kara.ID, input.FileType, input.VersionID)
+		if err != nil {
+			return err
+		}
+
+		err = archiveLegacyKaraFile(tx, kara, input.FileType)
+		if err != nil {
+			return err
+		}
+
+		res, err := setCurrentKaraFile(ctx, tx, &kara, &version)
+		if err != nil {
+			return err
+		}
+		resp.Body.CheckResults = *res
+		resp.Body.KID = kara.ID
+
+		err = disableMugenFileImportForKara(tx, kara.ID)
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	EVENTS.Publish(EventFileUploaded, FileEventData{KaraID: input.KID, FileType: input.FileType, Size: version.Size, CRC32: version.CRC32})
+	return resp, nil
+}
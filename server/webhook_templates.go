@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/google/uuid"
+)
+
+var webhookTemplateFuncs = template.FuncMap{
+	// JSON encoded value, to put strings in JSON bodies
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join": strings.Join,
+	"upper": func(v any) string {
+		return strings.ToUpper(fmt.Sprint(v))
+	},
+	"lower": func(v any) string {
+		return strings.ToLower(fmt.Sprint(v))
+	},
+}
+
+func parseWebhookTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(webhookTemplateFuncs).Option("missingkey=error").Parse(text)
+}
+
+func executeWebhookTemplate(tmpl *template.Template, tmplCtx WebhookTemplateContext) (string, error) {
+	var b bytes.Buffer
+	err := tmpl.Execute(&b, tmplCtx)
+	return b.String(), err
+}
+
+// Body and headers of a webhook using templates, the body is generated by
+// its type if there is no body template
+func (w Webhook) render(tmplCtx WebhookTemplateContext) ([]byte, map[string]string, error) {
+	var body []byte
+	var err error
+	if w.BodyTemplate == "" {
+		body, err = w.body(tmplCtx)
+	} else {
+		var tmpl *template.Template
+		tmpl, err = parseWebhookTemplate("body", w.BodyTemplate)
+		if err == nil {
+			var rendered string
+			rendered, err = executeWebhookTemplate(tmpl, tmplCtx)
+			body = []byte(rendered)
+		}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("body: %w", err)
+	}
+
+	headers := map[string]string{}
+	for name, text := range w.HeaderTemplates {
+		tmpl, err := parseWebhookTemplate(name, text)
+		if err != nil {
+			return nil, nil, fmt.Errorf("header %s: %w", name, err)
+		}
+		value, err := executeWebhookTemplate(tmpl, tmplCtx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("header %s: %w", name, err)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, nil, fmt.Errorf("header %s: value contains a line break", name)
+		}
+		headers[name] = value
+	}
+	return body, headers, nil
+}
+
+// Context with every field set, templates using fields of a single event
+// type can be rendered
+func sampleWebhookTemplateContext() WebhookTemplateContext {
+	kara := KaraInfoDB{}
+	kara.ID = 1
+	kara.Title = "Sample karaoke"
+	kara.SourceMedia = &MediaDB{Name: "Sample media", Type: "ANIME"}
+	timestamp := uint(1500)
+	return WebhookTemplateContext{
+		Event:       WebhookTest,
+		Kara:        kara,
+		Issue:       &KaraIssue{KaraID: kara.ID, Type: IssueTypeTiming, Status: IssueOpen, Timestamp: &timestamp},
+		FileType:    "video",
+		DeliveryID:  uuid.New(),
+		Time:        time.Now().UTC(),
+		Server:      CONFIG.Listen.BaseURL,
+		Title:       kara.FriendlyName(),
+		Description: "Sample description",
+		Resource:    karaResource(kara),
+	}
+}
+
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check the templates when a webhook is saved
+func (w Webhook) checkTemplates() error {
+	for name := range w.HeaderTemplates {
+		if !isHeaderName(name) {
+			return huma.Error422UnprocessableEntity(fmt.Sprintf("invalid header name %q", name))
+		}
+	}
+	_, _, err := w.render(sampleWebhookTemplateContext())
+	if err != nil {
+		return huma.Error422UnprocessableEntity(fmt.Sprintf("invalid template: %s", err))
+	}
+	return nil
+}
+
+type PreviewWebhookInput struct {
+	Body struct {
+		Type            string            `json:"type" enum:"json,discord,matrix,slack"`
+		BodyTemplate    string            `json:"body_template,omitempty"`
+		HeaderTemplates map[string]string `json:"header_templates,omitempty"`
+		Event           WebhookEvent      `json:"event" enum:"kara_created,kara_updated,kara_deleted,file_uploaded,file_corrupted,issue_opened,issue_resolved,test"`
+		KaraID          uint              `json:"kara_id" doc:"kara of the event, the last issue of the kara is used for issue events"`
+	}
+}
+
+type PreviewWebhookOutput struct {
+	Body struct {
+		Body    string            `json:"body"`
+		Headers map[string]string `json:"headers"`
+	}
+}
+
+// Render a webhook for an event of a kara, the webhook doesn't need to be saved
+func PreviewWebhook(ctx context.Context, input *PreviewWebhookInput) (*PreviewWebhookOutput, error) {
+	db := GetDB(ctx)
+	out := &PreviewWebhookOutput{}
+
+	webhook := Webhook{
+		Type:            input.Body.Type,
+		BodyTemplate:    input.Body.BodyTemplate,
+		HeaderTemplates: input.Body.HeaderTemplates,
+	}
+	err := webhook.checkTemplates()
+	if err != nil {
+		return nil, err
+	}
+
+	kara := KaraInfoDB{}
+	err = db.Scopes(KaraAssociations, CurrentKaras).First(&kara, input.Body.KaraID).Error
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	var tmplCtx WebhookTemplateContext
+	switch input.Body.Event {
+	case WebhookIssueOpened, WebhookIssueResolved:
+		issue := KaraIssue{}
+		err = db.Scopes(IssuesAssociations).Where(&KaraIssue{KaraID: kara.ID}).Last(&issue).Error
+		if err != nil {
+			return nil, DBErrToHumaErr(err)
+		}
+		tmplCtx = issueTemplateContext(input.Body.Event, kara, issue)
+	case WebhookFileUploaded:
+		tmplCtx = fileTemplateContext(kara, "video")
+	case WebhookFileCorrupted:
+		tmplCtx = corruptedFileTemplateContext(kara, KaraFileScrub{KaraID: kara.ID, FileType: "video", Status: ScrubMissing})
+	case WebhookTest:
+		tmplCtx = testTemplateContext()
+	default:
+		tmplCtx, err = karaTemplateContext(input.Body.Event, kara)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tmplCtx.DeliveryID = uuid.New()
+	tmplCtx.Time = time.Now().UTC()
+
+	body, headers, err := webhook.render(tmplCtx)
+	if err != nil {
+		return nil, huma.Error422UnprocessableEntity(err.Error())
+	}
+	out.Body.Body = string(body)
+	out.Body.Headers = headers
+	return out, nil
+}
@@ -1,84 +1,719 @@
 package server
 
 import (
-	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"io"
 	"net/http"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
-type Webhook struct {
-	Type string
-	URL  string
+type WebhookEvent string
+
+var WebhookKaraCreated WebhookEvent = "kara_created"
+var WebhookKaraUpdated WebhookEvent = "kara_updated"
+var WebhookKaraDeleted WebhookEvent = "kara_deleted"
+var WebhookFileUploaded WebhookEvent = "file_uploaded"
+var WebhookFileCorrupted WebhookEvent = "file_corrupted"
+var WebhookIssueOpened WebhookEvent = "issue_opened"
+var WebhookIssueResolved WebhookEvent = "issue_resolved"
+
+// Sent by the test action, webhooks can't subscribe to it
+var WebhookTest WebhookEvent = "test"
+
+// Name displayed in the message of chat webhooks
+func (e WebhookEvent) DisplayName() string {
+	switch e {
+	case WebhookKaraUpdated:
+		return "Karaoke updated"
+	case WebhookKaraDeleted:
+		return "Karaoke deleted"
+	case WebhookFileUploaded:
+		return "File uploaded"
+	case WebhookFileCorrupted:
+		return "File corrupted"
+	case WebhookIssueOpened:
+		return "Issue reported"
+	case WebhookIssueResolved:
+		return "Issue resolved"
+	case WebhookTest:
+		return "Test event"
+	default:
+		return "New Karaoke!"
+	}
+}
+
+func (e WebhookEvent) Color() uint {
+	switch e {
+	case WebhookKaraDeleted, WebhookIssueOpened, WebhookFileCorrupted:
+		return 15158332
+	case WebhookIssueResolved:
+		return 3066993
+	case WebhookKaraUpdated, WebhookFileUploaded, WebhookTest:
+		return 3447003
+	default:
+		return 10053324
+	}
 }
 
 type WebhookTemplateContext struct {
-	Kara        KaraInfoDB
+	Event WebhookEvent
+	Kara  KaraInfoDB
+	// only set for issue events
+	Issue *KaraIssue
+	// only set for file events
+	FileType string `json:",omitempty"`
+	// sent in the X-Karaberus-Delivery header
+	DeliveryID uuid.UUID
+	// time of the event
+	Time        time.Time
 	Server      string
 	Title       string
 	Description string
 	Resource    string
 }
 
-func parseWebhooksConfig() []Webhook {
-	var webhooks []Webhook
+type Webhook struct {
+	ID        uint           `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	Type      string         `json:"type" enum:"json,discord,matrix,slack"`
+	URL       string         `json:"url"`
+	// key of the X-Karaberus-Signature header or access token of matrix
+	// webhooks, it is not returned by the API
+	Secret    string         `json:"-"`
+	HasSecret bool           `gorm:"-" json:"has_secret"`
+	Events    []WebhookEvent `gorm:"serializer:json" json:"events"`
+	// disabled webhooks don't get new events
+	Enabled bool `json:"enabled"`
+	// text/template of the body executed with WebhookTemplateContext,
+	// replaces the body generated for the type
+	BodyTemplate string `json:"body_template"`
+	// text/templates of additional headers
+	HeaderTemplates map[string]string `gorm:"serializer:json" json:"header_templates"`
+}
+
+func (w *Webhook) AfterFind(tx *gorm.DB) error {
+	w.HasSecret = w.Secret != ""
+	return nil
+}
+
+func (w *Webhook) AfterSave(tx *gorm.DB) error {
+	w.HasSecret = w.Secret != ""
+	return nil
+}
+
+func (w Webhook) subscribed(event WebhookEvent) bool {
+	return slices.Contains(w.Events, event)
+}
+
+// Import the webhooks of the KARABERUS_WEBHOOKS variable, they get the
+// events they used to get before webhooks were managed through the API
+func importWebhooksConfig(db *gorm.DB) {
 	for _, kv := range CONFIG.Webhooks {
 		typ, url, found := strings.Cut(kv, "=")
 		if !found {
 			getLogger().Printf("invalid webhook value: %s", kv)
 			continue
 		}
-		webhooks = append(webhooks, Webhook{typ, url})
+		webhook := Webhook{
+			Type:    typ,
+			URL:     url,
+			Secret:  CONFIG.WebhooksSecret,
+			Events:  []WebhookEvent{WebhookKaraCreated, WebhookIssueOpened, WebhookIssueResolved},
+			Enabled: true,
+		}
+		err := db.Create(&webhook).Error
+		if err != nil {
+			panic(err)
+		}
 	}
-	return webhooks
 }
 
-func PostWebhooks(kara KaraInfoDB) {
-	title := kara.FriendlyName()
+func karaTemplateContext(event WebhookEvent, kara KaraInfoDB) (WebhookTemplateContext, error) {
 	desc, err := karaDescription(kara)
+	return WebhookTemplateContext{
+		Event:       event,
+		Kara:        kara,
+		Server:      CONFIG.Listen.BaseURL,
+		Title:       kara.FriendlyName(),
+		Description: desc,
+		Resource:    karaResource(kara),
+	}, err
+}
+
+func postKaraWebhooks(tx *gorm.DB, event WebhookEvent, kara KaraInfoDB) error {
+	tmplCtx, err := karaTemplateContext(event, kara)
 	if err != nil {
 		getLogger().Printf("error generating description for webhooks: %s", err)
-		return
+		return nil
 	}
+	return enqueueWebhooks(tx, tmplCtx)
+}
 
-	tmplCtx := WebhookTemplateContext{
+func fileTemplateContext(kara KaraInfoDB, file_type string) WebhookTemplateContext {
+	return WebhookTemplateContext{
+		Event:       WebhookFileUploaded,
 		Kara:        kara,
+		FileType:    file_type,
 		Server:      CONFIG.Listen.BaseURL,
-		Title:       title,
-		Description: desc,
-		Resource:    fmt.Sprintf("%s/karaoke/browse/%d", CONFIG.Listen.BaseURL, kara.ID),
-	}
-
-	for _, webhook := range parseWebhooksConfig() {
-		var err error
-		switch webhook.Type {
-		case "json":
-			err = postJsonWebhook(webhook.URL, tmplCtx)
-		case "discord":
-			err = postDiscordWebhook(webhook.URL, tmplCtx)
-		default:
-			err = fmt.Errorf("unknown webhook type %s", webhook.Type)
+		Title:       kara.FriendlyName(),
+		Description: karaDescriptionPart("File", file_type),
+		Resource:    karaResource(kara),
+	}
+}
+
+func postFileWebhooks(tx *gorm.DB, kara KaraInfoDB, file_type string) error {
+	return enqueueWebhooks(tx, fileTemplateContext(kara, file_type))
+}
+
+func corruptedFileTemplateContext(kara KaraInfoDB, scrub KaraFileScrub) WebhookTemplateContext {
+	tmplCtx := fileTemplateContext(kara, scrub.FileType)
+	tmplCtx.Event = WebhookFileCorrupted
+	problem := scrub.Status
+	if scrub.Error != "" {
+		problem += ", " + scrub.Error
+	}
+	tmplCtx.Description += "\n" + karaDescriptionPart("Problem", problem)
+	return tmplCtx
+}
+
+func postFileCorruptedWebhooks(tx *gorm.DB, kara KaraInfoDB, scrub KaraFileScrub) error {
+	return enqueueWebhooks(tx, corruptedFileTemplateContext(kara, scrub))
+}
+
+func testTemplateContext() WebhookTemplateContext {
+	return WebhookTemplateContext{
+		Event:       WebhookTest,
+		Server:      CONFIG.Listen.BaseURL,
+		Title:       "Test event",
+		Description: "This webhook is set up properly.",
+		Resource:    CONFIG.Listen.BaseURL,
+	}
+}
+
+func karaResource(kara KaraInfoDB) string {
+	return fmt.Sprintf("%s/karaoke/browse/%d", CONFIG.Listen.BaseURL, kara.ID)
+}
+
+var WebhookDeliveryPending = "pending"
+var WebhookDeliveryDelivered = "delivered"
+var WebhookDeliveryFailed = "failed"
+
+// Outbox of the webhooks, the body is generated when the event happens and
+// sent until the receiver accepts it
+type WebhookDelivery struct {
+	// sent in the X-Karaberus-Delivery header, receivers can use it to ignore duplicates
+	ID        uuid.UUID    `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+	WebhookID uint         `gorm:"index" json:"webhook_id"`
+	Webhook   *Webhook     `gorm:"constraint:OnDelete:CASCADE" json:"-"`
+	Event     WebhookEvent `json:"event"`
+	Body      string       `json:"body"`
+	// rendered header templates of the webhook
+	Headers  map[string]string `gorm:"serializer:json" json:"headers"`
+	Status   string            `gorm:"index" json:"status" enum:"pending,delivered,failed"`
+	Attempts int               `json:"attempts"`
+	// nil once delivered or failed
+	NextAttemptAt *time.Time `gorm:"index" json:"next_attempt_at"`
+	// set while the delivery is sent, it can be claimed again after that if
+	// the attempt was interrupted
+	ClaimedUntil *time.Time `json:"-"`
+	DeliveredAt  *time.Time `json:"delivered_at"`
+	// status code of the last response, 0 if there was none
+	LastStatus int    `json:"last_status"`
+	LastError  string `json:"last_error"`
+}
+
+func (w Webhook) body(tmplCtx WebhookTemplateContext) ([]byte, error) {
+	switch w.Type {
+	case "json":
+		return json.Marshal(tmplCtx)
+	case "discord":
+		return json.Marshal(discordWebhookData(tmplCtx))
+	case "matrix":
+		return json.Marshal(matrixWebhookData(tmplCtx))
+	case "slack":
+		return json.Marshal(slackWebhookData(tmplCtx))
+	default:
+		return nil, fmt.Errorf("unknown webhook type %s", w.Type)
+	}
+}
+
+func newWebhookDelivery(webhook Webhook, tmplCtx WebhookTemplateContext) (*WebhookDelivery, error) {
+	now := time.Now().UTC()
+	tmplCtx.DeliveryID = uuid.New()
+	tmplCtx.Time = now
+	body, headers, err := webhook.render(tmplCtx)
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookDelivery{
+		ID:            tmplCtx.DeliveryID,
+		WebhookID:     webhook.ID,
+		Webhook:       &webhook,
+		Event:         tmplCtx.Event,
+		Body:          string(body),
+		Headers:       headers,
+		Status:        WebhookDeliveryPending,
+		NextAttemptAt: &now,
+	}, nil
+}
+
+// Add the deliveries of the event to the webhooks subscribed to it, they are
+// sent by the delivery worker once the transaction is committed
+func enqueueWebhooks(tx *gorm.DB, tmplCtx WebhookTemplateContext) error {
+	webhooks := []Webhook{}
+	err := tx.Where(&Webhook{Enabled: true}).Find(&webhooks).Error
+	if err != nil {
+		return err
+	}
+
+	enqueued := false
+	for _, webhook := range webhooks {
+		if !webhook.subscribed(tmplCtx.Event) {
+			continue
 		}
+		delivery, err := newWebhookDelivery(webhook, tmplCtx)
 		if err != nil {
-			getLogger().Printf("error during %s webhook: %s", webhook, err)
+			getLogger().Printf("error during webhook %d: %s", webhook.ID, err)
+			continue
+		}
+		err = tx.Omit("Webhook").Create(delivery).Error
+		if err != nil {
+			return err
 		}
+		enqueued = true
 	}
+
+	if enqueued {
+		afterCommit(tx, notifyWebhookWorker)
+	}
+	return nil
 }
 
-func postJsonWebhook(url string, tmplCtx WebhookTemplateContext) error {
-	b, err := json.Marshal(tmplCtx)
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+// Longer than an attempt so deliveries are not claimed while they are sent
+var webhookClaimDuration = 2 * time.Minute
+
+// Deliveries sent at the same time
+var webhookConcurrency = 4
+
+// Deliveries are abandoned after this many failed attempts
+var webhookMaxAttempts = 10
+
+// Delay before the first retry, doubled after each failure
+var webhookRetryDelay = 30 * time.Second
+var webhookMaxRetryDelay = 6 * time.Hour
+
+func webhookRetryBackoff(attempts int) time.Duration {
+	delay := webhookRetryDelay
+	for i := 1; i < attempts && delay < webhookMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, webhookMaxRetryDelay)
+}
+
+// HMAC-SHA256 of the body with the secret of the webhook
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func sendWebhook(ctx context.Context, delivery *WebhookDelivery) error {
+	body := []byte(delivery.Body)
+	webhook := delivery.Webhook
+	if webhook == nil {
+		return errors.New("the webhook was deleted")
+	}
+
+	method := http.MethodPost
+	url := webhook.URL
+	if webhook.Type == "matrix" {
+		// the delivery ID is the transaction ID so the homeserver ignores retries
+		// of a message it already received
+		method = http.MethodPut
+		url = strings.TrimSuffix(url, "/") + "/" + delivery.ID.String()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(delivery.Body))
 	if err != nil {
 		return err
 	}
-	resp, err := http.Post(url, "application/json", bytes.NewReader(b))
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range delivery.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("X-Karaberus-Event", string(delivery.Event))
+	req.Header.Set("X-Karaberus-Delivery", delivery.ID.String())
+	if webhook.Type == "matrix" {
+		req.Header.Set("Authorization", "Bearer "+webhook.Secret)
+	} else if webhook.Secret != "" {
+		req.Header.Set("X-Karaberus-Signature", webhookSignature(webhook.Secret, body))
+	}
+
+	resp, err := webhookClient.Do(req)
 	if err != nil {
 		return err
 	}
 	defer Closer(resp.Body)
+
+	delivery.LastStatus = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("received code %d: %s", resp.StatusCode, msg)
+	}
 	return nil
 }
 
+// Send the delivery once and save the result
+func attemptWebhookDelivery(ctx context.Context, tx *gorm.DB, delivery *WebhookDelivery) error {
+	delivery.Attempts++
+	delivery.LastStatus = 0
+	err := sendWebhook(ctx, delivery)
+
+	now := time.Now().UTC()
+	if err == nil {
+		delivery.Status = WebhookDeliveryDelivered
+		delivery.DeliveredAt = &now
+		delivery.NextAttemptAt = nil
+		delivery.LastError = ""
+	} else {
+		getLogger().Printf("error during webhook delivery %s: %s", delivery.ID, err)
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= webhookMaxAttempts || delivery.Webhook == nil {
+			delivery.Status = WebhookDeliveryFailed
+			delivery.NextAttemptAt = nil
+		} else {
+			delivery.Status = WebhookDeliveryPending
+			next_attempt := now.Add(webhookRetryBackoff(delivery.Attempts))
+			delivery.NextAttemptAt = &next_attempt
+		}
+	}
+
+	delivery.ClaimedUntil = nil
+	return tx.Omit("Webhook").Save(delivery).Error
+}
+
+// Only protects the claims, deliveries are sent without it
+var webhookDeliveryMutex = sync.Mutex{}
+
+func claimWebhookDeliveries(tx *gorm.DB, deliveries []WebhookDelivery, now time.Time) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+	claimed_until := now.Add(webhookClaimDuration)
+	ids := make([]uuid.UUID, len(deliveries))
+	for i := range deliveries {
+		deliveries[i].ClaimedUntil = &claimed_until
+		ids[i] = deliveries[i].ID
+	}
+	return tx.Model(&WebhookDelivery{}).
+		Where("id IN ?", ids).
+		UpdateColumn("claimed_until", claimed_until).Error
+}
+
+// Claim the deliveries that are due so they are only sent once
+func claimPendingWebhookDeliveries(db *gorm.DB) ([]WebhookDelivery, error) {
+	webhookDeliveryMutex.Lock()
+	defer webhookDeliveryMutex.Unlock()
+
+	deliveries := []WebhookDelivery{}
+	err := transaction(db, func(tx *gorm.DB) error {
+		now := time.Now().UTC()
+		err := lockForUpdate(tx).Preload("Webhook").
+			Where("status = ? AND next_attempt_at <= ?", WebhookDeliveryPending, now).
+			Where("claimed_until IS NULL OR claimed_until <= ?", now).
+			Order("next_attempt_at ASC").
+			Limit(100).
+			Find(&deliveries).Error
+		if err != nil {
+			return err
+		}
+		return claimWebhookDeliveries(tx, deliveries, now)
+	})
+	return deliveries, err
+}
+
+// Send the deliveries that are due
+func DeliverPendingWebhooks(ctx context.Context) {
+	db := GetDB(ctx)
+	deliveries, err := claimPendingWebhookDeliveries(db)
+	if err != nil {
+		getLogger().Println(err)
+		return
+	}
+
+	sem := make(chan struct{}, webhookConcurrency)
+	wg := sync.WaitGroup{}
+	for i := range deliveries {
+		sem <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			err := attemptWebhookDelivery(ctx, db, &deliveries[i])
+			if err != nil {
+				getLogger().Println(err)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+var webhookNotifyChannel = make(chan bool, 1)
+
+// Notify the delivery worker (non blocking)
+func notifyWebhookWorker() {
+	select {
+	case webhookNotifyChannel <- true:
+	default:
+	}
+}
+
+// Deliveries enqueued in a transaction that is not committed yet when the
+// worker is notified are sent on the next poll
+var webhookPollInterval = 30 * time.Second
+
+func DeliverWebhooksLoop(ctx context.Context) {
+	for {
+		DeliverPendingWebhooks(ctx)
+		select {
+		case <-webhookNotifyChannel:
+		case <-time.After(webhookPollInterval):
+		}
+	}
+}
+
+type GetWebhookDeliveriesInput struct {
+	Status string `query:"status" enum:"pending,delivered,failed," doc:"only return the deliveries with this status"`
+	Limit  int    `query:"limit" default:"100" minimum:"1" maximum:"1000"`
+}
+
+type WebhookDeliveriesOutput struct {
+	Body struct {
+		Deliveries []WebhookDelivery `json:"deliveries"`
+	}
+}
+
+func GetWebhookDeliveries(ctx context.Context, input *GetWebhookDeliveriesInput) (*WebhookDeliveriesOutput, error) {
+	db := GetDB(ctx)
+	out := &WebhookDeliveriesOutput{}
+
+	query := db.Order("created_at DESC").Limit(input.Limit)
+	if input.Status != "" {
+		query = query.Where(&WebhookDelivery{Status: input.Status})
+	}
+	err := query.Find(&out.Body.Deliveries).Error
+	return out, DBErrToHumaErr(err)
+}
+
+type RedeliverWebhookInput struct {
+	ID uuid.UUID `path:"id"`
+}
+
+type WebhookDeliveryOutput struct {
+	Body struct {
+		Delivery WebhookDelivery `json:"delivery"`
+	}
+}
+
+func claimWebhookDelivery(db *gorm.DB, delivery *WebhookDelivery, id uuid.UUID) error {
+	webhookDeliveryMutex.Lock()
+	defer webhookDeliveryMutex.Unlock()
+
+	return transaction(db, func(tx *gorm.DB) error {
+		err := lockForUpdate(tx).Preload("Webhook").First(delivery, id).Error
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		if delivery.ClaimedUntil != nil && delivery.ClaimedUntil.After(now) {
+			return huma.Error409Conflict("the delivery is being sent")
+		}
+		return claimWebhookDeliveries(tx, []WebhookDelivery{*delivery}, now)
+	})
+}
+
+// Send a delivery again now, failed deliveries get a new series of retries
+func RedeliverWebhook(ctx context.Context, input *RedeliverWebhookInput) (*WebhookDeliveryOutput, error) {
+	db := GetDB(ctx)
+	out := &WebhookDeliveryOutput{}
+
+	delivery := &out.Body.Delivery
+	err := claimWebhookDelivery(db, delivery, input.ID)
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	if delivery.Status == WebhookDeliveryFailed {
+		delivery.Attempts = 0
+	}
+	err = attemptWebhookDelivery(ctx, db, delivery)
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+	return out, nil
+}
+
+type WebhookInfo struct {
+	Type string `json:"type" enum:"json,discord,matrix,slack"`
+	URL  string `json:"url" format:"uri"`
+	// nil keeps the current secret
+	Secret  *string        `json:"secret,omitempty" doc:"key of the X-Karaberus-Signature header, empty for unsigned deliveries, access token of the bot for matrix webhooks"`
+	Events  []WebhookEvent `json:"events" enum:"kara_created,kara_updated,kara_deleted,file_uploaded,file_corrupted,issue_opened,issue_resolved"`
+	Enabled bool           `json:"enabled"`
+	// text/template executed with WebhookTemplateContext, empty for the body of the type
+	BodyTemplate    string            `json:"body_template,omitempty"`
+	HeaderTemplates map[string]string `json:"header_templates,omitempty"`
+}
+
+func (info WebhookInfo) to_Webhook(webhook *Webhook) {
+	webhook.Type = info.Type
+	webhook.URL = info.URL
+	if info.Secret != nil {
+		webhook.Secret = *info.Secret
+	}
+	webhook.Events = info.Events
+	webhook.Enabled = info.Enabled
+	webhook.BodyTemplate = info.BodyTemplate
+	webhook.HeaderTemplates = info.HeaderTemplates
+}
+
+type WebhookOutput struct {
+	Body struct {
+		Webhook Webhook `json:"webhook"`
+	}
+}
+
+type AllWebhooksOutput struct {
+	Body struct {
+		Webhooks []Webhook `json:"webhooks"`
+	}
+}
+
+func GetAllWebhooks(ctx context.Context, input *struct{}) (*AllWebhooksOutput, error) {
+	db := GetDB(ctx)
+	out := &AllWebhooksOutput{}
+	err := db.Find(&out.Body.Webhooks).Error
+	return out, DBErrToHumaErr(err)
+}
+
+type GetWebhookInput struct {
+	ID uint `path:"id"`
+}
+
+func GetWebhook(ctx context.Context, input *GetWebhookInput) (*WebhookOutput, error) {
+	db := GetDB(ctx)
+	out := &WebhookOutput{}
+	err := db.First(&out.Body.Webhook, input.ID).Error
+	return out, DBErrToHumaErr(err)
+}
+
+type CreateWebhookInput struct {
+	Body WebhookInfo
+}
+
+func CreateWebhook(ctx context.Context, input *CreateWebhookInput) (*WebhookOutput, error) {
+	db := GetDB(ctx)
+	out := &WebhookOutput{}
+	input.Body.to_Webhook(&out.Body.Webhook)
+	err := out.Body.Webhook.checkTemplates()
+	if err != nil {
+		return nil, err
+	}
+	err = db.Create(&out.Body.Webhook).Error
+	return out, DBErrToHumaErr(err)
+}
+
+type UpdateWebhookInput struct {
+	ID   uint `path:"id"`
+	Body WebhookInfo
+}
+
+func UpdateWebhook(ctx context.Context, input *UpdateWebhookInput) (*WebhookOutput, error) {
+	db := GetDB(ctx)
+	out := &WebhookOutput{}
+
+	webhook := &out.Body.Webhook
+	err := db.First(webhook, input.ID).Error
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+	input.Body.to_Webhook(webhook)
+	err = webhook.checkTemplates()
+	if err != nil {
+		return nil, err
+	}
+	err = db.Select("*").Omit("CreatedAt").Updates(webhook).Error
+	return out, DBErrToHumaErr(err)
+}
+
+type DeleteWebhookOutput struct {
+	Status int
+}
+
+func DeleteWebhook(ctx context.Context, input *GetWebhookInput) (*DeleteWebhookOutput, error) {
+	db := GetDB(ctx)
+	webhook := Webhook{}
+	err := db.First(&webhook, input.ID).Error
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+	err = db.Delete(&webhook).Error
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+	return &DeleteWebhookOutput{204}, nil
+}
+
+// Send a test event to the webhook now, even if it is disabled
+func TestWebhook(ctx context.Context, input *GetWebhookInput) (*WebhookDeliveryOutput, error) {
+	db := GetDB(ctx)
+	out := &WebhookDeliveryOutput{}
+
+	webhook := Webhook{}
+	err := db.First(&webhook, input.ID).Error
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+
+	delivery, err := newWebhookDelivery(webhook, testTemplateContext())
+	if err != nil {
+		return nil, huma.Error422UnprocessableEntity(err.Error())
+	}
+
+	// nobody else sends it
+	claimed_until := time.Now().UTC().Add(webhookClaimDuration)
+	delivery.ClaimedUntil = &claimed_until
+	err = db.Omit("Webhook").Create(delivery).Error
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+	err = attemptWebhookDelivery(ctx, db, delivery)
+	if err != nil {
+		return nil, DBErrToHumaErr(err)
+	}
+	out.Body.Delivery = *delivery
+	return out, nil
+}
+
 type DiscordEmbedAuthor struct {
 	Name    string `json:"name"`
 	IconURL string `json:"icon_url"`
@@ -96,28 +731,103 @@ type DiscordWebhook struct {
 	Embeds []DiscordEmbed `json:"embeds"`
 }
 
-func postDiscordWebhook(url string, tmplCtx WebhookTemplateContext) error {
-	webhook_data := DiscordWebhook{
+func discordWebhookData(tmplCtx WebhookTemplateContext) DiscordWebhook {
+	return DiscordWebhook{
 		Embeds: []DiscordEmbed{{
 			Author: DiscordEmbedAuthor{
-				Name:    "New Karaoke!",
+				Name:    tmplCtx.Event.DisplayName(),
 				IconURL: fmt.Sprintf("%s/vite.svg", tmplCtx.Server),
 			},
 			Title:       tmplCtx.Title,
 			URL:         tmplCtx.Resource,
 			Description: tmplCtx.Description,
-			Color:       10053324,
+			Color:       tmplCtx.Event.Color(),
 		}},
 	}
+}
 
-	body, err := json.Marshal(webhook_data)
-	if err != nil {
-		return err
+// Descriptions use the markdown of Discord: bold parts and line breaks
+var markdownBold = regexp.MustCompile(`\*\*(.+?)\*\*`)
+
+func webhookColor(event WebhookEvent) string {
+	return fmt.Sprintf("#%06x", event.Color())
+}
+
+type MatrixMessage struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format"`
+	FormattedBody string `json:"formatted_body"`
+}
+
+// Notice sent with the client-server API, the URL of matrix webhooks is
+// https://<homeserver>/_matrix/client/v3/rooms/<room id>/send/m.room.message
+func matrixWebhookData(tmplCtx WebhookTemplateContext) MatrixMessage {
+	name := tmplCtx.Event.DisplayName()
+	body := fmt.Sprintf("%s\n%s\n%s\n\n%s", name, tmplCtx.Title, tmplCtx.Resource, tmplCtx.Description)
+
+	description := html.EscapeString(tmplCtx.Description)
+	description = markdownBold.ReplaceAllString(description, "<b>$1</b>")
+	description = strings.ReplaceAll(description, "\n", "<br>")
+	formatted_body := fmt.Sprintf(
+		`<font data-mx-color="%s"><b>%s</b></font><br><a href="%s">%s</a><br><br>%s`,
+		webhookColor(tmplCtx.Event),
+		html.EscapeString(name),
+		html.EscapeString(tmplCtx.Resource),
+		html.EscapeString(tmplCtx.Title),
+		description,
+	)
+
+	return MatrixMessage{
+		MsgType:       "m.notice",
+		Body:          body,
+		Format:        "org.matrix.custom.html",
+		FormattedBody: formatted_body,
 	}
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
-	if err != nil {
-		return err
+}
+
+type SlackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type SlackBlock struct {
+	Type string    `json:"type"`
+	Text SlackText `json:"text"`
+}
+
+type SlackAttachment struct {
+	Color  string       `json:"color"`
+	Blocks []SlackBlock `json:"blocks"`
+}
+
+type SlackWebhook struct {
+	// shown in notifications
+	Text        string            `json:"text"`
+	Attachments []SlackAttachment `json:"attachments"`
+}
+
+// Escape the characters used by the mrkdwn format of Slack
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// Message of Slack incoming webhooks, the colour is set on an attachment
+func slackWebhookData(tmplCtx WebhookTemplateContext) SlackWebhook {
+	name := tmplCtx.Event.DisplayName()
+	title := fmt.Sprintf("*<%s|%s>*", tmplCtx.Resource, slackEscape(tmplCtx.Title))
+	description := markdownBold.ReplaceAllString(slackEscape(tmplCtx.Description), "*$1*")
+
+	blocks := []SlackBlock{
+		{Type: "header", Text: SlackText{Type: "plain_text", Text: name}},
+		{Type: "section", Text: SlackText{Type: "mrkdwn", Text: title}},
+	}
+	if description != "" {
+		blocks = append(blocks, SlackBlock{Type: "section", Text: SlackText{Type: "mrkdwn", Text: description}})
+	}
+
+	return SlackWebhook{
+		Text:        fmt.Sprintf("%s %s", name, tmplCtx.Title),
+		Attachments: []SlackAttachment{{Color: webhookColor(tmplCtx.Event), Blocks: blocks}},
 	}
-	defer Closer(resp.Body)
-	return nil
 }
@@ -47,11 +47,18 @@ export default function KaraokeBrowseId() {
         path: {
           id: parseInt(params.id!),
         },
+        header: {
+          "If-Match": String(getKara()!.kara.Revision),
+        },
       },
     });
 
     if (resp.error) {
       alert(resp.error.detail);
+      // someone else edited the karaoke, show the current version
+      if (resp.response.status === 409) {
+        refetch();
+      }
       return;
     }
 
@@ -60,7 +67,8 @@ export default function KaraokeBrowseId() {
   };
 
   const deleteKaraoke = async () => {
-    if (!confirm("Confirm deletion?")) {
+    const reason = prompt("Reason for the deletion?")?.trim();
+    if (!reason) {
       return;
     }
 
@@ -69,6 +77,9 @@ export default function KaraokeBrowseId() {
         path: {
           id: parseInt(params.id!),
         },
+        query: {
+          reason,
+        },
       },
     });
 
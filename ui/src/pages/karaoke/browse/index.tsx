@@ -22,7 +22,10 @@ const PAGE_SIZE = 9;
 
 export default function KaraokeBrowse() {
   const [getAllKaras] = createResource(async () => {
-    const resp = await karaberus.GET("/api/kara");
+    // the search is done on the whole catalogue
+    const resp = await karaberus.GET("/api/kara", {
+      params: { query: { limit: 0 } },
+    });
     return resp.data?.Karas?.sort((a, b) => b.ID - a.ID);
   });
   const [getAllAudioTags] = createResource(async () => {
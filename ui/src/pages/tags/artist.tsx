@@ -25,14 +25,22 @@ export default function TagsArtist() {
   };
 
   const patchArtist =
-    (id: components["schemas"]["Artist"]["ID"]) =>
+    (current: components["schemas"]["Artist"]) =>
     async (artist: components["schemas"]["ArtistInfo"]) => {
       const resp = await karaberus.PATCH("/api/tags/artist/{id}", {
-        params: { path: { id } },
+        params: {
+          path: { id: current.ID },
+          header: { "If-Match": String(current.Revision) },
+        },
         body: artist,
       });
       if (resp.error) {
         alert(resp.error.detail);
+        // someone else edited the artist, show the current version
+        if (resp.response.status === 409) {
+          getModalRef().close();
+          refetch();
+        }
         return;
       }
       getModalRef().close();
@@ -97,7 +105,7 @@ export default function TagsArtist() {
                         setModal(
                           <ArtistEditor
                             artist={getArtist()}
-                            onSubmit={patchArtist(getArtist().ID)}
+                            onSubmit={patchArtist(getArtist())}
                           />,
                         );
                         getModalRef().showModal();
@@ -25,14 +25,22 @@ export default function TagsMedia() {
   };
 
   const patchMedia =
-    (id: components["schemas"]["MediaDB"]["ID"]) =>
+    (current: components["schemas"]["MediaDB"]) =>
     async (media: components["schemas"]["MediaInfo"]) => {
       const resp = await karaberus.PATCH("/api/tags/media/{id}", {
-        params: { path: { id } },
+        params: {
+          path: { id: current.ID },
+          header: { "If-Match": String(current.revision) },
+        },
         body: media,
       });
       if (resp.error) {
         alert(resp.error.detail);
+        // someone else edited the media, show the current version
+        if (resp.response.status === 409) {
+          getModalRef().close();
+          refetch();
+        }
         return;
       }
       getModalRef().close();
@@ -99,7 +107,7 @@ export default function TagsMedia() {
                         setModal(
                           <MediaEditor
                             media={getMedia()}
-                            onSubmit={patchMedia(getMedia().ID)}
+                            onSubmit={patchMedia(getMedia())}
                           />,
                         );
                         getModalRef().showModal();